@@ -34,6 +34,94 @@ type ClusterResourceQuotaSpec struct {
 	// NamespaceSelector is the selector that is used to select namespaces
 	// +optional
 	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty" protobuf:"bytes,2,opt,name=namespaceSelector"`
+
+	// Topology limits the resources per topology domain, e.g. per zone, in addition to the hard limits
+	// +optional
+	Topology *TopologyResourceQuotaSpec `json:"topology,omitempty" protobuf:"bytes,3,opt,name=topology"`
+
+	// Queueing queues pods which exceed the quota by a scheduling gate instead of rejecting them
+	// +optional
+	Queueing *QueueingSpec `json:"queueing,omitempty" protobuf:"bytes,4,opt,name=queueing"`
+
+	// Reclaim evicts pods when the usage stays above the hard limits, e.g. after the hard limits are reduced
+	// +optional
+	Reclaim *ReclaimSpec `json:"reclaim,omitempty" protobuf:"bytes,5,opt,name=reclaim"`
+
+	// Budget limits the consumption of resources over time, e.g. GPU-hours per month, in addition to the hard limits
+	// +optional
+	Budget *BudgetSpec `json:"budget,omitempty" protobuf:"bytes,6,opt,name=budget"`
+}
+
+type BudgetSpec struct {
+	// Period is the length of a budget period, e.g. 720h, the consumption is reset at the start of each period
+	// +required
+	Period metav1.Duration `json:"period" protobuf:"bytes,1,opt,name=period"`
+
+	// StartTime is the start of the first period, periods start at StartTime plus a multiple of Period,
+	// defaults to the creation time of the ClusterResourceQuota
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty" protobuf:"bytes,2,opt,name=startTime"`
+
+	// Hard is the consumption allowed per period in resource-hours, keyed by the resources of pods,
+	// e.g. "requests.nvidia.com/gpu: 2000" is 2000 GPU-hours
+	Hard corev1.ResourceList `json:"hard,omitempty" protobuf:"bytes,3,rep,name=hard,casttype=ResourceList,castkey=ResourceName"`
+}
+
+// +kubebuilder:validation:Enum=None;Evict
+type ReclaimPolicy string
+
+const (
+	// ReclaimPolicyNone keeps the usage above the hard limits until pods are removed by their owners
+	ReclaimPolicyNone ReclaimPolicy = "None"
+	// ReclaimPolicyEvict evicts pods of lowest priority first, then newest first, until the usage is under the hard limits
+	ReclaimPolicyEvict ReclaimPolicy = "Evict"
+)
+
+type ReclaimSpec struct {
+	// Policy is what to do when the usage exceeds the hard limits, defaults to None
+	// +optional
+	Policy ReclaimPolicy `json:"policy,omitempty" protobuf:"bytes,1,opt,name=policy,casttype=ReclaimPolicy"`
+
+	// GracePeriodSeconds is how long the usage may exceed the hard limits before pods are evicted
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	GracePeriodSeconds *int64 `json:"gracePeriodSeconds,omitempty" protobuf:"varint,2,opt,name=gracePeriodSeconds"`
+}
+
+// +kubebuilder:validation:Enum=FIFO;Priority
+type QueueingPolicy string
+
+const (
+	// QueueingPolicyFIFO releases queued pods in the order they are created
+	QueueingPolicyFIFO QueueingPolicy = "FIFO"
+	// QueueingPolicyPriority releases queued pods of higher priority first, then in the order they are created
+	QueueingPolicyPriority QueueingPolicy = "Priority"
+)
+
+type QueueingSpec struct {
+	// Policy is the order in which queued pods are released, defaults to FIFO
+	// +optional
+	Policy QueueingPolicy `json:"policy,omitempty" protobuf:"bytes,1,opt,name=policy,casttype=QueueingPolicy"`
+}
+
+type TopologyResourceQuotaSpec struct {
+	// Key is the node label key of the topology, e.g. topology.kubernetes.io/zone
+	// +required
+	Key string `json:"key" protobuf:"bytes,1,opt,name=key"`
+
+	// +optional
+	// +listType=map
+	// +listMapKey=value
+	// Domains is the list of hard limits per value of the topology label
+	Domains []TopologyDomainResourceQuota `json:"domains,omitempty" protobuf:"bytes,2,rep,name=domains"`
+}
+
+type TopologyDomainResourceQuota struct {
+	// Value is the value of the topology label, e.g. the zone name
+	// +required
+	Value string `json:"value" protobuf:"bytes,1,opt,name=value"`
+	// Hard is the set of hard limits of pods in the domain, across all selected namespaces
+	Hard corev1.ResourceList `json:"hard,omitempty" protobuf:"bytes,2,rep,name=hard,casttype=ResourceList,castkey=ResourceName"`
 }
 
 // ClusterStatus is information about the current status of a License.
@@ -45,6 +133,37 @@ type ClusterResourceQuotaStatus struct {
 	// +listMapKey=name
 	// Namespaces is the list of namespaces on which the resource quota is applied
 	Namespaces []NamespaceResourceQuota `json:"namespaces,omitempty" protobuf:"bytes,2,rep,name=namespaces"`
+
+	// +optional
+	// +listType=map
+	// +listMapKey=value
+	// Topology is the list of topology domains on which the resource quota is applied
+	Topology []TopologyResourceQuotaStatus `json:"topology,omitempty" protobuf:"bytes,3,rep,name=topology"`
+
+	// +optional
+	// ExceededSince is the time the usage started to exceed the hard limits, it's set when a reclaim policy is set
+	ExceededSince *metav1.Time `json:"exceededSince,omitempty" protobuf:"bytes,4,opt,name=exceededSince"`
+
+	// +optional
+	// Budget is the consumption of the current budget period
+	Budget *BudgetStatus `json:"budget,omitempty" protobuf:"bytes,5,opt,name=budget"`
+}
+
+type BudgetStatus struct {
+	// PeriodStart is the start of the current budget period
+	PeriodStart metav1.Time `json:"periodStart,omitempty" protobuf:"bytes,1,opt,name=periodStart"`
+	// LastUpdateTime is the time until which the consumption is accounted
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty" protobuf:"bytes,2,opt,name=lastUpdateTime"`
+	// Used is the consumption of the current period in resource-hours
+	Used corev1.ResourceList `json:"used,omitempty" protobuf:"bytes,3,rep,name=used,casttype=ResourceList,castkey=ResourceName"`
+}
+
+type TopologyResourceQuotaStatus struct {
+	// Value is the value of the topology label
+	// +required
+	Value string              `json:"value,omitempty" protobuf:"bytes,1,opt,name=value"`
+	Hard  corev1.ResourceList `json:"hard,omitempty" protobuf:"bytes,2,rep,name=hard,casttype=ResourceList,castkey=ResourceName"`
+	Used  corev1.ResourceList `json:"used,omitempty" protobuf:"bytes,3,rep,name=used,casttype=ResourceList,castkey=ResourceName"`
 }
 
 type NamespaceResourceQuota struct {
@@ -27,6 +27,59 @@ import (
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BudgetSpec) DeepCopyInto(out *BudgetSpec) {
+	*out = *in
+	out.Period = in.Period
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Hard != nil {
+		in, out := &in.Hard, &out.Hard
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BudgetSpec.
+func (in *BudgetSpec) DeepCopy() *BudgetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(BudgetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BudgetStatus) DeepCopyInto(out *BudgetStatus) {
+	*out = *in
+	in.PeriodStart.DeepCopyInto(&out.PeriodStart)
+	in.LastUpdateTime.DeepCopyInto(&out.LastUpdateTime)
+	if in.Used != nil {
+		in, out := &in.Used, &out.Used
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BudgetStatus.
+func (in *BudgetStatus) DeepCopy() *BudgetStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BudgetStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClusterResourceQuota) DeepCopyInto(out *ClusterResourceQuota) {
 	*out = *in
@@ -97,6 +150,26 @@ func (in *ClusterResourceQuotaSpec) DeepCopyInto(out *ClusterResourceQuotaSpec)
 		*out = new(metav1.LabelSelector)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Topology != nil {
+		in, out := &in.Topology, &out.Topology
+		*out = new(TopologyResourceQuotaSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Queueing != nil {
+		in, out := &in.Queueing, &out.Queueing
+		*out = new(QueueingSpec)
+		**out = **in
+	}
+	if in.Reclaim != nil {
+		in, out := &in.Reclaim, &out.Reclaim
+		*out = new(ReclaimSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Budget != nil {
+		in, out := &in.Budget, &out.Budget
+		*out = new(BudgetSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -121,6 +194,22 @@ func (in *ClusterResourceQuotaStatus) DeepCopyInto(out *ClusterResourceQuotaStat
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Topology != nil {
+		in, out := &in.Topology, &out.Topology
+		*out = make([]TopologyResourceQuotaStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ExceededSince != nil {
+		in, out := &in.ExceededSince, &out.ExceededSince
+		*out = (*in).DeepCopy()
+	}
+	if in.Budget != nil {
+		in, out := &in.Budget, &out.Budget
+		*out = new(BudgetStatus)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -157,6 +246,43 @@ func (in *NamespaceResourceQuota) DeepCopy() *NamespaceResourceQuota {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QueueingSpec) DeepCopyInto(out *QueueingSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QueueingSpec.
+func (in *QueueingSpec) DeepCopy() *QueueingSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(QueueingSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReclaimSpec) DeepCopyInto(out *ReclaimSpec) {
+	*out = *in
+	if in.GracePeriodSeconds != nil {
+		in, out := &in.GracePeriodSeconds, &out.GracePeriodSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReclaimSpec.
+func (in *ReclaimSpec) DeepCopy() *ReclaimSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ReclaimSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ResourceQuota) DeepCopyInto(out *ResourceQuota) {
 	*out = *in
@@ -217,3 +343,79 @@ func (in *ResourceQuotaList) DeepCopyObject() runtime.Object {
 	}
 	return nil
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TopologyDomainResourceQuota) DeepCopyInto(out *TopologyDomainResourceQuota) {
+	*out = *in
+	if in.Hard != nil {
+		in, out := &in.Hard, &out.Hard
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TopologyDomainResourceQuota.
+func (in *TopologyDomainResourceQuota) DeepCopy() *TopologyDomainResourceQuota {
+	if in == nil {
+		return nil
+	}
+	out := new(TopologyDomainResourceQuota)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TopologyResourceQuotaSpec) DeepCopyInto(out *TopologyResourceQuotaSpec) {
+	*out = *in
+	if in.Domains != nil {
+		in, out := &in.Domains, &out.Domains
+		*out = make([]TopologyDomainResourceQuota, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TopologyResourceQuotaSpec.
+func (in *TopologyResourceQuotaSpec) DeepCopy() *TopologyResourceQuotaSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TopologyResourceQuotaSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TopologyResourceQuotaStatus) DeepCopyInto(out *TopologyResourceQuotaStatus) {
+	*out = *in
+	if in.Hard != nil {
+		in, out := &in.Hard, &out.Hard
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.Used != nil {
+		in, out := &in.Used, &out.Used
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TopologyResourceQuotaStatus.
+func (in *TopologyResourceQuotaStatus) DeepCopy() *TopologyResourceQuotaStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TopologyResourceQuotaStatus)
+	in.DeepCopyInto(out)
+	return out
+}
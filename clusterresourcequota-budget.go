@@ -0,0 +1,472 @@
+package clusterresourcequota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/admission"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	quotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+	thislisters "xiaoshiai.cn/clusterresourcequota/generated/listers/quota/v1"
+)
+
+// BudgetAccountingInterval is the interval the consumption of pods is accounted into the budget status.
+const BudgetAccountingInterval = time.Minute
+
+// NewClusterResourceQuotaBudget sets up the accounting of budgets of ClusterResourceQuotas,
+// evaluator is the pod evaluator used by the resourcequota webhook.
+func NewClusterResourceQuotaBudget(mgr manager.Manager, evaluator quota.Evaluator) error {
+	controller := &ClusterResourceQuotaBudgetReconciler{
+		Client:    mgr.GetClient(),
+		Evaluator: evaluator,
+		Clock:     clock.RealClock{},
+		Interval:  BudgetAccountingInterval,
+	}
+	return controller.Setup(mgr)
+}
+
+// ClusterResourceQuotaBudgetReconciler integrates the usage of the pods of a ClusterResourceQuota over their lifetimes,
+// and accounts it as resource-hours into the budget status of the current period.
+// The pods deleted are recorded by [ClusterResourceQuotaBudgetReconciler.OnPodDelete] and accounted right away,
+// so the time they ran since the last accounting is charged although they are not listed any more.
+type ClusterResourceQuotaBudgetReconciler struct {
+	Client    client.Client
+	Evaluator quota.Evaluator
+	Clock     clock.Clock
+	Interval  time.Duration
+
+	lock sync.Mutex
+	// deleted are the pods deleted since the last accounting by the name of ClusterResourceQuota
+	deleted map[string]map[types.UID]deletedPod
+	// accounted is the time until which the pods listed are charged by the last accounting, by the name of ClusterResourceQuota
+	accounted map[string]map[types.UID]time.Time
+}
+
+// deletedPod is a pod deleted, it's charged until it terminated or was deleted.
+type deletedPod struct {
+	pod     *corev1.Pod
+	deleted time.Time
+}
+
+func (a *ClusterResourceQuotaBudgetReconciler) Setup(mgr manager.Manager) error {
+	return builder.ControllerManagedBy(mgr).
+		Named("clusterresourcequota-budget").
+		// the consumption is accounted periodically, updates of the status are not watched
+		For(&quotav1.ClusterResourceQuota{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(a.OnPodDelete), builder.WithPredicates(predicate.Funcs{
+			CreateFunc:  func(event.CreateEvent) bool { return false },
+			UpdateFunc:  func(event.UpdateEvent) bool { return false },
+			GenericFunc: func(event.GenericEvent) bool { return false },
+		})).
+		Complete(a)
+}
+
+// OnPodDelete records the pod deleted for the ClusterResourceQuotas with budgets matching it,
+// and requests their accounting.
+func (a *ClusterResourceQuotaBudgetReconciler) OnPodDelete(ctx context.Context, obj client.Object) []reconcile.Request {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil
+	}
+	names, err := a.budgetsOf(ctx, pod)
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "find budgets of pod deleted", "pod", client.ObjectKeyFromObject(pod))
+		return nil
+	}
+	now := a.Clock.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	requests := []reconcile.Request{}
+	for _, name := range names {
+		if a.deleted == nil {
+			a.deleted = map[string]map[types.UID]deletedPod{}
+		}
+		if a.deleted[name] == nil {
+			a.deleted[name] = map[types.UID]deletedPod{}
+		}
+		a.deleted[name][pod.UID] = deletedPod{pod: pod.DeepCopy(), deleted: now}
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKey{Name: name}})
+	}
+	return requests
+}
+
+// budgetsOf returns the names of the ClusterResourceQuotas with budgets whose ResourceQuotas match the pod.
+func (a *ClusterResourceQuotaBudgetReconciler) budgetsOf(ctx context.Context, pod *corev1.Pod) ([]string, error) {
+	quotaslist := &quotav1.ResourceQuotaList{}
+	if err := a.Client.List(ctx, quotaslist, client.InNamespace(pod.Namespace), client.HasLabels{LabelClusterResourceQuota}); err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := range quotaslist.Items {
+		rq := &quotaslist.Items[i]
+		name := rq.Labels[LabelClusterResourceQuota]
+		if rq.Labels[LabelClusterResourceQuotaTopology] != "" || slices.Contains(names, name) {
+			continue
+		}
+		crq := &quotav1.ClusterResourceQuota{}
+		if err := a.Client.Get(ctx, client.ObjectKey{Name: name}, crq); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if crq.Spec.Budget == nil {
+			continue
+		}
+		matched, err := a.Evaluator.Matches(toQuota(rq), pod)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (a *ClusterResourceQuotaBudgetReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	crq := &quotav1.ClusterResourceQuota{}
+	if err := a.Client.Get(ctx, req.NamespacedName, crq); err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	if crq.DeletionTimestamp != nil {
+		a.forget(crq.Name)
+		return reconcile.Result{}, nil
+	}
+	budget := crq.Spec.Budget
+	if budget == nil || budget.Period.Duration <= 0 {
+		a.forget(crq.Name)
+		return reconcile.Result{}, a.setBudgetStatus(ctx, crq, nil)
+	}
+	// the time in the status is stored in seconds
+	now := a.Clock.Now().Truncate(time.Second)
+	periodStart := BudgetPeriodStart(budget, crq.CreationTimestamp.Time, now)
+
+	status := crq.Status.Budget.DeepCopy()
+	from := periodStart
+	if status != nil && status.PeriodStart.Time.Equal(periodStart) {
+		if status.LastUpdateTime.Time.After(periodStart) {
+			from = status.LastUpdateTime.Time
+		}
+	} else {
+		// a new period starts with nothing consumed
+		status = &quotav1.BudgetStatus{PeriodStart: metav1.NewTime(periodStart)}
+	}
+	var accounting *budgetAccounting
+	if now.After(from) {
+		consumed, result, err := a.consumption(ctx, crq, periodStart, from, now)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		status.Used = quota.Add(status.Used, consumed)
+		accounting = result
+	}
+	for name := range budget.Hard {
+		if _, ok := status.Used[name]; !ok {
+			status.Used = quota.Add(status.Used, corev1.ResourceList{name: resource.MustParse("0")})
+		}
+	}
+	requeue := reconcile.Result{RequeueAfter: min(a.Interval, periodStart.Add(budget.Period.Duration).Sub(now))}
+	if previous := crq.Status.Budget; previous != nil && previous.PeriodStart.Equal(&status.PeriodStart) && quota.Equals(previous.Used, status.Used) {
+		// nothing consumed, the consumption since the last update is accounted by the next one
+		a.finishAccounting(crq.Name, from, accounting)
+		return requeue, nil
+	}
+	status.LastUpdateTime = metav1.NewTime(now)
+	if err := a.setBudgetStatus(ctx, crq, status); err != nil {
+		return reconcile.Result{}, err
+	}
+	a.finishAccounting(crq.Name, from, accounting)
+	return requeue, nil
+}
+
+// budgetAccounting is the pods charged by an accounting.
+type budgetAccounting struct {
+	// listed is the time until which the pods listed are charged
+	listed map[types.UID]time.Time
+	// deleted are the pods deleted which are charged
+	deleted []types.UID
+}
+
+// consumption returns the resource-hours consumed by the pods of the ClusterResourceQuota between from and to.
+// Pods are charged while they run, the pods deleted are charged until they were deleted,
+// from the last accounting listing them, as they may be deleted before they are recorded.
+func (a *ClusterResourceQuotaBudgetReconciler) consumption(ctx context.Context, crq *quotav1.ClusterResourceQuota, periodStart, from, to time.Time) (corev1.ResourceList, *budgetAccounting, error) {
+	pods, err := clusterResourceQuotaPods(ctx, a.Client, a.Evaluator, crq)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.lock.Lock()
+	deleted, accounted := maps.Clone(a.deleted[crq.Name]), a.accounted[crq.Name]
+	a.lock.Unlock()
+
+	names := quota.ResourceNames(crq.Spec.Budget.Hard)
+	consumed := corev1.ResourceList{}
+	charge := func(pod *corev1.Pod, from, to time.Time) error {
+		start, end, ok := podRunningInterval(pod, to)
+		if !ok {
+			return nil
+		}
+		start, end = maxTime(start, from), minTime(end, to)
+		if !end.After(start) {
+			return nil
+		}
+		// terminated pods are not charged by the evaluator, their usage is what they used while running
+		running := pod.DeepCopy()
+		running.Status.Phase = corev1.PodRunning
+		usage, err := a.Evaluator.Usage(running)
+		if err != nil {
+			return err
+		}
+		consumed = quota.Add(consumed, resourceHours(quota.Mask(usage, names), end.Sub(start)))
+		return nil
+	}
+	result := &budgetAccounting{listed: map[types.UID]time.Time{}}
+	for i := range pods {
+		result.listed[pods[i].UID] = to
+		// the pod deleted is still listed by the cache, it is charged as listed
+		delete(deleted, pods[i].UID)
+		if err := charge(&pods[i], from, to); err != nil {
+			return nil, nil, err
+		}
+	}
+	for uid, pod := range deleted {
+		start := from
+		if at, ok := accounted[uid]; ok && at.Before(from) {
+			start = maxTime(at, periodStart)
+		}
+		if err := charge(pod.pod, start, minTime(pod.deleted, to)); err != nil {
+			return nil, nil, err
+		}
+		result.deleted = append(result.deleted, uid)
+	}
+	return consumed, result, nil
+}
+
+// finishAccounting forgets the pods deleted which are charged, and records the time the pods listed are charged until.
+// A pod not listed any more is remembered until the next accounting, in case it's deleted but not recorded yet.
+func (a *ClusterResourceQuotaBudgetReconciler) finishAccounting(name string, from time.Time, accounting *budgetAccounting) {
+	if accounting == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, uid := range accounting.deleted {
+		delete(a.deleted[name], uid)
+	}
+	for uid, at := range a.accounted[name] {
+		if _, ok := accounting.listed[uid]; !ok && !at.Before(from) && !slices.Contains(accounting.deleted, uid) {
+			accounting.listed[uid] = at
+		}
+	}
+	if a.accounted == nil {
+		a.accounted = map[string]map[types.UID]time.Time{}
+	}
+	a.accounted[name] = accounting.listed
+}
+
+// forget forgets the pods of the ClusterResourceQuota which has no budget any more.
+func (a *ClusterResourceQuotaBudgetReconciler) forget(name string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.deleted, name)
+	delete(a.accounted, name)
+}
+
+func (a *ClusterResourceQuotaBudgetReconciler) setBudgetStatus(ctx context.Context, crq *quotav1.ClusterResourceQuota, status *quotav1.BudgetStatus) error {
+	if crq.Status.Budget == nil && status == nil {
+		return nil
+	}
+	original := crq.DeepCopy()
+	crq.Status.Budget = status
+	if err := a.Client.Status().Patch(ctx, crq, client.MergeFrom(original)); err != nil {
+		return fmt.Errorf("update budget of clusterresourcequota %s: %w", crq.Name, err)
+	}
+	return nil
+}
+
+// BudgetPeriodStart returns the start of the budget period containing now,
+// periods start at the start time of the budget, or the creation time, plus a multiple of the period.
+func BudgetPeriodStart(budget *quotav1.BudgetSpec, created, now time.Time) time.Time {
+	anchor := created
+	if budget.StartTime != nil {
+		anchor = budget.StartTime.Time
+	}
+	period := budget.Period.Duration
+	elapsed := now.Sub(anchor)
+	n := elapsed / period
+	if elapsed < 0 && elapsed%period != 0 {
+		n--
+	}
+	return anchor.Add(n * period)
+}
+
+// podRunningInterval returns the time the pod started, and the time it terminated or now if it's still running.
+func podRunningInterval(pod *corev1.Pod, now time.Time) (time.Time, time.Time, bool) {
+	if pod.Status.StartTime == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	start := pod.Status.StartTime.Time
+	if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+		return start, now, true
+	}
+	var finished time.Time
+	for _, status := range slices.Concat(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses) {
+		if terminated := status.State.Terminated; terminated != nil && terminated.FinishedAt.Time.After(finished) {
+			finished = terminated.FinishedAt.Time
+		}
+	}
+	if finished.IsZero() {
+		return time.Time{}, time.Time{}, false
+	}
+	return start, finished, true
+}
+
+// resourceHours returns the usage integrated over the duration, in resource-hours.
+func resourceHours(usage corev1.ResourceList, d time.Duration) corev1.ResourceList {
+	result := corev1.ResourceList{}
+	for name, value := range usage {
+		hours := value.AsApproximateFloat64() * d.Hours()
+		result[name] = *resource.NewMilliQuantity(int64(math.Round(hours*1000)), resource.DecimalSI)
+	}
+	return result
+}
+
+var _ admission.ValidationInterface = &PodBudgetAdmission{}
+
+// PodBudgetAdmission rejects the pods requesting resources whose budget of a ClusterResourceQuota is exhausted,
+// pods queued by a ClusterResourceQuota are admitted, they are checked against the budget when released from the queue.
+// Other requests are passed to the wrapped admission as is.
+type PodBudgetAdmission struct {
+	admission.ValidationInterface
+	Evaluator                  quota.Evaluator
+	QuotaLister                corev1listers.ResourceQuotaLister
+	ClusterResourceQuotaLister thislisters.ClusterResourceQuotaLister
+}
+
+func (a *PodBudgetAdmission) Validate(ctx context.Context, attr admission.Attributes, o admission.ObjectInterfaces) error {
+	if attr.GetOperation() != admission.Create || attr.GetSubresource() != "" || attr.GetResource().GroupResource() != corev1.Resource("pods") {
+		return a.ValidationInterface.Validate(ctx, attr, o)
+	}
+	pod, ok := attr.GetObject().(*corev1.Pod)
+	if !ok || IsPodQueued(pod) {
+		return a.ValidationInterface.Validate(ctx, attr, o)
+	}
+	exhausted, err := a.exhaustedBudget(pod)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	if exhausted != "" {
+		return admission.NewForbidden(attr, errors.New(exhausted))
+	}
+	return a.ValidationInterface.Validate(ctx, attr, o)
+}
+
+// exhaustedBudget returns why the pod can not be admitted by the budgets of the ClusterResourceQuotas matching it, or empty if it can.
+func (a *PodBudgetAdmission) exhaustedBudget(pod *corev1.Pod) (string, error) {
+	quotas, err := a.QuotaLister.ResourceQuotas(pod.Namespace).List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+	var usage corev1.ResourceList
+	for _, rq := range quotas {
+		name := rq.Labels[LabelClusterResourceQuota]
+		// the domains of topology share the budget of the ClusterResourceQuota
+		if name == "" || rq.Labels[LabelClusterResourceQuotaTopology] != "" {
+			continue
+		}
+		crq, err := a.ClusterResourceQuotaLister.Get(name)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return "", err
+		}
+		if crq.Spec.Budget == nil {
+			continue
+		}
+		matched, err := a.Evaluator.Matches(rq, pod)
+		if err != nil {
+			return "", err
+		}
+		if !matched {
+			continue
+		}
+		if usage == nil {
+			if usage, err = a.Evaluator.Usage(pod); err != nil {
+				return "", err
+			}
+		}
+		if exhausted := exhaustedBudgetMessage(crq, usage); exhausted != "" {
+			return exhausted, nil
+		}
+	}
+	return "", nil
+}
+
+// exhaustedBudgetMessage returns why the usage can not be admitted if it requests any resource
+// whose budget of the current period is exhausted, or empty if not.
+func exhaustedBudgetMessage(crq *quotav1.ClusterResourceQuota, usage corev1.ResourceList) string {
+	budget, status := crq.Spec.Budget, crq.Status.Budget
+	if budget == nil || status == nil {
+		return ""
+	}
+	exhausted := []string{}
+	for _, name := range quota.ToSet(quota.ResourceNames(budget.Hard)).List() {
+		requested := usage[corev1.ResourceName(name)]
+		if requested.IsZero() {
+			continue
+		}
+		used, hard := status.Used[corev1.ResourceName(name)], budget.Hard[corev1.ResourceName(name)]
+		if used.Cmp(hard) >= 0 {
+			exhausted = append(exhausted, fmt.Sprintf("%s: used %s of %s", name, used.String(), hard.String()))
+		}
+	}
+	if len(exhausted) == 0 {
+		return ""
+	}
+	periodEnd := status.PeriodStart.Add(budget.Period.Duration)
+	return fmt.Sprintf("budget of clusterresourcequota %s exhausted until %s: %s",
+		crq.Name, periodEnd.UTC().Format(time.RFC3339), strings.Join(exhausted, ", "))
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
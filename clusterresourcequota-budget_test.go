@@ -0,0 +1,294 @@
+package clusterresourcequota_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	testingclock "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	webhookadmission "sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"xiaoshiai.cn/clusterresourcequota"
+	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+	thislisters "xiaoshiai.cn/clusterresourcequota/generated/listers/quota/v1"
+)
+
+func TestBudgetPeriodStart(t *testing.T) {
+	anchor := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	budget := &thisquotav1.BudgetSpec{Period: metav1.Duration{Duration: 24 * time.Hour}, StartTime: &metav1.Time{Time: anchor}}
+
+	for _, tt := range []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{now: anchor, want: anchor},
+		{now: anchor.Add(36 * time.Hour), want: anchor.Add(24 * time.Hour)},
+		{now: anchor.Add(-time.Hour), want: anchor.Add(-24 * time.Hour)},
+	} {
+		if got := clusterresourcequota.BudgetPeriodStart(budget, time.Time{}, tt.now); !got.Equal(tt.want) {
+			t.Errorf("BudgetPeriodStart(%v) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestClusterResourceQuotaBudgetReconciler(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	evaluator := newTestPodEvaluator(t)
+	now := time.Now().Truncate(time.Second)
+	periodStart := now.Add(-30 * time.Minute)
+
+	running := newQueuePod("running", periodStart.Add(-time.Hour), 0, false)
+	running.Status = corev1.PodStatus{Phase: corev1.PodRunning, StartTime: &metav1.Time{Time: periodStart.Add(-time.Hour)}}
+	// charged for the 6 minutes it ran in the period
+	finished := newQueuePod("finished", periodStart.Add(-time.Hour), 0, false)
+	finished.Status = corev1.PodStatus{
+		Phase:     corev1.PodSucceeded,
+		StartTime: &metav1.Time{Time: periodStart.Add(-time.Hour)},
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  "container",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{FinishedAt: metav1.NewTime(periodStart.Add(6 * time.Minute))}},
+		}},
+	}
+	// pending pods are not charged until they start
+	pending := newQueuePod("pending", now, 0, false)
+
+	objects := newQueueingObjects(thisquotav1.QueueingPolicyFIFO, "1")
+	crq := objects[0].(*thisquotav1.ClusterResourceQuota)
+	crq.Spec.Queueing = nil
+	crq.Spec.Budget = &thisquotav1.BudgetSpec{
+		Period:    metav1.Duration{Duration: time.Hour},
+		StartTime: &metav1.Time{Time: periodStart},
+		Hard:      corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1")},
+	}
+	objects = append(objects, running, finished, pending)
+
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).
+		WithStatusSubresource(&thisquotav1.ClusterResourceQuota{}).
+		WithIndex(&corev1.Pod{}, clusterresourcequota.PodQueueIndex, clusterresourcequota.PodQueueIndexFunc).Build()
+	clock := testingclock.NewFakeClock(now)
+	reconciler := &clusterresourcequota.ClusterResourceQuotaBudgetReconciler{
+		Client: cli, Evaluator: evaluator, Clock: clock, Interval: time.Minute,
+	}
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: "crq"}}
+
+	reconcileBudget := func(wantUsed string, wantRequeue time.Duration) {
+		t.Helper()
+		result, err := reconciler.Reconcile(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.RequeueAfter != wantRequeue {
+			t.Errorf("requeue after = %v, want %v", result.RequeueAfter, wantRequeue)
+		}
+		updated := &thisquotav1.ClusterResourceQuota{}
+		if err := cli.Get(ctx, req.NamespacedName, updated); err != nil {
+			t.Fatal(err)
+		}
+		if updated.Status.Budget == nil {
+			t.Fatalf("budget status not set")
+		}
+		used := updated.Status.Budget.Used[corev1.ResourceRequestsCPU]
+		if want := resource.MustParse(wantUsed); used.Cmp(want) != 0 {
+			t.Errorf("used = %v, want %v", used.String(), wantUsed)
+		}
+	}
+	admit := func() webhookadmission.Response {
+		t.Helper()
+		webhook := &clusterresourcequota.PodQueueAdmission{
+			Decoder:   webhookadmission.NewDecoder(scheme),
+			Client:    cli,
+			Evaluator: evaluator,
+		}
+		return webhook.Handle(ctx, webhookadmission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Create,
+			Namespace: "ns1",
+			Object:    toRawExtension(newQueuePod("new", now, 0, false)),
+		}})
+	}
+
+	// the validation reads the quotas from listers synced from the client explicitly
+	validate := func(pod *corev1.Pod) error {
+		t.Helper()
+		quotaIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		quotas := &thisquotav1.ResourceQuotaList{}
+		if err := cli.List(ctx, quotas); err != nil {
+			t.Fatal(err)
+		}
+		for i := range quotas.Items {
+			rq := &quotas.Items[i]
+			if err := quotaIndexer.Add(&corev1.ResourceQuota{ObjectMeta: rq.ObjectMeta, Spec: rq.Spec, Status: rq.Status}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		crqIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		current := &thisquotav1.ClusterResourceQuota{}
+		if err := cli.Get(ctx, req.NamespacedName, current); err != nil {
+			t.Fatal(err)
+		}
+		if err := crqIndexer.Add(current); err != nil {
+			t.Fatal(err)
+		}
+		validation := &clusterresourcequota.PodBudgetAdmission{
+			ValidationInterface:        &recordingValidation{},
+			Evaluator:                  evaluator,
+			QuotaLister:                corev1listers.NewResourceQuotaLister(quotaIndexer),
+			ClusterResourceQuotaLister: thislisters.NewClusterResourceQuotaLister(crqIndexer),
+		}
+		return validation.Validate(ctx, createPodAttributes(pod), nil)
+	}
+
+	// half an hour of the running pod and 6 minutes of the finished pod
+	reconcileBudget("600m", time.Minute)
+	if resp := admit(); !resp.Allowed {
+		t.Fatalf("expected pod allowed within the budget, got: %v", resp.Result)
+	}
+
+	// the status is not patched if nothing is consumed
+	accounted := &thisquotav1.ClusterResourceQuota{}
+	if err := cli.Get(ctx, req.NamespacedName, accounted); err != nil {
+		t.Fatal(err)
+	}
+	reconcileBudget("600m", time.Minute)
+	if err := cli.Get(ctx, req.NamespacedName, crq); err != nil {
+		t.Fatal(err)
+	}
+	if crq.ResourceVersion != accounted.ResourceVersion {
+		t.Errorf("expected the unchanged budget not patched")
+	}
+
+	clock.Step(24 * time.Minute)
+	reconcileBudget("1", time.Minute)
+	// the pod is not queued, it's denied by the validation
+	if resp := admit(); !resp.Allowed || len(resp.Patches) != 0 {
+		t.Fatalf("expected pod not queued without queueing, got: %v", resp.Result)
+	}
+	err := validate(newQueuePod("new", now, 0, false))
+	if !apierrors.IsForbidden(err) || !strings.Contains(err.Error(), "budget of clusterresourcequota crq exhausted") {
+		t.Fatalf("expected pod denied by the exhausted budget, got: %v", err)
+	}
+	// pods queued by the clusterresourcequota are checked when released
+	if err := validate(newQueuePod("queued", now, 0, true)); err != nil {
+		t.Fatalf("expected queued pod allowed, got: %v", err)
+	}
+
+	// pods are queued instead of denied if the clusterresourcequota has queueing
+	withQueueing := &thisquotav1.ClusterResourceQuota{}
+	if err := cli.Get(ctx, req.NamespacedName, withQueueing); err != nil {
+		t.Fatal(err)
+	}
+	withQueueing.Spec.Queueing = &thisquotav1.QueueingSpec{}
+	if err := cli.Update(ctx, withQueueing); err != nil {
+		t.Fatal(err)
+	}
+	if resp := admit(); !resp.Allowed || len(resp.Patches) == 0 {
+		t.Fatalf("expected pod queued by the exhausted budget, got: %v", resp.Result)
+	}
+
+	// the budget is reset in the next period
+	clock.Step(6 * time.Minute)
+	reconcileBudget("0", time.Minute)
+	if resp := admit(); !resp.Allowed || len(resp.Patches) != 0 {
+		t.Fatalf("expected pod allowed in the next period, got: %v", resp.Result)
+	}
+	if err := validate(newQueuePod("new", now, 0, false)); err != nil {
+		t.Fatalf("expected pod allowed in the next period, got: %v", err)
+	}
+}
+
+func TestClusterResourceQuotaBudgetReconciler_DeletedPods(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	evaluator := newTestPodEvaluator(t)
+	now := time.Now().Truncate(time.Second)
+	periodStart := now.Add(-30 * time.Minute)
+
+	newRunningPod := func(name string, started time.Time) *corev1.Pod {
+		pod := newQueuePod(name, started, 0, false)
+		pod.UID = types.UID(name)
+		pod.Status = corev1.PodStatus{Phase: corev1.PodRunning, StartTime: &metav1.Time{Time: started}}
+		return pod
+	}
+	objects := newQueueingObjects(thisquotav1.QueueingPolicyFIFO, "1")
+	crq := objects[0].(*thisquotav1.ClusterResourceQuota)
+	crq.Spec.Queueing = nil
+	crq.Spec.Budget = &thisquotav1.BudgetSpec{
+		Period:    metav1.Duration{Duration: time.Hour},
+		StartTime: &metav1.Time{Time: periodStart},
+		Hard:      corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("10")},
+	}
+	objects = append(objects, newRunningPod("long", periodStart.Add(-time.Hour)))
+
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).
+		WithStatusSubresource(&thisquotav1.ClusterResourceQuota{}).Build()
+	clock := testingclock.NewFakeClock(now)
+	reconciler := &clusterresourcequota.ClusterResourceQuotaBudgetReconciler{
+		Client: cli, Evaluator: evaluator, Clock: clock, Interval: time.Minute,
+	}
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: "crq"}}
+	reconcileBudget := func(wantUsed string) {
+		t.Helper()
+		if _, err := reconciler.Reconcile(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		updated := &thisquotav1.ClusterResourceQuota{}
+		if err := cli.Get(ctx, req.NamespacedName, updated); err != nil {
+			t.Fatal(err)
+		}
+		used := updated.Status.Budget.Used[corev1.ResourceRequestsCPU]
+		if want := resource.MustParse(wantUsed); used.Cmp(want) != 0 {
+			t.Errorf("used = %v, want %v", used.String(), wantUsed)
+		}
+	}
+	deletePod := func(name string, record bool) *corev1.Pod {
+		t.Helper()
+		pod := &corev1.Pod{}
+		if err := cli.Get(ctx, client.ObjectKey{Namespace: "ns1", Name: name}, pod); err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.Delete(ctx, pod); err != nil {
+			t.Fatal(err)
+		}
+		if record {
+			if requests := reconciler.OnPodDelete(ctx, pod); len(requests) != 1 || requests[0] != req {
+				t.Errorf("requests = %v, want %v", requests, req)
+			}
+		}
+		return pod
+	}
+
+	// half an hour of the long running pod
+	reconcileBudget("500m")
+
+	clock.Step(10 * time.Minute)
+	// the short-lived pod runs and is deleted between two accountings
+	if err := cli.Create(ctx, newRunningPod("short", now.Add(2*time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	deletePod("short", true)
+	// the long running pod is not recorded yet when it's accounted
+	long := deletePod("long", false)
+	// 8 minutes of the short-lived pod
+	reconcileBudget("633m")
+
+	// the long running pod is charged from the last accounting listing it until deleted
+	reconciler.OnPodDelete(ctx, long)
+	clock.Step(5 * time.Minute)
+	reconcileBudget("800m")
+
+	// the pods deleted are charged once
+	clock.Step(5 * time.Minute)
+	reconcileBudget("800m")
+}
@@ -2,147 +2,513 @@ package clusterresourcequota
 
 import (
 	"context"
-	"maps"
+	"encoding/json"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	quotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+	"xiaoshiai.cn/common"
 	"xiaoshiai.cn/common/log"
 )
 
-type CacheSyner struct {
-	Cache    *ResourceQuotaCache
-	Client   client.Client
-	Interval time.Duration
+// AnnotationResync is set on a ClusterResourceQuota by a replica not running its controller, e.g. a webhook replica,
+// to request the leader to aggregate its status again, the value is the time of the request.
+const AnnotationResync = "resync.clusterresourcequota." + common.GroupPrefix
+
+const (
+	// DefaultReservationTimeout is how long a reservation of the status admission waits to be observed by the informer,
+	// the admitted update is considered failed after that, e.g. it's conflicted or denied by another webhook.
+	DefaultReservationTimeout = 30 * time.Second
+	// reservationExpireInterval is the interval to roll back the expired reservations.
+	reservationExpireInterval = 5 * time.Second
+	// expiredBufferSize is the buffer of the notifications of rolled back reservations.
+	expiredBufferSize = 100
+)
+
+// ResourceQuotaCacheSyncer feeds the ResourceQuotaCache with the events of the ResourceQuota informer,
+// and rolls back the expired reservations.
+type ResourceQuotaCacheSyncer struct {
+	Cache     *ResourceQuotaCache
+	Informers cache.Informers
+	// Expired receives the ClusterResourceQuotas whose reservations are rolled back, so their status is aggregated again.
+	// It's only sent to once Elected is closed, i.e. the controller of this replica is running.
+	Expired chan<- event.GenericEvent
+	// Elected is closed once this replica is elected, see [manager.Manager.Elected], it's elected if nil.
+	Elected <-chan struct{}
+	// Client requests the leader to aggregate the status by [AnnotationResync] if this replica can't notify its controller.
+	Client client.Client
 }
 
-var _ manager.Runnable = &CacheSyner{}
+var _ manager.LeaderElectionRunnable = &ResourceQuotaCacheSyncer{}
 
-func (c *CacheSyner) Start(ctx context.Context) error {
-	ticker := time.NewTicker(c.Interval)
-	defer ticker.Stop()
-	for {
+// NeedLeaderElection implements [manager.LeaderElectionRunnable], the cache is used by the webhook of every replica.
+func (c *ResourceQuotaCacheSyncer) NeedLeaderElection() bool {
+	return false
+}
+
+func (c *ResourceQuotaCacheSyncer) Start(ctx context.Context) error {
+	informer, err := c.Informers.GetInformer(ctx, &quotav1.ResourceQuota{})
+	if err != nil {
+		return err
+	}
+	registration, err := informer.AddEventHandler(c)
+	if err != nil {
+		return err
+	}
+	wait.UntilWithContext(ctx, c.ExpireReservations, reservationExpireInterval)
+	return informer.RemoveEventHandler(registration)
+}
+
+// ExpireReservations rolls back the expired reservations and notifies their ClusterResourceQuotas,
+// the status written by the admission is rolled back once it's aggregated again.
+func (c *ResourceQuotaCacheSyncer) ExpireReservations(ctx context.Context) {
+	for _, name := range c.Cache.ExpireReservations() {
+		if c.notify(name) || c.Client == nil {
+			continue
+		}
+		if err := c.requestResync(ctx, name); err != nil {
+			log.FromContext(ctx).Error(err, "request resync of clusterresourcequota", "name", name)
+		}
+	}
+}
+
+// notify sends the ClusterResourceQuota to the controller of this replica, it returns false if the controller is not running,
+// or the notifications are not received in time.
+func (c *ResourceQuotaCacheSyncer) notify(name string) bool {
+	if c.Expired == nil {
+		return false
+	}
+	if c.Elected != nil {
 		select {
-		case <-ticker.C:
-			if err := c.SyncOnce(ctx); err != nil {
-				log.FromContext(ctx).Error(err, "Sync ResourceQuotaCache")
-			}
-		case <-ctx.Done():
-			return nil
+		case <-c.Elected:
+		default:
+			return false
 		}
 	}
+	select {
+	case c.Expired <- event.GenericEvent{Object: &quotav1.ClusterResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: name}}}:
+		return true
+	default:
+		return false
+	}
 }
 
-func (c *CacheSyner) SyncOnce(ctx context.Context) error {
-	rqlist := &quotav1.ResourceQuotaList{}
-	if err := c.Client.List(ctx, rqlist); err != nil {
+// requestResync sets [AnnotationResync] on the ClusterResourceQuota, so the leader aggregates its status again.
+func (c *ResourceQuotaCacheSyncer) requestResync(ctx context.Context, name string) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{AnnotationResync: c.Cache.Clock.Now().UTC().Format(time.RFC3339Nano)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	crq := &quotav1.ClusterResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if err := c.Client.Patch(ctx, crq, client.RawPatch(types.MergePatchType, patch)); err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
-	c.Cache.Sync(rqlist.Items)
 	return nil
 }
 
+// OnAdd implements cache.ResourceEventHandler.
+func (c *ResourceQuotaCacheSyncer) OnAdd(obj any, isInInitialList bool) {
+	if rq, ok := obj.(*quotav1.ResourceQuota); ok {
+		c.Cache.Update(rq)
+	}
+}
+
+// OnUpdate implements cache.ResourceEventHandler.
+func (c *ResourceQuotaCacheSyncer) OnUpdate(oldObj, newObj any) {
+	oldRQ, ok := oldObj.(*quotav1.ResourceQuota)
+	if !ok {
+		return
+	}
+	newRQ, ok := newObj.(*quotav1.ResourceQuota)
+	if !ok {
+		return
+	}
+	// the ResourceQuota is moved to another ClusterResourceQuota, or is no longer managed
+	if resourceQuotaCacheKeyOf(oldRQ) != resourceQuotaCacheKeyOf(newRQ) {
+		c.Cache.Delete(oldRQ)
+	}
+	c.Cache.Update(newRQ)
+}
+
+// OnDelete implements cache.ResourceEventHandler.
+func (c *ResourceQuotaCacheSyncer) OnDelete(obj any) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if rq, ok := obj.(*quotav1.ResourceQuota); ok {
+		c.Cache.Delete(rq)
+	}
+}
+
 func NewResourceQuotaCache() *ResourceQuotaCache {
 	return &ResourceQuotaCache{
-		quotacache: map[string]*ClusterResourceQuotaCache{},
+		Clock:              clock.RealClock{},
+		ReservationTimeout: DefaultReservationTimeout,
+		quotacache:         map[string]*ClusterResourceQuotaCache{},
+	}
+}
+
+// ResourceQuotaCacheKey returns the key of the cache entry which the usage of a managed ResourceQuota belongs to.
+// Usage of the ResourceQuotas limiting a topology domain is cached apart from the usage of the ClusterResourceQuota.
+func ResourceQuotaCacheKey(clusterresourcequotaname, topology string) string {
+	if topology == "" {
+		return clusterresourcequotaname
+	}
+	return clusterresourcequotaname + "/" + topology
+}
+
+// resourceQuotaCacheKeyOf returns the cache key of the ResourceQuota, or empty if it's not managed by a ClusterResourceQuota.
+func resourceQuotaCacheKeyOf(rq *quotav1.ResourceQuota) string {
+	crqname := rq.Labels[LabelClusterResourceQuota]
+	if crqname == "" {
+		return ""
 	}
+	return ResourceQuotaCacheKey(crqname, rq.Labels[LabelClusterResourceQuotaTopology])
 }
 
+// ResourceQuotaCache caches the usage of the ResourceQuotas managed by ClusterResourceQuotas.
+// The persisted usage is written by the informer, each usage records the resourceVersion of the ResourceQuota,
+// and only a newer resourceVersion replaces it.
+// The usage admitted by the status admission is reserved before it's persisted, see [ClusterResourceQuotaCache.Reserve].
 type ResourceQuotaCache struct {
+	Clock clock.PassiveClock
+	// ReservationTimeout is how long a reservation is held until it's observed by the informer.
+	ReservationTimeout time.Duration
+
 	lock sync.RWMutex
-	// clusterquotaname ->  usage
+	// clusterquotaname or clusterquotaname/topology ->  usage
 	quotacache map[string]*ClusterResourceQuotaCache
 }
 
+// Update updates the usage of the ResourceQuota if its resourceVersion is newer than the cached one.
+func (r *ResourceQuotaCache) Update(rq *quotav1.ResourceQuota) {
+	key := resourceQuotaCacheKeyOf(rq)
+	if key == "" {
+		return
+	}
+	_ = r.OnLock(context.Background(), key, func(crqcache *ClusterResourceQuotaCache) error {
+		crqcache.update(rq.Namespace, resourceUsageInfoOf(rq))
+		return nil
+	})
+}
+
+// Delete removes the usage of the ResourceQuota,
+// the entry of its ClusterResourceQuota is removed once it has neither usage nor reservations.
+func (r *ResourceQuotaCache) Delete(rq *quotav1.ResourceQuota) {
+	key := resourceQuotaCacheKeyOf(rq)
+	if key == "" {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	crqcache, ok := r.quotacache[key]
+	if !ok {
+		return
+	}
+	crqcache.Lock.Lock()
+	defer crqcache.Lock.Unlock()
+	delete(crqcache.Quotas, rq.Namespace)
+	crqcache.resolveReservations(rq.Namespace, "")
+	if crqcache.empty() {
+		r.remove(key, crqcache)
+	}
+}
+
 // Sync syncs the cache with the given list of ResourceQuotas
-// it will add/update/remove the cache entries as needed
-// Due to the possibility of status updates from both the admission controller and the kube-controller-manager
-// it only updates the cache entries if the last update time is older than 10 seconds
+// it will add/update/remove the cache entries as needed,
+// an entry is only updated if the resourceVersion of the ResourceQuota is newer.
 func (r *ResourceQuotaCache) Sync(quotas []quotav1.ResourceQuota) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	now := time.Now()
-	grouped := map[string]map[string]*ResourceUsageInfo{}
-	for _, rq := range quotas {
-		if rq.Labels == nil {
-			continue
-		}
-		crqname := rq.Labels[LabelClusterResourceQuota]
-		if crqname == "" {
-			continue
+	grouped := groupResourceQuotaUsage(quotas)
+	for key, crqcache := range r.quotacache {
+		if _, ok := grouped[key]; !ok {
+			// remove clusterresourcequota cache that no longer exists
+			crqcache.Lock.Lock()
+			r.remove(key, crqcache)
+			crqcache.Lock.Unlock()
 		}
-		if _, ok := grouped[crqname]; !ok {
-			grouped[crqname] = map[string]*ResourceUsageInfo{}
+	}
+	r.merge(grouped)
+}
+
+// SyncClusterResourceQuota syncs the cache entries of a ClusterResourceQuota, including the entries of its topology domains,
+// with the status of its ResourceQuotas aggregated by the controller.
+// Like [ResourceQuotaCache.Sync], an entry is only updated if the resourceVersion of the ResourceQuota is newer.
+func (r *ResourceQuotaCache) SyncClusterResourceQuota(name string, quotas []quotav1.ResourceQuota) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	grouped := groupResourceQuotaUsage(quotas)
+	for key, crqcache := range r.quotacache {
+		if _, ok := grouped[key]; !ok && (key == name || strings.HasPrefix(key, name+"/")) {
+			crqcache.Lock.Lock()
+			r.remove(key, crqcache)
+			crqcache.Lock.Unlock()
 		}
-		grouped[crqname][rq.Namespace] = &ResourceUsageInfo{Hard: rq.Status.Hard, Used: rq.Status.Used, LastUpdate: now}
 	}
-	for existingClusterRQName, crqcache := range r.quotacache {
-		updatedQuotas, ok := grouped[existingClusterRQName]
+	r.merge(grouped)
+}
+
+// merge merges the grouped usage into the cache, the caller must hold the lock.
+func (r *ResourceQuotaCache) merge(grouped map[string]map[string]*ResourceUsageInfo) {
+	for key, updatedQuotas := range grouped {
+		crqcache, ok := r.quotacache[key]
 		if !ok {
-			// remove clusterresourcequota cache that no longer exists
-			delete(r.quotacache, existingClusterRQName)
-			continue
+			crqcache = newClusterResourceQuotaCache(r.Clock)
+			r.quotacache[key] = crqcache
 		}
-		// merge quotas
-		for existingNamespace, existingUsage := range crqcache.Quotas {
-			updatedUsage, ok := updatedQuotas[existingNamespace]
-			if !ok {
+		crqcache.Lock.Lock()
+		for namespace := range crqcache.Quotas {
+			if _, ok := updatedQuotas[namespace]; !ok {
 				// remove namespace quota that no longer exists
-				delete(crqcache.Quotas, existingNamespace)
-				continue
-			}
-			// skip update if last update is within 10 seconds
-			// it means the usage is recently updated from admission
-			// it's the most up-to-date usage info
-			if existingUsage.LastUpdate.Add(10 * time.Second).After(time.Now()) {
-				continue
+				delete(crqcache.Quotas, namespace)
+				crqcache.resolveReservations(namespace, "")
 			}
-			// update existing usage info
-			*existingUsage = *updatedUsage
-			delete(updatedQuotas, existingNamespace)
 		}
-		// add new namespace quotas
-		maps.Copy(crqcache.Quotas, updatedQuotas)
-		delete(grouped, existingClusterRQName)
+		for namespace, usage := range updatedQuotas {
+			crqcache.update(namespace, usage)
+		}
+		crqcache.Lock.Unlock()
 	}
-	for newClusterRQName, quotas := range grouped {
-		crqcache := &ClusterResourceQuotaCache{Quotas: map[string]*ResourceUsageInfo{}}
-		r.quotacache[newClusterRQName] = crqcache
-		// add new namespace quotas
-		maps.Copy(crqcache.Quotas, quotas)
+}
+
+// groupResourceQuotaUsage groups the usage of managed ResourceQuotas by cache key and namespace.
+func groupResourceQuotaUsage(quotas []quotav1.ResourceQuota) map[string]map[string]*ResourceUsageInfo {
+	grouped := map[string]map[string]*ResourceUsageInfo{}
+	for i := range quotas {
+		rq := &quotas[i]
+		key := resourceQuotaCacheKeyOf(rq)
+		if key == "" {
+			continue
+		}
+		if _, ok := grouped[key]; !ok {
+			grouped[key] = map[string]*ResourceUsageInfo{}
+		}
+		grouped[key][rq.Namespace] = resourceUsageInfoOf(rq)
 	}
+	return grouped
+}
+
+func resourceUsageInfoOf(rq *quotav1.ResourceQuota) *ResourceUsageInfo {
+	return &ResourceUsageInfo{Hard: rq.Status.Hard, Used: rq.Status.Used, ResourceVersion: rq.ResourceVersion}
 }
 
-// OnClusterResourceQuota lock and execute function fn on the quota usage map for the given clusterresourcequota name
+// GetOrCreate returns the cache entry of the given key, see [ResourceQuotaCacheKey].
+// The entry may be removed once it's empty, use [ResourceQuotaCache.OnLock] to update it.
 func (c *ResourceQuotaCache) GetOrCreate(ctx context.Context, name string) *ClusterResourceQuotaCache {
+	return c.getOrCreate(name)
+}
+
+// OnLock calls fn with the cache entry of the given key locked,
+// the entry is created again if it's removed before it's locked.
+func (c *ResourceQuotaCache) OnLock(ctx context.Context, name string, fn func(cache *ClusterResourceQuotaCache) error) error {
+	for {
+		crqcache := c.getOrCreate(name)
+		crqcache.Lock.Lock()
+		if crqcache.removed {
+			crqcache.Lock.Unlock()
+			continue
+		}
+		defer crqcache.Lock.Unlock()
+		return fn(crqcache)
+	}
+}
+
+// remove removes the cache entry, the caller must hold both locks.
+func (c *ResourceQuotaCache) remove(name string, crqcache *ClusterResourceQuotaCache) {
+	crqcache.removed = true
+	delete(c.quotacache, name)
+}
+
+func (c *ResourceQuotaCache) getOrCreate(name string) *ClusterResourceQuotaCache {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	val, ok := c.quotacache[name]
 	if !ok {
-		val = &ClusterResourceQuotaCache{Quotas: map[string]*ResourceUsageInfo{}}
+		val = newClusterResourceQuotaCache(c.Clock)
 		c.quotacache[name] = val
 	}
 	return val
 }
 
+// ExpireReservations rolls back the reservations not observed in time,
+// and returns the names of the ClusterResourceQuotas whose reservations are rolled back.
+// The entries left with neither usage nor reservations are removed.
+func (c *ResourceQuotaCache) ExpireReservations() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.Clock.Now()
+	names := map[string]struct{}{}
+	for key, crqcache := range c.quotacache {
+		crqcache.Lock.Lock()
+		if crqcache.expireReservations(now) {
+			name, _, _ := strings.Cut(key, "/")
+			names[name] = struct{}{}
+		}
+		if crqcache.empty() {
+			c.remove(key, crqcache)
+		}
+		crqcache.Lock.Unlock()
+	}
+	expired := make([]string, 0, len(names))
+	for name := range names {
+		expired = append(expired, name)
+	}
+	return expired
+}
+
 type ClusterResourceQuotaCache struct {
 	Lock   sync.RWMutex
 	Quotas map[string]*ResourceUsageInfo
+	// Reservations are the usage admitted by the status admission but not observed by the informer yet, by admission UID.
+	Reservations map[types.UID]*Reservation
+
+	clock clock.PassiveClock
+	// removed is set once the entry is removed from the cache, it must not be updated then.
+	removed bool
+}
+
+// Reservation is the usage of a ResourceQuota admitted by the status admission.
+// It's confirmed when the informer observes a newer resourceVersion of the ResourceQuota, then the persisted usage replaces it,
+// and it's rolled back when it expires, as the admitted update may fail after the admission, e.g. on conflicts.
+type Reservation struct {
+	Namespace string
+	Used      corev1.ResourceList
+	// ResourceVersion is the resourceVersion of the ResourceQuota the admitted update is based on
+	ResourceVersion string
+	Reserved        time.Time
+	Expires         time.Time
 }
 
-func (c *ClusterResourceQuotaCache) OnLock(ctx context.Context, fn func(cache *ClusterResourceQuotaCache) error) error {
-	c.Lock.Lock()
-	defer c.Lock.Unlock()
-	return fn(c)
+func newClusterResourceQuotaCache(clock clock.PassiveClock) *ClusterResourceQuotaCache {
+	return &ClusterResourceQuotaCache{Quotas: map[string]*ResourceUsageInfo{}, Reservations: map[types.UID]*Reservation{}, clock: clock}
+}
+
+// Reserve reserves the usage of the namespace for the admission, the caller must hold the lock.
+// A retried admission of the same UID replaces its reservation.
+func (c *ClusterResourceQuotaCache) Reserve(uid types.UID, reservation *Reservation) {
+	c.Reservations[uid] = reservation
+}
+
+// UsedOf returns the usage of the namespace, the caller must hold the lock.
+// It's the maximum of the persisted usage and the pending reservations,
+// as at most one of the updates based on the same resourceVersion can be persisted.
+func (c *ClusterResourceQuotaCache) UsedOf(namespace string) corev1.ResourceList {
+	var used corev1.ResourceList
+	if usage, ok := c.Quotas[namespace]; ok {
+		used = usage.Used
+	}
+	for _, reservation := range c.Reservations {
+		if reservation.Namespace == namespace {
+			used = quota.Max(used, reservation.Used)
+		}
+	}
+	return used
+}
+
+// Used returns the total usage of all namespaces, including the pending reservations, the caller must hold the lock.
+func (c *ClusterResourceQuotaCache) Used() corev1.ResourceList {
+	namespaces := map[string]struct{}{}
+	for namespace := range c.Quotas {
+		namespaces[namespace] = struct{}{}
+	}
+	for _, reservation := range c.Reservations {
+		namespaces[reservation.Namespace] = struct{}{}
+	}
+	total := corev1.ResourceList{}
+	for namespace := range namespaces {
+		total = quota.Add(total, c.UsedOf(namespace))
+	}
+	return total
+}
+
+// resolveReservations removes the reservations of the namespace based on a resourceVersion older than the observed one,
+// the admitted update has been either persisted or failed. All reservations of the namespace are removed if resourceVersion is empty.
+func (c *ClusterResourceQuotaCache) resolveReservations(namespace, resourceVersion string) {
+	for uid, reservation := range c.Reservations {
+		if reservation.Namespace != namespace {
+			continue
+		}
+		if resourceVersion == "" {
+			c.removeReservation(uid, ReservationResultRemoved)
+		} else if IsNewerResourceVersion(resourceVersion, reservation.ResourceVersion) {
+			c.removeReservation(uid, ReservationResultConfirmed)
+		}
+	}
+}
+
+// removeReservation removes the reservation and records its age, the caller must hold the lock.
+func (c *ClusterResourceQuotaCache) removeReservation(uid types.UID, result string) {
+	if reservation, ok := c.Reservations[uid]; ok {
+		cacheReservationAge.WithLabelValues(result).Observe(c.clock.Since(reservation.Reserved).Seconds())
+		delete(c.Reservations, uid)
+	}
+}
+
+// expireReservations removes the expired reservations and returns true if any is removed, the caller must hold the lock.
+func (c *ClusterResourceQuotaCache) expireReservations(now time.Time) bool {
+	expired := false
+	for uid, reservation := range c.Reservations {
+		if !now.Before(reservation.Expires) {
+			c.removeReservation(uid, ReservationResultExpired)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// empty returns true if the entry has neither usage nor reservations, the caller must hold the lock.
+func (c *ClusterResourceQuotaCache) empty() bool {
+	return len(c.Quotas) == 0 && len(c.Reservations) == 0
+}
+
+// update replaces the usage of the namespace if it's newer than the cached one, the caller must hold the lock.
+// The reservations based on an older resourceVersion are resolved.
+func (c *ClusterResourceQuotaCache) update(namespace string, usage *ResourceUsageInfo) {
+	c.resolveReservations(namespace, usage.ResourceVersion)
+	if existing, ok := c.Quotas[namespace]; ok && !IsNewerResourceVersion(usage.ResourceVersion, existing.ResourceVersion) {
+		return
+	}
+	c.Quotas[namespace] = usage
 }
 
 type ResourceUsageInfo struct {
 	Hard corev1.ResourceList
 	Used corev1.ResourceList
-	// LastUpdate record the last update time of the usage info
-	LastUpdate time.Time
+	// ResourceVersion is the resourceVersion of the ResourceQuota the usage is based on
+	ResourceVersion string
+}
+
+// IsNewerResourceVersion returns true if resourceVersion a is newer than b.
+// ResourceVersions are opaque by the API conventions, but the etcd3 storage of the kube-apiserver
+// sets them to the etcd revisions which only increase, so they are compared as integers to ignore stale events.
+// If either is not an integer, e.g. with another storage, a different resourceVersion is considered newer.
+func IsNewerResourceVersion(a, b string) bool {
+	av, aerr := strconv.ParseUint(a, 10, 64)
+	bv, berr := strconv.ParseUint(b, 10, 64)
+	if aerr != nil || berr != nil {
+		return a != b
+	}
+	return av > bv
 }
@@ -1 +1,328 @@
 package clusterresourcequota_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	admv1 "k8s.io/api/admission/v1"
+	authnv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	testingclock "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"xiaoshiai.cn/clusterresourcequota"
+	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+func newCachedResourceQuota(namespace, resourceVersion, used string) *thisquotav1.ResourceQuota {
+	return &thisquotav1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "crq",
+			Namespace:       namespace,
+			ResourceVersion: resourceVersion,
+			Labels:          map[string]string{clusterresourcequota.LabelClusterResourceQuota: "crq"},
+		},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")},
+			Used: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(used)},
+		},
+	}
+}
+
+// cachedUsage returns the usage of the namespace including the reservations, or empty if it's not cached.
+func cachedUsage(t *testing.T, cache *clusterresourcequota.ResourceQuotaCache, key, namespace string) string {
+	t.Helper()
+	crqcache := cache.GetOrCreate(context.Background(), key)
+	crqcache.Lock.RLock()
+	defer crqcache.Lock.RUnlock()
+	used, ok := crqcache.UsedOf(namespace)[corev1.ResourceCPU]
+	if !ok {
+		return ""
+	}
+	return used.String()
+}
+
+func TestIsNewerResourceVersion(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want bool
+	}{
+		{a: "11", b: "10", want: true},
+		{a: "10", b: "10", want: false},
+		{a: "9", b: "10", want: false},
+		{a: "100", b: "99", want: true},
+		{a: "10", b: "", want: true},
+		{a: "opaque", b: "10", want: true},
+	} {
+		if got := clusterresourcequota.IsNewerResourceVersion(tt.a, tt.b); got != tt.want {
+			t.Errorf("IsNewerResourceVersion(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestResourceQuotaCacheSyncer_Events(t *testing.T) {
+	cache := clusterresourcequota.NewResourceQuotaCache()
+	syncer := &clusterresourcequota.ResourceQuotaCacheSyncer{Cache: cache}
+
+	syncer.OnAdd(newCachedResourceQuota("ns1", "10", "1"), true)
+	if got := cachedUsage(t, cache, "crq", "ns1"); got != "1" {
+		t.Fatalf("cached usage = %q, want 1", got)
+	}
+	// an event delivered out of order is older than the cached usage
+	syncer.OnUpdate(newCachedResourceQuota("ns1", "8", "1"), newCachedResourceQuota("ns1", "9", "3"))
+	if got := cachedUsage(t, cache, "crq", "ns1"); got != "1" {
+		t.Errorf("cached usage = %q after an older event, want 1", got)
+	}
+	syncer.OnUpdate(newCachedResourceQuota("ns1", "10", "1"), newCachedResourceQuota("ns1", "12", "2"))
+	if got := cachedUsage(t, cache, "crq", "ns1"); got != "2" {
+		t.Errorf("cached usage = %q after a newer event, want 2", got)
+	}
+
+	// the ResourceQuota is moved to a topology domain
+	moved := newCachedResourceQuota("ns1", "13", "2")
+	moved.Labels[clusterresourcequota.LabelClusterResourceQuotaTopology] = "zone-a"
+	syncer.OnUpdate(newCachedResourceQuota("ns1", "12", "2"), moved)
+	if got := cachedUsage(t, cache, "crq", "ns1"); got != "" {
+		t.Errorf("cached usage = %q after moved, want removed", got)
+	}
+	if got := cachedUsage(t, cache, "crq/zone-a", "ns1"); got != "2" {
+		t.Errorf("cached usage of domain = %q, want 2", got)
+	}
+
+	syncer.OnDelete(toolscache.DeletedFinalStateUnknown{Key: "ns1/crq", Obj: moved})
+	if got := cachedUsage(t, cache, "crq/zone-a", "ns1"); got != "" {
+		t.Errorf("cached usage = %q after deleted, want removed", got)
+	}
+}
+
+func TestResourceQuotaCache_RemoveEmpty(t *testing.T) {
+	ctx := context.Background()
+	clock := testingclock.NewFakeClock(time.Now())
+	cache := clusterresourcequota.NewResourceQuotaCache()
+	cache.Clock = clock
+	syncer := &clusterresourcequota.ResourceQuotaCacheSyncer{Cache: cache}
+
+	syncer.OnAdd(newCachedResourceQuota("ns1", "10", "1"), true)
+	held := cache.GetOrCreate(ctx, "crq")
+	syncer.OnDelete(newCachedResourceQuota("ns1", "10", "1"))
+	if cache.GetOrCreate(ctx, "crq") == held {
+		t.Fatalf("expected the entry removed once its last ResourceQuota is deleted")
+	}
+
+	// an entry left with only a reservation is removed once the reservation expires
+	if err := cache.OnLock(ctx, "crq/zone-a", func(crqcache *clusterresourcequota.ClusterResourceQuotaCache) error {
+		crqcache.Reserve("a", &clusterresourcequota.Reservation{
+			Namespace: "ns1",
+			Used:      corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+			Expires:   clock.Now().Add(time.Second),
+		})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	held = cache.GetOrCreate(ctx, "crq/zone-a")
+	clock.Step(time.Second)
+	syncer.ExpireReservations(ctx)
+	if cache.GetOrCreate(ctx, "crq/zone-a") == held {
+		t.Fatalf("expected the entry removed once its reservations expire")
+	}
+
+	// the admission holding a removed entry updates a new one
+	if err := cache.OnLock(ctx, "crq/zone-a", func(crqcache *clusterresourcequota.ClusterResourceQuotaCache) error {
+		if crqcache == held {
+			t.Errorf("expected a new entry instead of the removed one")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResourceQuotaCache_AdmissionInterleaving(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	crq := &thisquotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+		Status: thisquotav1.ClusterResourceQuotaStatus{
+			ResourceQuotaStatus: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")},
+				Used: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")},
+			},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(crq).WithStatusSubresource(crq).Build()
+	cache := clusterresourcequota.NewResourceQuotaCache()
+	syncer := &clusterresourcequota.ResourceQuotaCacheSyncer{Cache: cache}
+	handler := clusterresourcequota.NewResourceQuotaStatusAdmission(cache, cli)
+	admit := func(rq *thisquotav1.ResourceQuota) admission.Response {
+		return handler.Handle(ctx, admission.Request{AdmissionRequest: admv1.AdmissionRequest{
+			UID:      types.UID(rq.Namespace + "-" + rq.ResourceVersion),
+			Object:   toRawExtension(rq),
+			UserInfo: authnv1.UserInfo{Username: "system:serviceaccount:kube-system:resourcequota-controller"},
+		}})
+	}
+
+	syncer.OnAdd(newCachedResourceQuota("ns1", "10", "1"), true)
+	syncer.OnAdd(newCachedResourceQuota("ns2", "20", "1"), true)
+
+	// the admission charges ns1 with the update of resourceVersion 10, which is persisted as resourceVersion 11
+	if resp := admit(newCachedResourceQuota("ns1", "10", "2")); !resp.Allowed {
+		t.Fatalf("expected allowed, got %v", resp.Result)
+	}
+	// a resync of resourceVersion 10 must not release the reserved usage
+	syncer.OnUpdate(newCachedResourceQuota("ns1", "10", "1"), newCachedResourceQuota("ns1", "10", "1"))
+	if got := cachedUsage(t, cache, "crq", "ns1"); got != "2" {
+		t.Fatalf("cached usage = %q after a resync, want the admitted usage 2", got)
+	}
+	// so the next request is checked against the admitted usage: 2 + 3 > 4
+	if resp := admit(newCachedResourceQuota("ns2", "20", "3")); resp.Allowed {
+		t.Fatalf("expected forbidden against the admitted usage")
+	}
+	// the persisted update arrives and confirms the reservation
+	syncer.OnUpdate(newCachedResourceQuota("ns1", "10", "1"), newCachedResourceQuota("ns1", "11", "2"))
+	if crqcache := cache.GetOrCreate(ctx, "crq"); crqcache.Quotas["ns1"].ResourceVersion != "11" || len(crqcache.Reservations) != 0 {
+		t.Errorf("expected the reservation confirmed by resourceVersion 11, got %v", crqcache.Reservations)
+	}
+	// the usage is released bypassing the admission
+	syncer.OnUpdate(newCachedResourceQuota("ns1", "11", "2"), newCachedResourceQuota("ns1", "12", "0"))
+	if resp := admit(newCachedResourceQuota("ns2", "20", "3")); !resp.Allowed {
+		t.Fatalf("expected allowed after the usage is released, got %v", resp.Result)
+	}
+}
+
+func TestResourceQuotaCache_ReservationRollback(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	crq := &thisquotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+		Status: thisquotav1.ClusterResourceQuotaStatus{
+			ResourceQuotaStatus: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")},
+			},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(crq).WithStatusSubresource(crq).Build()
+	clock := testingclock.NewFakeClock(time.Now())
+	cache := clusterresourcequota.NewResourceQuotaCache()
+	cache.Clock = clock
+	expired := make(chan event.GenericEvent, 1)
+	syncer := &clusterresourcequota.ResourceQuotaCacheSyncer{Cache: cache, Expired: expired}
+	handler := clusterresourcequota.NewResourceQuotaStatusAdmission(cache, cli)
+	admit := func(uid types.UID, rq *thisquotav1.ResourceQuota) admission.Response {
+		return handler.Handle(ctx, admission.Request{AdmissionRequest: admv1.AdmissionRequest{
+			UID:      uid,
+			Object:   toRawExtension(rq),
+			UserInfo: authnv1.UserInfo{Username: "system:serviceaccount:kube-system:resourcequota-controller"},
+		}})
+	}
+
+	syncer.OnAdd(newCachedResourceQuota("ns1", "10", "1"), true)
+	if resp := admit("a", newCachedResourceQuota("ns1", "10", "3")); !resp.Allowed {
+		t.Fatalf("expected allowed, got %v", resp.Result)
+	}
+	// a retried admission replaces its own reservation instead of adding to it
+	if resp := admit("a", newCachedResourceQuota("ns1", "10", "3")); !resp.Allowed {
+		t.Fatalf("expected the retried admission allowed, got %v", resp.Result)
+	}
+	// a concurrent update based on the same resourceVersion is checked against the larger usage
+	if resp := admit("b", newCachedResourceQuota("ns1", "10", "2")); !resp.Allowed {
+		t.Fatalf("expected allowed, got %v", resp.Result)
+	}
+	if got := cachedUsage(t, cache, "crq", "ns1"); got != "3" {
+		t.Fatalf("cached usage = %q, want the largest reservation 3", got)
+	}
+	// a denied admission reserves nothing
+	if resp := admit("c", newCachedResourceQuota("ns1", "10", "5")); resp.Allowed {
+		t.Fatalf("expected forbidden")
+	}
+	if crqcache := cache.GetOrCreate(ctx, "crq"); len(crqcache.Reservations) != 2 {
+		t.Fatalf("reservations = %v, want 2", crqcache.Reservations)
+	}
+
+	// the updates are never persisted, e.g. denied by another webhook
+	clock.Step(clusterresourcequota.DefaultReservationTimeout - time.Second)
+	syncer.ExpireReservations(ctx)
+	if got := cachedUsage(t, cache, "crq", "ns1"); got != "3" {
+		t.Fatalf("cached usage = %q before the reservations expire, want 3", got)
+	}
+	clock.Step(time.Second)
+	syncer.ExpireReservations(ctx)
+	if got := cachedUsage(t, cache, "crq", "ns1"); got != "1" {
+		t.Errorf("cached usage = %q after the reservations rolled back, want the persisted usage 1", got)
+	}
+	select {
+	case e := <-expired:
+		if e.Object.GetName() != "crq" {
+			t.Errorf("expired clusterresourcequota = %q, want crq", e.Object.GetName())
+		}
+	default:
+		t.Errorf("expected the clusterresourcequota notified to aggregate its status again")
+	}
+}
+
+func TestResourceQuotaCacheSyncer_RequestResync(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	crq := &thisquotav1.ClusterResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: "crq"}}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(crq).Build()
+	clock := testingclock.NewFakeClock(time.Now())
+	cache := clusterresourcequota.NewResourceQuotaCache()
+	cache.Clock = clock
+	reserve := func(uid types.UID) {
+		if err := cache.OnLock(ctx, "crq", func(crqcache *clusterresourcequota.ClusterResourceQuotaCache) error {
+			crqcache.Reserve(uid, &clusterresourcequota.Reservation{Namespace: "ns1", Expires: clock.Now()})
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resync := func() string {
+		t.Helper()
+		current := &thisquotav1.ClusterResourceQuota{}
+		if err := cli.Get(ctx, types.NamespacedName{Name: "crq"}, current); err != nil {
+			t.Fatal(err)
+		}
+		return current.Annotations[clusterresourcequota.AnnotationResync]
+	}
+
+	// this replica is not elected, its controller does not receive the notification
+	expired := make(chan event.GenericEvent, 1)
+	elected := make(chan struct{})
+	syncer := &clusterresourcequota.ResourceQuotaCacheSyncer{Cache: cache, Expired: expired, Elected: elected, Client: cli}
+	reserve("a")
+	syncer.ExpireReservations(ctx)
+	if len(expired) != 0 {
+		t.Errorf("expected no notification before elected")
+	}
+	requested := resync()
+	if requested == "" {
+		t.Fatalf("expected annotation %s requested on the clusterresourcequota", clusterresourcequota.AnnotationResync)
+	}
+
+	// once elected, the controller of this replica is notified
+	close(elected)
+	clock.Step(time.Second)
+	reserve("b")
+	syncer.ExpireReservations(ctx)
+	if len(expired) != 1 {
+		t.Errorf("expected the controller notified once elected")
+	}
+	if got := resync(); got != requested {
+		t.Errorf("annotation = %q, want unchanged %q", got, requested)
+	}
+
+	// a webhook replica never runs the controller
+	webhook := &clusterresourcequota.ResourceQuotaCacheSyncer{Cache: cache, Client: cli}
+	reserve("c")
+	webhook.ExpireReservations(ctx)
+	if got := resync(); got == requested {
+		t.Errorf("expected annotation %s requested again", clusterresourcequota.AnnotationResync)
+	}
+}
@@ -2,6 +2,11 @@ package clusterresourcequota
 
 import (
 	"context"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
@@ -11,6 +16,7 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	quota "k8s.io/apiserver/pkg/quota/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -19,6 +25,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	quotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
 	"xiaoshiai.cn/common"
 	"xiaoshiai.cn/common/log"
@@ -27,22 +34,65 @@ import (
 const (
 	LabelClusterResourceQuota     = "clusterresourcequota." + common.GroupPrefix
 	ClusterResourceQuotaFinalizer = "clusterresourcequota.finalizers." + common.GroupPrefix
+	// LabelClusterResourceQuotaTopology is set on the ResourceQuota which limits a topology domain,
+	// the value is the value of the topology label.
+	LabelClusterResourceQuotaTopology = "topology.clusterresourcequota." + common.GroupPrefix
 )
 
-func NewClusterResourceQuotaReconciler(client client.Client) *ClusterResourceQuotaReconciler {
-	return &ClusterResourceQuotaReconciler{Client: client}
+// StatusResyncInterval is the interval the status of a ClusterResourceQuota is aggregated again,
+// it rolls back the usage written by the status admission whose update of the ResourceQuota failed
+// when the replica which admitted it can't, e.g. it exits before the reservation expires.
+const StatusResyncInterval = 5 * time.Minute
+
+func NewClusterResourceQuotaReconciler(client client.Client, cache *ResourceQuotaCache, recorder record.EventRecorder) *ClusterResourceQuotaReconciler {
+	return &ClusterResourceQuotaReconciler{Client: client, Cache: cache, Recorder: recorder}
 }
 
-// ClusterResourceQuotaReconciler is a simple ControllerManagedBy example implementation.
+// ClusterResourceQuotaReconciler creates the ResourceQuotas of a ClusterResourceQuota in the selected namespaces,
+// and aggregates their status into the status of the ClusterResourceQuota.
 type ClusterResourceQuotaReconciler struct {
 	Client client.Client
+	// Cache is the usage cache of the status admission, it's synced with the aggregated status if set
+	Cache *ResourceQuotaCache
+	// Expired receives the ClusterResourceQuotas whose reservations are rolled back,
+	// their status written by the admission is aggregated again if set
+	Expired <-chan event.GenericEvent
+	// Recorder records the changes of the selected namespaces, the failures to sync ResourceQuotas
+	// and the usage approaching the hard limits on the ClusterResourceQuota if set
+	Recorder record.EventRecorder
+	// ResyncInterval is the interval the status is aggregated again if set, see [StatusResyncInterval]
+	ResyncInterval time.Duration
 }
 
 func (a *ClusterResourceQuotaReconciler) Setup(mgr manager.Manager) error {
-	return builder.ControllerManagedBy(mgr).
-		For(&quotav1.ClusterResourceQuota{}, builder.WithPredicates(OnClusterResourceQuotaSpecChange())).
+	b := builder.ControllerManagedBy(mgr).
+		For(&quotav1.ClusterResourceQuota{}, builder.WithPredicates(predicate.Or(OnClusterResourceQuotaSpecChange(), OnClusterResourceQuotaResync()))).
 		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(a.OnNamespaceChange)).
-		Complete(a)
+		Watches(&quotav1.ResourceQuota{}, handler.EnqueueRequestsFromMapFunc(a.OnResourceQuotaChange), builder.WithPredicates(OnResourceQuotaStatusChange()))
+	if a.Expired != nil {
+		b = b.WatchesRawSource(source.Channel(a.Expired, &handler.EnqueueRequestForObject{}))
+	}
+	return b.Complete(a)
+}
+
+// OnResourceQuotaStatusChange filters the updates of ResourceQuotas to the changes of status,
+// the usage may be updated bypassing the status admission, e.g. when the webhook is unavailable.
+func OnResourceQuotaStatusChange() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldObj := e.ObjectOld.(*quotav1.ResourceQuota)
+			newObj := e.ObjectNew.(*quotav1.ResourceQuota)
+			return !equality.Semantic.DeepEqual(oldObj.Status, newObj.Status)
+		},
+	}
+}
+
+func (a *ClusterResourceQuotaReconciler) OnResourceQuotaChange(ctx context.Context, obj client.Object) []reconcile.Request {
+	name := obj.GetLabels()[LabelClusterResourceQuota]
+	if name == "" {
+		return []reconcile.Request{}
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: name}}}
 }
 
 func OnClusterResourceQuotaSpecChange() predicate.Predicate {
@@ -55,6 +105,30 @@ func OnClusterResourceQuotaSpecChange() predicate.Predicate {
 	}
 }
 
+// OnClusterResourceQuotaResync filters the updates of ClusterResourceQuotas to the requests of [AnnotationResync],
+// e.g. by the webhook replicas whose reservations are rolled back.
+func OnClusterResourceQuotaResync() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return e.ObjectOld.GetAnnotations()[AnnotationResync] != e.ObjectNew.GetAnnotations()[AnnotationResync]
+		},
+	}
+}
+
+// OnClusterResourceQuotaUsageChange filters the updates of ClusterResourceQuotas to the changes of spec and of the usage in status,
+// e.g. the updates of the budget or the time exceeded in status are filtered out.
+func OnClusterResourceQuotaUsageChange() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldObj := e.ObjectOld.(*quotav1.ClusterResourceQuota)
+			newObj := e.ObjectNew.(*quotav1.ClusterResourceQuota)
+			return !equality.Semantic.DeepEqual(oldObj.Spec, newObj.Spec) ||
+				!equality.Semantic.DeepEqual(oldObj.Status.Hard, newObj.Status.Hard) ||
+				!equality.Semantic.DeepEqual(oldObj.Status.Used, newObj.Status.Used)
+		},
+	}
+}
+
 func (a *ClusterResourceQuotaReconciler) OnNamespaceChange(ctx context.Context, obj client.Object) []reconcile.Request {
 	ns, ok := obj.(*corev1.Namespace)
 	if !ok {
@@ -90,6 +164,7 @@ func (a *ClusterResourceQuotaReconciler) Reconcile(ctx context.Context, req reco
 	if clusterresourcequota.DeletionTimestamp != nil {
 		return reconcile.Result{}, nil
 	}
+	previous := clusterresourcequota.Status.DeepCopy()
 	if err := a.syncResourceQuota(ctx, clusterresourcequota); err != nil {
 		return reconcile.Result{}, err
 	}
@@ -97,7 +172,41 @@ func (a *ClusterResourceQuotaReconciler) Reconcile(ctx context.Context, req reco
 	if err := a.Client.Status().Update(ctx, clusterresourcequota); err != nil {
 		return reconcile.Result{}, err
 	}
-	return reconcile.Result{}, nil
+	a.recordStatusEvents(clusterresourcequota, previous)
+	if err := a.syncCache(ctx, clusterresourcequota); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := a.clearForceHardReduction(ctx, clusterresourcequota); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{RequeueAfter: a.ResyncInterval}, nil
+}
+
+// clearForceHardReduction removes [AnnotationForceHardReduction] once the reduction is synced,
+// so it does not force the later reductions.
+func (a *ClusterResourceQuotaReconciler) clearForceHardReduction(ctx context.Context, clusterResourceQuota *quotav1.ClusterResourceQuota) error {
+	if _, ok := clusterResourceQuota.Annotations[AnnotationForceHardReduction]; !ok {
+		return nil
+	}
+	original := clusterResourceQuota.DeepCopy()
+	delete(clusterResourceQuota.Annotations, AnnotationForceHardReduction)
+	return a.Client.Patch(ctx, clusterResourceQuota, client.MergeFrom(original))
+}
+
+// syncCache syncs the usage cache of the status admission with the status of the ResourceQuotas,
+// so the admission checks the next usage against the aggregated usage.
+func (a *ClusterResourceQuotaReconciler) syncCache(ctx context.Context, clusterResourceQuota *quotav1.ClusterResourceQuota) error {
+	if a.Cache == nil {
+		return nil
+	}
+	start := time.Now()
+	rqlist := &quotav1.ResourceQuotaList{}
+	if err := a.Client.List(ctx, rqlist, client.MatchingLabels{LabelClusterResourceQuota: clusterResourceQuota.Name}); err != nil {
+		return err
+	}
+	a.Cache.SyncClusterResourceQuota(clusterResourceQuota.Name, rqlist.Items)
+	cacheSyncDuration.Observe(time.Since(start).Seconds())
+	return nil
 }
 
 func (rq *ClusterResourceQuotaReconciler) syncResourceQuota(ctx context.Context, clusterResourceQuota *quotav1.ClusterResourceQuota) (err error) {
@@ -108,50 +217,180 @@ func (rq *ClusterResourceQuotaReconciler) syncResourceQuota(ctx context.Context,
 		return err
 	}
 
-	totalUsage := corev1.ResourceList{}
-	// init all resource quantities to zero
-	for resourceName := range clusterResourceQuota.Spec.Hard {
-		totalUsage[resourceName] = *resource.NewQuantity(0, resource.DecimalSI)
-	}
+	totalUsage := zeroUsage(clusterResourceQuota.Spec.Hard)
 	namespaceUsage := []quotav1.NamespaceResourceQuota{}
 
+	var domains []quotav1.TopologyDomainResourceQuota
+	if topology := clusterResourceQuota.Spec.Topology; topology != nil {
+		domains = topology.Domains
+	}
+	topologyUsage := make([]corev1.ResourceList, len(domains))
+	for i, domain := range domains {
+		topologyUsage[i] = zeroUsage(domain.Hard)
+	}
+
+	baseSpec := *clusterResourceQuota.Spec.ResourceQuotaSpec.DeepCopy()
+	if clusterResourceQuota.Spec.Queueing != nil {
+		// the pods of the queue are charged when they are released
+		if baseSpec.ScopeSelector == nil {
+			baseSpec.ScopeSelector = &corev1.ScopeSelector{}
+		}
+		baseSpec.ScopeSelector.MatchExpressions = append(baseSpec.ScopeSelector.MatchExpressions, corev1.ScopedResourceSelectorRequirement{
+			ScopeName: ResourceQuotaScopeQueue,
+			Operator:  corev1.ScopeSelectorOpNotIn,
+			Values:    []string{clusterResourceQuota.Name},
+		})
+	}
+
 	var errs []error
 	for _, ns := range matchedNamespaces {
 		// create or update resource quota in the namespace
-		resourceQuota := &quotav1.ResourceQuota{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      clusterResourceQuota.Name,
-				Namespace: ns.Name,
-			},
-		}
-		_, err := controllerutil.CreateOrUpdate(ctx, rq.Client, resourceQuota, func() error {
-			resourceQuota.Labels = clusterResourceQuota.Labels
-			resourceQuota.Annotations = clusterResourceQuota.Annotations
-
-			if resourceQuota.Labels == nil {
-				resourceQuota.Labels = map[string]string{}
-			}
-			resourceQuota.Labels[LabelClusterResourceQuota] = clusterResourceQuota.Name
-			// set resource quota spec to cluster resource quota spec
-			// single namespace resource quota should not larger than cluster resource quota
-			resourceQuota.Spec = clusterResourceQuota.Spec.ResourceQuotaSpec
-			// set owner reference to cluster resource quota so that resource quota will be deleted when cluster resource quota is deleted
-			return controllerutil.SetOwnerReference(clusterResourceQuota, resourceQuota, rq.Client.Scheme())
-		})
+		// set resource quota spec to cluster resource quota spec
+		// single namespace resource quota should not larger than cluster resource quota
+		resourceQuota, err := rq.createOrUpdateResourceQuota(ctx, clusterResourceQuota, ns.Name, clusterResourceQuota.Name, "", baseSpec)
 		if err != nil {
 			log.Error(err, "failed to create or update resource quota", "namespace", ns)
+			rq.resourceQuotaSyncFailed(clusterResourceQuota, ns.Name, clusterResourceQuota.Name, err)
 			errs = append(errs, err)
 			continue
 		}
 		totalUsage = quota.Add(totalUsage, resourceQuota.Status.Used)
 		namespaceUsage = append(namespaceUsage, quotav1.NamespaceResourceQuota{Name: ns.Name, Used: resourceQuota.Status.Used})
+
+		// one more resource quota per topology domain, limits pods in the domain only
+		for i, domain := range domains {
+			spec := *baseSpec.DeepCopy()
+			spec.Hard = domain.Hard
+			if spec.ScopeSelector == nil {
+				spec.ScopeSelector = &corev1.ScopeSelector{}
+			}
+			spec.ScopeSelector.MatchExpressions = append(spec.ScopeSelector.MatchExpressions, corev1.ScopedResourceSelectorRequirement{
+				ScopeName: ResourceQuotaScopeTopology,
+				Operator:  corev1.ScopeSelectorOpIn,
+				Values:    []string{clusterResourceQuota.Spec.Topology.Key + "=" + domain.Value},
+			})
+			name := TopologyResourceQuotaName(clusterResourceQuota.Name, domain.Value)
+			topologyQuota, err := rq.createOrUpdateResourceQuota(ctx, clusterResourceQuota, ns.Name, name, domain.Value, spec)
+			if err != nil {
+				log.Error(err, "failed to create or update topology resource quota", "namespace", ns, "topology", domain.Value)
+				rq.resourceQuotaSyncFailed(clusterResourceQuota, ns.Name, name, err)
+				errs = append(errs, err)
+				continue
+			}
+			topologyUsage[i] = quota.Add(topologyUsage[i], topologyQuota.Status.Used)
+		}
 	}
+	if err := rq.removeStaleTopologyResourceQuotas(ctx, clusterResourceQuota); err != nil {
+		errs = append(errs, err)
+	}
+
 	clusterResourceQuota.Status.Namespaces = namespaceUsage
 	clusterResourceQuota.Status.Hard = clusterResourceQuota.Spec.Hard.DeepCopy()
 	clusterResourceQuota.Status.Used = totalUsage.DeepCopy()
+	clusterResourceQuota.Status.Topology = nil
+	for i, domain := range domains {
+		clusterResourceQuota.Status.Topology = append(clusterResourceQuota.Status.Topology, quotav1.TopologyResourceQuotaStatus{
+			Value: domain.Value,
+			Hard:  domain.Hard.DeepCopy(),
+			Used:  topologyUsage[i],
+		})
+	}
 	return utilerrors.NewAggregate(errs)
 }
 
+func (rq *ClusterResourceQuotaReconciler) createOrUpdateResourceQuota(ctx context.Context,
+	clusterResourceQuota *quotav1.ClusterResourceQuota, namespace, name, topology string, spec corev1.ResourceQuotaSpec,
+) (*quotav1.ResourceQuota, error) {
+	resourceQuota := &quotav1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, rq.Client, resourceQuota, func() error {
+		// never take over the ResourceQuota of another ClusterResourceQuota
+		if owner := resourceQuota.Labels[LabelClusterResourceQuota]; owner != "" && owner != clusterResourceQuota.Name {
+			return fmt.Errorf("resourcequota %s/%s belongs to clusterresourcequota %s", namespace, name, owner)
+		}
+		resourceQuota.Labels = maps.Clone(clusterResourceQuota.Labels)
+		// the reservations of pod groups are written by the admission
+		reservations, reserved := resourceQuota.Annotations[AnnotationPodGroupReservations]
+		resourceQuota.Annotations = maps.Clone(clusterResourceQuota.Annotations)
+		delete(resourceQuota.Annotations, AnnotationPodGroupReservations)
+		delete(resourceQuota.Annotations, AnnotationForceHardReduction)
+		delete(resourceQuota.Annotations, AnnotationResync)
+		if reserved {
+			if resourceQuota.Annotations == nil {
+				resourceQuota.Annotations = map[string]string{}
+			}
+			resourceQuota.Annotations[AnnotationPodGroupReservations] = reservations
+		}
+
+		if resourceQuota.Labels == nil {
+			resourceQuota.Labels = map[string]string{}
+		}
+		resourceQuota.Labels[LabelClusterResourceQuota] = clusterResourceQuota.Name
+		if topology != "" {
+			resourceQuota.Labels[LabelClusterResourceQuotaTopology] = topology
+		}
+		resourceQuota.Spec = spec
+		// set owner reference to cluster resource quota so that resource quota will be deleted when cluster resource quota is deleted
+		return controllerutil.SetOwnerReference(clusterResourceQuota, resourceQuota, rq.Client.Scheme())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resourceQuota, nil
+}
+
+// removeStaleTopologyResourceQuotas deletes the topology resource quotas whose domain is removed from the spec,
+// or which are not named by [TopologyResourceQuotaName], e.g. named by an earlier version.
+func (rq *ClusterResourceQuotaReconciler) removeStaleTopologyResourceQuotas(ctx context.Context, clusterResourceQuota *quotav1.ClusterResourceQuota) error {
+	rqlist := &quotav1.ResourceQuotaList{}
+	if err := rq.Client.List(ctx, rqlist, client.MatchingLabels{LabelClusterResourceQuota: clusterResourceQuota.Name}); err != nil {
+		return err
+	}
+	var errs []error
+	for _, resourceQuota := range rqlist.Items {
+		topology, ok := resourceQuota.Labels[LabelClusterResourceQuotaTopology]
+		if !ok || HasTopologyDomain(clusterResourceQuota, topology) && resourceQuota.Name == TopologyResourceQuotaName(clusterResourceQuota.Name, topology) {
+			continue
+		}
+		if err := rq.Client.Delete(ctx, &resourceQuota); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// TopologyResourceQuotaName returns the name of the ResourceQuota which limits a topology domain in a namespace.
+// Names of ClusterResourceQuotas and domains may both contain dots, the hash of the pair keeps the names of different pairs apart,
+// e.g. "a.b" with domain "c" and "a" with domain "b.c".
+func TopologyResourceQuotaName(clusterResourceQuotaName, topology string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(clusterResourceQuotaName + "/" + topology))
+	return fmt.Sprintf("%s.%s-%08x", clusterResourceQuotaName, topology, hash.Sum32())
+}
+
+// HasTopologyDomain returns true if the topology domain is in the spec of the ClusterResourceQuota.
+func HasTopologyDomain(clusterResourceQuota *quotav1.ClusterResourceQuota, topology string) bool {
+	if clusterResourceQuota.Spec.Topology == nil {
+		return false
+	}
+	return slices.ContainsFunc(clusterResourceQuota.Spec.Topology.Domains, func(domain quotav1.TopologyDomainResourceQuota) bool {
+		return domain.Value == topology
+	})
+}
+
+// zeroUsage returns usage with all resource quantities of hard initialized to zero
+func zeroUsage(hard corev1.ResourceList) corev1.ResourceList {
+	usage := corev1.ResourceList{}
+	for resourceName := range hard {
+		usage[resourceName] = *resource.NewQuantity(0, resource.DecimalSI)
+	}
+	return usage
+}
+
 func (rq *ClusterResourceQuotaReconciler) selectedNamespaces(ctx context.Context, clusterResourceQuota *quotav1.ClusterResourceQuota) ([]corev1.Namespace, error) {
 	namespacelist := &corev1.NamespaceList{}
 	if err := rq.Client.List(ctx, namespacelist); err != nil {
@@ -10,7 +10,9 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	quotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
 )
@@ -27,7 +29,8 @@ func TestClusterResourceQuotaReconciler_Reconcile(t *testing.T) {
 
 	crq := &quotav1.ClusterResourceQuota{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: crqName,
+			Name:        crqName,
+			Annotations: map[string]string{AnnotationForceHardReduction: "true"},
 		},
 		Spec: quotav1.ClusterResourceQuotaSpec{
 			NamespaceSelector: &metav1.LabelSelector{
@@ -94,6 +97,11 @@ func TestClusterResourceQuotaReconciler_Reconcile(t *testing.T) {
 		t.Errorf("Expected CPU limit 10, got %v", cpuLimit)
 	}
 
+	// Check the forced reduction is not copied
+	if _, ok := rq.Annotations[AnnotationForceHardReduction]; ok {
+		t.Errorf("Expected annotation %s not copied to ResourceQuota", AnnotationForceHardReduction)
+	}
+
 	// Check owner reference
 	if len(rq.OwnerReferences) == 0 {
 		t.Error("Expected OwnerReference to be set")
@@ -116,6 +124,10 @@ func TestClusterResourceQuotaReconciler_Reconcile(t *testing.T) {
 		t.Fatalf("Failed to get updated ClusterResourceQuota: %v", err)
 	}
 
+	if _, ok := updatedCrq.Annotations[AnnotationForceHardReduction]; ok {
+		t.Errorf("Expected annotation %s removed once synced", AnnotationForceHardReduction)
+	}
+
 	if len(updatedCrq.Status.Namespaces) != 1 {
 		t.Errorf("Expected 1 namespace in status, got %d", len(updatedCrq.Status.Namespaces))
 	} else {
@@ -124,3 +136,311 @@ func TestClusterResourceQuotaReconciler_Reconcile(t *testing.T) {
 		}
 	}
 }
+
+func TestClusterResourceQuotaReconciler_Topology(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = quotav1.AddToScheme(scheme)
+
+	crq := &quotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "gpu"},
+		Spec: quotav1.ClusterResourceQuotaSpec{
+			NamespaceSelector: &metav1.LabelSelector{},
+			ResourceQuotaSpec: corev1.ResourceQuotaSpec{
+				Hard: corev1.ResourceList{"requests.nvidia.com/gpu": resource.MustParse("32")},
+			},
+			Topology: &quotav1.TopologyResourceQuotaSpec{
+				Key: corev1.LabelTopologyZone,
+				Domains: []quotav1.TopologyDomainResourceQuota{
+					{Value: "zone-a", Hard: corev1.ResourceList{"requests.nvidia.com/gpu": resource.MustParse("16")}},
+				},
+			},
+		},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team"}}
+	// quota of a domain named by an earlier version
+	legacy := &quotav1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      crq.Name + ".zone-a",
+			Namespace: ns.Name,
+			Labels: map[string]string{
+				LabelClusterResourceQuota:         crq.Name,
+				LabelClusterResourceQuotaTopology: "zone-a",
+			},
+		},
+	}
+	// quota of a domain which has been removed from the spec
+	stale := &quotav1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      TopologyResourceQuotaName(crq.Name, "zone-b"),
+			Namespace: ns.Name,
+			Labels: map[string]string{
+				LabelClusterResourceQuota:         crq.Name,
+				LabelClusterResourceQuotaTopology: "zone-b",
+			},
+		},
+	}
+	client := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(crq, ns, stale, legacy).
+		WithStatusSubresource(crq).
+		Build()
+
+	r := &ClusterResourceQuotaReconciler{Client: client}
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: crq.Name}}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	rq := &quotav1.ResourceQuota{}
+	if err := client.Get(ctx, types.NamespacedName{Name: TopologyResourceQuotaName(crq.Name, "zone-a"), Namespace: ns.Name}, rq); err != nil {
+		t.Fatalf("Failed to get topology ResourceQuota: %v", err)
+	}
+	if got := rq.Labels[LabelClusterResourceQuotaTopology]; got != "zone-a" {
+		t.Errorf("Expected topology label zone-a, got %q", got)
+	}
+	if gpu := rq.Spec.Hard["requests.nvidia.com/gpu"]; gpu.String() != "16" {
+		t.Errorf("Expected GPU limit 16, got %v", gpu.String())
+	}
+	if rq.Spec.ScopeSelector == nil || len(rq.Spec.ScopeSelector.MatchExpressions) != 1 ||
+		rq.Spec.ScopeSelector.MatchExpressions[0].ScopeName != ResourceQuotaScopeTopology ||
+		rq.Spec.ScopeSelector.MatchExpressions[0].Values[0] != corev1.LabelTopologyZone+"=zone-a" {
+		t.Errorf("Unexpected scope selector %v", rq.Spec.ScopeSelector)
+	}
+	// the ResourceQuota of the whole ClusterResourceQuota must not be limited to the domain
+	main := &quotav1.ResourceQuota{}
+	if err := client.Get(ctx, types.NamespacedName{Name: crq.Name, Namespace: ns.Name}, main); err != nil {
+		t.Fatalf("Failed to get ResourceQuota: %v", err)
+	}
+	if main.Spec.ScopeSelector != nil || main.Labels[LabelClusterResourceQuotaTopology] != "" {
+		t.Errorf("Unexpected topology on ResourceQuota %v", main.ObjectMeta)
+	}
+
+	if err := client.Get(ctx, types.NamespacedName{Name: stale.Name, Namespace: stale.Namespace}, &quotav1.ResourceQuota{}); err == nil {
+		t.Error("Stale topology ResourceQuota should be deleted")
+	}
+	if err := client.Get(ctx, types.NamespacedName{Name: legacy.Name, Namespace: legacy.Namespace}, &quotav1.ResourceQuota{}); err == nil {
+		t.Error("Topology ResourceQuota named by an earlier version should be deleted")
+	}
+
+	updated := &quotav1.ClusterResourceQuota{}
+	if err := client.Get(ctx, types.NamespacedName{Name: crq.Name}, updated); err != nil {
+		t.Fatalf("Failed to get updated ClusterResourceQuota: %v", err)
+	}
+	if len(updated.Status.Topology) != 1 || updated.Status.Topology[0].Value != "zone-a" {
+		t.Errorf("Unexpected topology status %v", updated.Status.Topology)
+	}
+}
+
+func TestTopologyResourceQuotaName(t *testing.T) {
+	for _, pair := range [][2][2]string{
+		{{"a.b", "c"}, {"a", "b.c"}},
+		{{"gpu", "a100"}, {"gpu.a100", ""}},
+	} {
+		first, second := pair[0], pair[1]
+		name := TopologyResourceQuotaName(first[0], first[1])
+		other := second[0]
+		if second[1] != "" {
+			other = TopologyResourceQuotaName(second[0], second[1])
+		}
+		if name == other {
+			t.Errorf("name of %v collides with %v: %s", first, second, name)
+		}
+	}
+}
+
+func TestClusterResourceQuotaReconciler_ForeignResourceQuota(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = quotav1.AddToScheme(scheme)
+
+	crq := &quotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "gpu"},
+		Spec: quotav1.ClusterResourceQuotaSpec{
+			NamespaceSelector: &metav1.LabelSelector{},
+			ResourceQuotaSpec: corev1.ResourceQuotaSpec{
+				Hard: corev1.ResourceList{"requests.nvidia.com/gpu": resource.MustParse("32")},
+			},
+		},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team"}}
+	// the quota of another ClusterResourceQuota with the same name
+	foreign := &quotav1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      crq.Name,
+			Namespace: ns.Name,
+			Labels:    map[string]string{LabelClusterResourceQuota: "other"},
+		},
+		Spec: corev1.ResourceQuotaSpec{Hard: corev1.ResourceList{"requests.nvidia.com/gpu": resource.MustParse("4")}},
+	}
+	client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(crq, ns, foreign).WithStatusSubresource(crq).Build()
+
+	r := &ClusterResourceQuotaReconciler{Client: client}
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: crq.Name}}); err == nil {
+		t.Fatalf("expected Reconcile to fail on the ResourceQuota of another ClusterResourceQuota")
+	}
+	rq := &quotav1.ResourceQuota{}
+	if err := client.Get(ctx, types.NamespacedName{Name: foreign.Name, Namespace: ns.Name}, rq); err != nil {
+		t.Fatal(err)
+	}
+	if rq.Labels[LabelClusterResourceQuota] != "other" || len(rq.OwnerReferences) != 0 {
+		t.Errorf("ResourceQuota of another ClusterResourceQuota taken over: %v", rq.ObjectMeta)
+	}
+	if gpu := rq.Spec.Hard["requests.nvidia.com/gpu"]; gpu.String() != "4" {
+		t.Errorf("ResourceQuota of another ClusterResourceQuota updated to %s", gpu.String())
+	}
+}
+
+func TestClusterResourceQuotaReconciler_AggregateResourceQuotaStatus(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = quotav1.AddToScheme(scheme)
+
+	crq := &quotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+		Spec: quotav1.ClusterResourceQuotaSpec{
+			NamespaceSelector: &metav1.LabelSelector{},
+			ResourceQuotaSpec: corev1.ResourceQuotaSpec{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("10")},
+			},
+		},
+	}
+	newResourceQuota := func(namespace, used string) *quotav1.ResourceQuota {
+		return &quotav1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      crq.Name,
+				Namespace: namespace,
+				Labels:    map[string]string{LabelClusterResourceQuota: crq.Name},
+			},
+			Status: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("10")},
+				Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse(used)},
+			},
+		}
+	}
+	// the usage of ns1 is updated bypassing the status admission
+	rq1, rq2 := newResourceQuota("ns1", "3"), newResourceQuota("ns2", "2")
+	client := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(crq, rq1, rq2,
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns1"}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns2"}}).
+		WithStatusSubresource(crq).
+		Build()
+
+	cache := NewResourceQuotaCache()
+	crqcache := cache.GetOrCreate(context.Background(), crq.Name)
+	crqcache.Quotas["ns1"] = &ResourceUsageInfo{
+		Used:            corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1")},
+		ResourceVersion: "1",
+	}
+	// the cached usage of ns2 is newer than the ResourceQuota listed
+	crqcache.Quotas["ns2"] = &ResourceUsageInfo{
+		Used:            corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("4")},
+		ResourceVersion: "1000000",
+	}
+
+	r := NewClusterResourceQuotaReconciler(client, cache, nil)
+	if requests := r.OnResourceQuotaChange(context.Background(), rq1); len(requests) != 1 || requests[0].Name != crq.Name {
+		t.Fatalf("Expected ResourceQuota mapped to its ClusterResourceQuota, got %v", requests)
+	}
+	updatedRQ := rq1.DeepCopy()
+	updatedRQ.Status.Used[corev1.ResourceRequestsCPU] = resource.MustParse("4")
+	if !OnResourceQuotaStatusChange().Update(event.UpdateEvent{ObjectOld: rq1, ObjectNew: updatedRQ}) {
+		t.Error("Expected status change of ResourceQuota to be reconciled")
+	}
+
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: crq.Name}}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	updated := &quotav1.ClusterResourceQuota{}
+	if err := client.Get(ctx, types.NamespacedName{Name: crq.Name}, updated); err != nil {
+		t.Fatal(err)
+	}
+	if used := updated.Status.Used[corev1.ResourceRequestsCPU]; used.String() != "5" {
+		t.Errorf("Expected aggregated usage 5, got %v", used.String())
+	}
+	if used := crqcache.Quotas["ns1"].Used[corev1.ResourceRequestsCPU]; used.String() != "3" {
+		t.Errorf("Expected cached usage of ns1 synced to 3, got %v", used.String())
+	}
+	if used := crqcache.Quotas["ns2"].Used[corev1.ResourceRequestsCPU]; used.String() != "4" {
+		t.Errorf("Expected newer cached usage of ns2 kept, got %v", used.String())
+	}
+}
+
+func TestClusterResourceQuotaReconciler_Events(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = quotav1.AddToScheme(scheme)
+
+	crq := &quotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "crq",
+			Annotations: map[string]string{AnnotationWarningThreshold: "50"},
+		},
+		Spec: quotav1.ClusterResourceQuotaSpec{
+			NamespaceSelector: &metav1.LabelSelector{},
+			ResourceQuotaSpec: corev1.ResourceQuotaSpec{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("10")},
+			},
+		},
+		Status: quotav1.ClusterResourceQuotaStatus{
+			Namespaces: []quotav1.NamespaceResourceQuota{{Name: "removed"}},
+		},
+	}
+	newResourceQuota := func(namespace, used string) *quotav1.ResourceQuota {
+		return &quotav1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      crq.Name,
+				Namespace: namespace,
+				Labels:    map[string]string{LabelClusterResourceQuota: crq.Name},
+			},
+			Status: corev1.ResourceQuotaStatus{
+				Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse(used)},
+			},
+		}
+	}
+	client := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(crq, newResourceQuota("ns1", "3"), newResourceQuota("ns2", "3"),
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns1"}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns2"}}).
+		WithStatusSubresource(crq).
+		Build()
+	recorder := record.NewFakeRecorder(10)
+	r := NewClusterResourceQuotaReconciler(client, nil, recorder)
+
+	ctx := context.Background()
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: crq.Name}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	expected := []string{
+		"Normal NamespaceAdded Namespace ns1 is selected",
+		"Normal NamespaceAdded Namespace ns2 is selected",
+		"Normal NamespaceRemoved Namespace removed is no longer selected",
+		"Warning ApproachingLimit Usage of requests.cpu is 6, reached 50% of the hard limit 10",
+	}
+	for _, want := range expected {
+		select {
+		case got := <-recorder.Events:
+			if got != want {
+				t.Errorf("Expected event %q, got %q", want, got)
+			}
+		default:
+			t.Errorf("Expected event %q, got none", want)
+		}
+	}
+
+	// unchanged namespaces and usage above the threshold are not recorded again
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	select {
+	case got := <-recorder.Events:
+		t.Errorf("Unexpected event %q", got)
+	default:
+	}
+}
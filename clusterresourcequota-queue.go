@@ -0,0 +1,454 @@
+package clusterresourcequota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/admission"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	webhookadmission "sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	quotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+	"xiaoshiai.cn/common"
+)
+
+const (
+	// SchedulingGateClusterResourceQuotaQueue is the scheduling gate of pods queued by a ClusterResourceQuota,
+	// queued pods are not charged until the gate is removed.
+	SchedulingGateClusterResourceQuotaQueue = "clusterresourcequota." + common.GroupPrefix + "/queue"
+	// LabelClusterResourceQuotaQueue is the name of the ClusterResourceQuota queuing the pod.
+	LabelClusterResourceQuotaQueue = "queue.clusterresourcequota." + common.GroupPrefix
+	// PodConditionClusterResourceQuotaQueued is the condition of pods queued by a ClusterResourceQuota,
+	// the message tells the position of the pod in the queue.
+	PodConditionClusterResourceQuotaQueued corev1.PodConditionType = "ClusterResourceQuotaQueued"
+	// PodQueueIndex is the field index of pods by the ClusterResourceQuota queuing them.
+	PodQueueIndex = "clusterresourcequota-queue"
+)
+
+// IsPodQueued returns true if the pod is gated by the queue of a ClusterResourceQuota.
+func IsPodQueued(pod *corev1.Pod) bool {
+	return slices.ContainsFunc(pod.Spec.SchedulingGates, isQueueGate)
+}
+
+func isQueueGate(gate corev1.PodSchedulingGate) bool {
+	return gate.Name == SchedulingGateClusterResourceQuotaQueue
+}
+
+// PodQueue returns the name of the ClusterResourceQuota queuing the pod, or empty if the pod is not queued.
+// The gate and the label are set together by [PodQueueAdmission], which removes the ones supplied on creation,
+// a pod only gated is not queued and charged as usual.
+func PodQueue(pod *corev1.Pod) string {
+	if !IsPodQueued(pod) {
+		return ""
+	}
+	return pod.Labels[LabelClusterResourceQuotaQueue]
+}
+
+// dequeuePod removes the gate and the label of the queue from the pod, it returns false if there is none.
+func dequeuePod(pod *corev1.Pod) bool {
+	_, labeled := pod.Labels[LabelClusterResourceQuotaQueue]
+	gated := IsPodQueued(pod)
+	delete(pod.Labels, LabelClusterResourceQuotaQueue)
+	pod.Spec.SchedulingGates = slices.DeleteFunc(pod.Spec.SchedulingGates, isQueueGate)
+	return labeled || gated
+}
+
+// IsPodDequeued returns true if the request is an update removing the queue gate of a pod.
+func IsPodDequeued(a admission.Attributes) bool {
+	if a.GetOperation() != admission.Update || a.GetSubresource() != "" {
+		return false
+	}
+	oldPod, ok := a.GetOldObject().(*corev1.Pod)
+	if !ok {
+		return false
+	}
+	newPod, ok := a.GetObject().(*corev1.Pod)
+	if !ok {
+		return false
+	}
+	return IsPodQueued(oldPod) && !IsPodQueued(newPod)
+}
+
+var _ quota.Evaluator = &PodDequeueEvaluator{}
+
+// PodDequeueEvaluator evaluates the pod released from the queue of a ClusterResourceQuota, the pod is labeled with the queue.
+// It only matches the quotas which match the released pod but not the queued pod, i.e. the ResourceQuotas of the queue,
+// the others have been charged when the pod was created.
+type PodDequeueEvaluator struct {
+	quota.Evaluator
+}
+
+// Matches implements v1.Evaluator.
+func (e *PodDequeueEvaluator) Matches(resourceQuota *corev1.ResourceQuota, item runtime.Object) (bool, error) {
+	pod, ok := item.(*corev1.Pod)
+	if !ok {
+		return false, nil
+	}
+	queued := pod.DeepCopy()
+	queued.Spec.SchedulingGates = append(queued.Spec.SchedulingGates, corev1.PodSchedulingGate{Name: SchedulingGateClusterResourceQuotaQueue})
+	released := pod.DeepCopy()
+	dequeuePod(released)
+	matched, err := e.Evaluator.Matches(resourceQuota, released)
+	if err != nil || !matched {
+		return false, err
+	}
+	matched, err = e.Evaluator.Matches(resourceQuota, queued)
+	if err != nil {
+		return false, err
+	}
+	return !matched, nil
+}
+
+// PodDequeueAdmission admits the release of pods from the queue of a ClusterResourceQuota, other requests are admitted by the embedded admission.
+// The released pod is admitted as a created pod by Dequeue, whose pod evaluator is a [PodDequeueEvaluator],
+// so the ResourceQuotas of the queue are charged when the pod is released.
+type PodDequeueAdmission struct {
+	admission.ValidationInterface
+	Dequeue admission.ValidationInterface
+}
+
+// Validate implements admission.ValidationInterface.
+func (a *PodDequeueAdmission) Validate(ctx context.Context, attr admission.Attributes, o admission.ObjectInterfaces) error {
+	if err := a.ValidationInterface.Validate(ctx, attr, o); err != nil || !IsPodDequeued(attr) {
+		return err
+	}
+	released := attr.GetObject().(*corev1.Pod).DeepCopy()
+	if released.Labels == nil {
+		released.Labels = map[string]string{}
+	}
+	released.Labels[LabelClusterResourceQuotaQueue] = attr.GetOldObject().(*corev1.Pod).Labels[LabelClusterResourceQuotaQueue]
+	dequeued := admission.NewAttributesRecord(released, nil,
+		corev1.SchemeGroupVersion.WithKind("Pod"), released.Namespace, released.Name,
+		corev1.SchemeGroupVersion.WithResource("pods"), "",
+		admission.Create, &metav1.CreateOptions{}, attr.IsDryRun(), attr.GetUserInfo())
+	return a.Dequeue.Validate(ctx, dequeued, o)
+}
+
+// NewClusterResourceQuotaQueue sets up the queueing of pods for ClusterResourceQuotas with queueing enabled,
+// evaluator is the pod evaluator used by the resourcequota webhook.
+// The role decides whether the controller releasing pods, the webhook queueing pods, or both are set up.
+func NewClusterResourceQuotaQueue(mgr manager.Manager, evaluator quota.Evaluator, role Role) error {
+	// the queued pods are listed by the index in both the controller and the webhook
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, PodQueueIndex, PodQueueIndexFunc); err != nil {
+		return err
+	}
+	if role.Controller() {
+		controller := &ClusterResourceQuotaQueueReconciler{
+			Client:    mgr.GetClient(),
+			Evaluator: evaluator,
+			Recorder:  mgr.GetEventRecorderFor("clusterresourcequota-queue"),
+		}
+		if err := controller.Setup(mgr); err != nil {
+			return err
+		}
+	}
+	if !role.Webhook() {
+		return nil
+	}
+	webhook := &PodQueueAdmission{
+		Decoder:   webhookadmission.NewDecoder(mgr.GetScheme()),
+		Client:    mgr.GetClient(),
+		Evaluator: evaluator,
+	}
+	mgr.GetWebhookServer().Register("/mutate-pod-queue", &webhookadmission.Webhook{Handler: InstrumentedHandler{Webhook: "pod-queue", Handler: webhook}})
+	return nil
+}
+
+// PodQueueAdmission gates the pods which exceed a ClusterResourceQuota with queueing enabled,
+// or which would overtake the pods already queued by it.
+// The queued pods are listed by [PodQueueIndex] of the client.
+type PodQueueAdmission struct {
+	Decoder   webhookadmission.Decoder
+	Client    client.Client
+	Evaluator quota.Evaluator
+}
+
+func (c *PodQueueAdmission) Handle(ctx context.Context, req webhookadmission.Request) webhookadmission.Response {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if req.Operation != "CREATE" || req.SubResource != "" {
+		return webhookadmission.Allowed("")
+	}
+	pod := &corev1.Pod{}
+	if err := c.Decoder.Decode(req, pod); err != nil {
+		log.Error(err, "Decode request")
+		return webhookadmission.Errored(http.StatusBadRequest, err)
+	}
+	pod.Namespace = req.Namespace
+	// the queue of a pod is only decided by this webhook
+	supplied := dequeuePod(pod)
+	queue, err := c.queueOf(ctx, pod)
+	if err != nil {
+		log.Error(err, "Find queue of pod")
+		return webhookadmission.Errored(http.StatusInternalServerError, err)
+	}
+	if queue == "" && !supplied {
+		return webhookadmission.Allowed("")
+	}
+	if queue != "" {
+		log.V(1).Info("Pod queued", "clusterresourcequota", queue)
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+		}
+		pod.Labels[LabelClusterResourceQuotaQueue] = queue
+		pod.Spec.SchedulingGates = append(pod.Spec.SchedulingGates, corev1.PodSchedulingGate{Name: SchedulingGateClusterResourceQuotaQueue})
+	}
+	marshaled, err := json.Marshal(pod)
+	if err != nil {
+		return webhookadmission.Errored(http.StatusInternalServerError, err)
+	}
+	return webhookadmission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// queueOf returns the name of the ClusterResourceQuota which queues the pod, or empty if the pod is not queued.
+// Pods requesting resources whose budget is exhausted are queued, they are denied by [PodBudgetAdmission] if the ClusterResourceQuota has no queueing.
+func (c *PodQueueAdmission) queueOf(ctx context.Context, pod *corev1.Pod) (string, error) {
+	quotaslist := &quotav1.ResourceQuotaList{}
+	if err := c.Client.List(ctx, quotaslist, client.InNamespace(pod.Namespace), client.HasLabels{LabelClusterResourceQuota}); err != nil {
+		return "", err
+	}
+	usage, err := c.Evaluator.Usage(pod)
+	if err != nil {
+		return "", err
+	}
+	for i := range quotaslist.Items {
+		rq := &quotaslist.Items[i]
+		// the domains of topology are checked when the pod is released from the queue
+		if rq.Labels[LabelClusterResourceQuotaTopology] != "" {
+			continue
+		}
+		matched, err := c.Evaluator.Matches(toQuota(rq), pod)
+		if err != nil {
+			return "", err
+		}
+		if !matched {
+			continue
+		}
+		crq := &quotav1.ClusterResourceQuota{}
+		if err := c.Client.Get(ctx, client.ObjectKey{Name: rq.Labels[LabelClusterResourceQuota]}, crq); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return "", err
+		}
+		if crq.Spec.Queueing == nil {
+			continue
+		}
+		if exhaustedBudgetMessage(crq, usage) != "" {
+			return crq.Name, nil
+		}
+		queued := &corev1.PodList{}
+		if err := c.Client.List(ctx, queued, client.MatchingFields{PodQueueIndex: crq.Name}); err != nil {
+			return "", err
+		}
+		if len(queued.Items) != 0 || exceededMessage(crq.Name, usage, crq.Status.Used, crq.Status.Hard) != "" {
+			return crq.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// ClusterResourceQuotaQueueReconciler releases the pods queued by a ClusterResourceQuota in the order of its queueing policy,
+// as long as they fit in the usage of the ClusterResourceQuota.
+// The queued pods are listed by [PodQueueIndex] of the client.
+type ClusterResourceQuotaQueueReconciler struct {
+	Client    client.Client
+	Evaluator quota.Evaluator
+	Recorder  record.EventRecorder
+}
+
+// PodQueueIndexFunc indexes the pods by the ClusterResourceQuota queuing them.
+func PodQueueIndexFunc(obj client.Object) []string {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil
+	}
+	if queue := PodQueue(pod); queue != "" {
+		return []string{queue}
+	}
+	return nil
+}
+
+// Setup sets up the reconciler, [PodQueueIndex] must be indexed by the manager.
+func (a *ClusterResourceQuotaQueueReconciler) Setup(mgr manager.Manager) error {
+	return builder.ControllerManagedBy(mgr).
+		Named("clusterresourcequota-queue").
+		For(&quotav1.ClusterResourceQuota{}, builder.WithPredicates(OnClusterResourceQuotaUsageChange())).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(a.OnPodChange)).
+		Complete(a)
+}
+
+func (a *ClusterResourceQuotaQueueReconciler) OnPodChange(ctx context.Context, obj client.Object) []reconcile.Request {
+	name := obj.GetLabels()[LabelClusterResourceQuotaQueue]
+	if name == "" {
+		return []reconcile.Request{}
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: name}}}
+}
+
+func (a *ClusterResourceQuotaQueueReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	pods := &corev1.PodList{}
+	if err := a.Client.List(ctx, pods, client.MatchingFields{PodQueueIndex: req.Name}); err != nil {
+		return reconcile.Result{}, err
+	}
+	if len(pods.Items) == 0 {
+		return reconcile.Result{}, nil
+	}
+	crq := &quotav1.ClusterResourceQuota{}
+	if err := a.Client.Get(ctx, req.NamespacedName, crq); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return reconcile.Result{}, err
+		}
+		// the queue is gone with the ClusterResourceQuota, release all pods
+		crq = nil
+	}
+	policy := quotav1.QueueingPolicyFIFO
+	if crq != nil && crq.Spec.Queueing != nil && crq.Spec.Queueing.Policy != "" {
+		policy = crq.Spec.Queueing.Policy
+	}
+	SortQueuedPods(pods.Items, policy)
+
+	var used, hard corev1.ResourceList
+	if crq != nil {
+		used, hard = crq.Status.Used, crq.Status.Hard
+	}
+	// the order of the queue is kept, pods behind a pod which does not fit in the ClusterResourceQuota wait,
+	// a pod rejected by other quotas is skipped until the next reconcile, so it does not block the queue
+	var queued []*corev1.Pod
+	blocked := false
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !blocked {
+			released, usage, err := a.release(ctx, crq, pod, used, hard)
+			switch {
+			case released:
+				used = quota.Add(used, usage)
+				continue
+			case apierrors.IsForbidden(err):
+				a.releaseRejected(pod, err)
+			case err != nil:
+				log.Error(err, "release queued pod", "pod", client.ObjectKeyFromObject(pod))
+				blocked = true
+			default:
+				blocked = true
+			}
+		}
+		queued = append(queued, pod)
+	}
+	for i, pod := range queued {
+		message := fmt.Sprintf("position %d of %d in the queue of clusterresourcequota %s", i+1, len(queued), req.Name)
+		if err := a.setQueuedCondition(ctx, pod, corev1.ConditionTrue, "Queued", message); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	if len(queued) != 0 {
+		// usage of the ClusterResourceQuota is watched, it's a fallback of missed updates
+		return reconcile.Result{RequeueAfter: time.Minute}, nil
+	}
+	return reconcile.Result{}, nil
+}
+
+// release removes the queue gate of the pod if it fits in the remaining usage,
+// it returns the usage of the pod charged.
+func (a *ClusterResourceQuotaQueueReconciler) release(ctx context.Context, crq *quotav1.ClusterResourceQuota, pod *corev1.Pod, used, hard corev1.ResourceList) (bool, corev1.ResourceList, error) {
+	released := pod.DeepCopy()
+	dequeuePod(released)
+	usage, err := a.Evaluator.Usage(released)
+	if err != nil {
+		return false, nil, err
+	}
+	if crq != nil && crq.Spec.Queueing != nil {
+		if exceededMessage(crq.Name, usage, used, hard) != "" || exhaustedBudgetMessage(crq, usage) != "" {
+			return false, nil, nil
+		}
+	}
+	// the update is checked by the resourcequota webhook, it's rejected if the pod exceeds a ResourceQuota of the queue
+	if err := a.Client.Update(ctx, released); err != nil {
+		return false, nil, err
+	}
+	if err := a.setQueuedCondition(ctx, released, corev1.ConditionFalse, "Released", "released from the queue"); err != nil {
+		return true, usage, err
+	}
+	return true, usage, nil
+}
+
+// releaseRejected records the rejection of the release of a pod, the pod stays in the queue.
+func (a *ClusterResourceQuotaQueueReconciler) releaseRejected(pod *corev1.Pod, err error) {
+	if a.Recorder == nil {
+		return
+	}
+	a.Recorder.Eventf(pod, corev1.EventTypeWarning, EventReasonReleaseRejected, "Release from the queue is rejected: %v", err)
+}
+
+func (a *ClusterResourceQuotaQueueReconciler) setQueuedCondition(ctx context.Context, pod *corev1.Pod, status corev1.ConditionStatus, reason, message string) error {
+	condition := corev1.PodCondition{
+		Type:    PodConditionClusterResourceQuotaQueued,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	}
+	updated := pod.DeepCopy()
+	i := slices.IndexFunc(updated.Status.Conditions, func(c corev1.PodCondition) bool {
+		return c.Type == PodConditionClusterResourceQuotaQueued
+	})
+	if i == -1 {
+		condition.LastTransitionTime = metav1.Now()
+		updated.Status.Conditions = append(updated.Status.Conditions, condition)
+	} else {
+		existing := updated.Status.Conditions[i]
+		condition.LastTransitionTime = existing.LastTransitionTime
+		if existing.Status != status {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		updated.Status.Conditions[i] = condition
+	}
+	if equality.Semantic.DeepEqual(pod.Status.Conditions, updated.Status.Conditions) {
+		return nil
+	}
+	return a.Client.Status().Patch(ctx, updated, client.StrategicMergeFrom(pod))
+}
+
+// SortQueuedPods sorts the pods in the order they are released by the policy.
+func SortQueuedPods(pods []corev1.Pod, policy quotav1.QueueingPolicy) {
+	sort.SliceStable(pods, func(i, j int) bool {
+		if policy == quotav1.QueueingPolicyPriority {
+			pi, pj := podPriority(&pods[i]), podPriority(&pods[j])
+			if pi != pj {
+				return pi > pj
+			}
+		}
+		ti, tj := pods[i].CreationTimestamp, pods[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+}
+
+func podPriority(pod *corev1.Pod) int32 {
+	if pod.Spec.Priority == nil {
+		return 0
+	}
+	return *pod.Spec.Priority
+}
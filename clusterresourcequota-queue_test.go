@@ -0,0 +1,286 @@
+package clusterresourcequota_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	admv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/admission"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	webhookadmission "sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"xiaoshiai.cn/clusterresourcequota"
+	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+func newQueueingObjects(policy thisquotav1.QueueingPolicy, used string) []runtime.Object {
+	return []runtime.Object{
+		&thisquotav1.ClusterResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+			Spec: thisquotav1.ClusterResourceQuotaSpec{
+				Queueing: &thisquotav1.QueueingSpec{Policy: policy},
+			},
+			Status: thisquotav1.ClusterResourceQuotaStatus{
+				ResourceQuotaStatus: corev1.ResourceQuotaStatus{
+					Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("2")},
+					Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse(used)},
+				},
+			},
+		},
+		&thisquotav1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "crq",
+				Namespace: "ns1",
+				Labels:    map[string]string{clusterresourcequota.LabelClusterResourceQuota: "crq"},
+			},
+			Status: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("2")},
+				Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse(used)},
+			},
+		},
+	}
+}
+
+func newQueuePod(name string, created time.Time, priority int32, queued bool) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns1", CreationTimestamp: metav1.NewTime(created)},
+		Spec: corev1.PodSpec{
+			Priority: ptr.To(priority),
+			Containers: []corev1.Container{{
+				Name: "container",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+				},
+			}},
+		},
+	}
+	if queued {
+		pod.Labels = map[string]string{clusterresourcequota.LabelClusterResourceQuotaQueue: "crq"}
+		pod.Spec.SchedulingGates = []corev1.PodSchedulingGate{{Name: clusterresourcequota.SchedulingGateClusterResourceQuotaQueue}}
+	}
+	return pod
+}
+
+func newTestPodEvaluator(t *testing.T) *clusterresourcequota.ConditionalPodEvaluator {
+	informerFactory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0)
+	evaluator := clusterresourcequota.NewConditionalPodEvaluator(informerFactory, nil)
+	informerFactory.Start(t.Context().Done())
+	informerFactory.WaitForCacheSync(t.Context().Done())
+	return evaluator.(*clusterresourcequota.ConditionalPodEvaluator)
+}
+
+func TestConditionalPodEvaluator_Queued(t *testing.T) {
+	evaluator := newTestPodEvaluator(t)
+
+	queued := newQueuePod("pod", time.Now(), 0, true)
+	released := newQueuePod("pod", time.Now(), 0, false)
+	usage, err := evaluator.Usage(queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu := usage[corev1.ResourceRequestsCPU]; cpu.String() != "1" {
+		t.Errorf("usage of queued pod = %v, want requests.cpu=1", usage)
+	}
+
+	newQuota := func(requirements ...corev1.ScopedResourceSelectorRequirement) *corev1.ResourceQuota {
+		rq := &corev1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: "rq", Namespace: "ns1"},
+			Spec:       corev1.ResourceQuotaSpec{Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("2")}},
+			Status:     corev1.ResourceQuotaStatus{Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("2")}},
+		}
+		if len(requirements) > 0 {
+			rq.Spec.ScopeSelector = &corev1.ScopeSelector{MatchExpressions: requirements}
+		}
+		return rq
+	}
+	ofQueue := newQuota(corev1.ScopedResourceSelectorRequirement{
+		ScopeName: clusterresourcequota.ResourceQuotaScopeQueue, Operator: corev1.ScopeSelectorOpNotIn, Values: []string{"crq"},
+	})
+	other := newQuota()
+
+	// only the quotas of the queue exempt the queued pod
+	for _, tt := range []struct {
+		name string
+		rq   *corev1.ResourceQuota
+		pod  *corev1.Pod
+		want bool
+	}{
+		{name: "queued by the quota", rq: ofQueue, pod: queued, want: false},
+		{name: "released by the quota", rq: ofQueue, pod: released, want: true},
+		{name: "queued by other quota", rq: other, pod: queued, want: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			matched, err := evaluator.Matches(tt.rq, tt.pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matched != tt.want {
+				t.Errorf("Matches() = %v, want %v", matched, tt.want)
+			}
+		})
+	}
+
+	// a pod gated without the label of the queue is not queued
+	gated := released.DeepCopy()
+	gated.Spec.SchedulingGates = []corev1.PodSchedulingGate{{Name: clusterresourcequota.SchedulingGateClusterResourceQuotaQueue}}
+	if matched, err := evaluator.Matches(ofQueue, gated); err != nil || !matched {
+		t.Errorf("expected the gated pod matched, got %v: %v", matched, err)
+	}
+
+	// the released pod is only charged to the quotas of the queue
+	dequeue := &clusterresourcequota.PodDequeueEvaluator{Evaluator: evaluator}
+	labeled := released.DeepCopy()
+	labeled.Labels = map[string]string{clusterresourcequota.LabelClusterResourceQuotaQueue: "crq"}
+	if matched, err := dequeue.Matches(ofQueue, labeled); err != nil || !matched {
+		t.Errorf("expected the released pod charged to the quota of the queue, got %v: %v", matched, err)
+	}
+	if matched, err := dequeue.Matches(other, labeled); err != nil || matched {
+		t.Errorf("expected the released pod not charged to other quotas again, got %v: %v", matched, err)
+	}
+
+	attr := admission.NewAttributesRecord(released, queued, corev1.SchemeGroupVersion.WithKind("Pod"), "ns1", "pod", corev1.SchemeGroupVersion.WithResource("pods"), "", admission.Update, &metav1.UpdateOptions{}, false, nil)
+	if !clusterresourcequota.IsPodDequeued(attr) {
+		t.Errorf("expected the release of a queued pod")
+	}
+	filter := clusterresourcequota.ConditionalUpdateFilter()
+	if !filter(corev1.SchemeGroupVersion.WithResource("pods"), queued, released) {
+		t.Errorf("expected update filter to replenish quota when pod is released")
+	}
+}
+
+func TestPodQueueAdmission_Handle(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	evaluator := newTestPodEvaluator(t)
+
+	for _, tt := range []struct {
+		name         string
+		used         string
+		objects      []runtime.Object
+		supplied     bool
+		wantQueued   bool
+		wantStripped bool
+	}{
+		{name: "fits", used: "1"},
+		{name: "queue supplied by user", used: "1", supplied: true, wantStripped: true},
+		{name: "exceeds", used: "2", wantQueued: true},
+		{
+			name:       "queue-not-empty",
+			used:       "0",
+			objects:    []runtime.Object{newQueuePod("queued", time.Now(), 0, true)},
+			wantQueued: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := append(newQueueingObjects(thisquotav1.QueueingPolicyFIFO, tt.used), tt.objects...)
+			cli := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).
+				WithIndex(&corev1.Pod{}, clusterresourcequota.PodQueueIndex, clusterresourcequota.PodQueueIndexFunc).Build()
+			handler := &clusterresourcequota.PodQueueAdmission{
+				Decoder:   webhookadmission.NewDecoder(scheme),
+				Client:    cli,
+				Evaluator: evaluator,
+			}
+			pod := newQueuePod("pod", time.Now(), 0, tt.supplied)
+			resp := handler.Handle(ctx, webhookadmission.Request{AdmissionRequest: admv1.AdmissionRequest{
+				Operation: admv1.Create, Namespace: "ns1",
+				Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Object: toRawExtension(pod),
+			}})
+			if !resp.Allowed {
+				t.Fatalf("expected allowed, got: %+v", resp.Result)
+			}
+			queued, stripped := false, false
+			for _, patch := range resp.Patches {
+				if patch.Path == "/spec/schedulingGates" {
+					queued = patch.Operation == "add"
+					stripped = patch.Operation == "remove"
+				}
+			}
+			if queued != tt.wantQueued || stripped != tt.wantStripped {
+				t.Errorf("queued = %v, stripped = %v, want %v and %v, patches: %v", queued, stripped, tt.wantQueued, tt.wantStripped, resp.Patches)
+			}
+		})
+	}
+}
+
+func TestClusterResourceQuotaQueueReconciler(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	evaluator := newTestPodEvaluator(t)
+	now := time.Now()
+
+	for _, tt := range []struct {
+		name         string
+		policy       thisquotav1.QueueingPolicy
+		rejected     string
+		wantReleased string
+	}{
+		{name: "fifo", policy: thisquotav1.QueueingPolicyFIFO, wantReleased: "first"},
+		{name: "priority", policy: thisquotav1.QueueingPolicyPriority, wantReleased: "important"},
+		// the pod rejected by other quotas does not block the queue
+		{name: "rejected", policy: thisquotav1.QueueingPolicyFIFO, rejected: "first", wantReleased: "important"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := append(newQueueingObjects(tt.policy, "1"),
+				newQueuePod("first", now.Add(-time.Hour), 0, true),
+				newQueuePod("important", now, 100, true),
+				newQueuePod("last", now.Add(time.Hour), 0, true),
+			)
+			cli := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).WithStatusSubresource(&corev1.Pod{}).
+				WithIndex(&corev1.Pod{}, clusterresourcequota.PodQueueIndex, clusterresourcequota.PodQueueIndexFunc).
+				WithInterceptorFuncs(interceptor.Funcs{
+					Update: func(ctx context.Context, cli client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+						if obj.GetName() == tt.rejected {
+							return apierrors.NewForbidden(corev1.Resource("pods"), obj.GetName(), fmt.Errorf("exceeded quota: other"))
+						}
+						return cli.Update(ctx, obj, opts...)
+					},
+				}).Build()
+			recorder := record.NewFakeRecorder(10)
+			reconciler := &clusterresourcequota.ClusterResourceQuotaQueueReconciler{Client: cli, Evaluator: evaluator, Recorder: recorder}
+			if _, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: "crq"}}); err != nil {
+				t.Fatal(err)
+			}
+			positions := map[string]string{}
+			for _, name := range []string{"first", "important", "last"} {
+				pod := &corev1.Pod{}
+				if err := cli.Get(ctx, client.ObjectKey{Namespace: "ns1", Name: name}, pod); err != nil {
+					t.Fatal(err)
+				}
+				if released := !clusterresourcequota.IsPodQueued(pod); released != (name == tt.wantReleased) {
+					t.Errorf("pod %s released = %v", name, released)
+				}
+				for _, condition := range pod.Status.Conditions {
+					if condition.Type == clusterresourcequota.PodConditionClusterResourceQuotaQueued && condition.Status == corev1.ConditionTrue {
+						positions[name] = condition.Message
+					}
+				}
+			}
+			if len(positions) != 2 {
+				t.Fatalf("expected 2 pods with queued condition, got: %v", positions)
+			}
+			if !strings.HasPrefix(positions["last"], "position 2 of 2") {
+				t.Errorf("unexpected position of the last pod: %q", positions["last"])
+			}
+			if tt.rejected != "" && len(recorder.Events) != 1 {
+				t.Errorf("expected an event of the rejected release, got %d", len(recorder.Events))
+			}
+		})
+	}
+}
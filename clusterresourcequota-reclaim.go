@@ -0,0 +1,277 @@
+package clusterresourcequota
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	quotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+// ReclaimRecheckInterval is the interval the usage is checked again after pods are evicted,
+// the usage in the status is updated after the evicted pods are gone.
+const ReclaimRecheckInterval = 30 * time.Second
+
+// NewClusterResourceQuotaReclaim sets up the eviction of pods for ClusterResourceQuotas with the reclaim policy Evict,
+// evaluator is the pod evaluator used by the resourcequota webhook.
+func NewClusterResourceQuotaReclaim(mgr manager.Manager, evaluator quota.Evaluator) error {
+	controller := &ClusterResourceQuotaReclaimReconciler{
+		Client:    mgr.GetClient(),
+		Evaluator: evaluator,
+		Recorder:  mgr.GetEventRecorderFor("clusterresourcequota-reclaim"),
+		Clock:     clock.RealClock{},
+	}
+	return controller.Setup(mgr)
+}
+
+// ClusterResourceQuotaReclaimReconciler evicts pods of a ClusterResourceQuota whose usage exceeds the hard limits,
+// or the hard limits of a topology domain, for longer than the grace period, until the usage is under the hard limits.
+type ClusterResourceQuotaReclaimReconciler struct {
+	Client    client.Client
+	Evaluator quota.Evaluator
+	Recorder  record.EventRecorder
+	Clock     clock.Clock
+}
+
+func (a *ClusterResourceQuotaReclaimReconciler) Setup(mgr manager.Manager) error {
+	return builder.ControllerManagedBy(mgr).
+		Named("clusterresourcequota-reclaim").
+		For(&quotav1.ClusterResourceQuota{}, builder.WithPredicates(OnClusterResourceQuotaUsageChange())).
+		Complete(a)
+}
+
+func (a *ClusterResourceQuotaReclaimReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	crq := &quotav1.ClusterResourceQuota{}
+	if err := a.Client.Get(ctx, req.NamespacedName, crq); err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	reclaim := crq.Spec.Reclaim
+	if crq.DeletionTimestamp != nil || reclaim == nil || reclaim.Policy != quotav1.ReclaimPolicyEvict {
+		return reconcile.Result{}, a.setExceededSince(ctx, crq, nil)
+	}
+	if !isExceeded(crq) {
+		return reconcile.Result{}, a.setExceededSince(ctx, crq, nil)
+	}
+	now := a.Clock.Now()
+	if crq.Status.ExceededSince == nil {
+		since := metav1.NewTime(now)
+		if err := a.setExceededSince(ctx, crq, &since); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	var grace time.Duration
+	if reclaim.GracePeriodSeconds != nil {
+		grace = time.Duration(*reclaim.GracePeriodSeconds) * time.Second
+	}
+	if remaining := crq.Status.ExceededSince.Add(grace).Sub(now); remaining > 0 {
+		return reconcile.Result{RequeueAfter: remaining}, nil
+	}
+	if err := a.evict(ctx, crq); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{RequeueAfter: ReclaimRecheckInterval}, nil
+}
+
+// evict evicts the pods of each topology domain exceeded, then the pods of the ClusterResourceQuota,
+// until the usage of evicted pods covers the excess of the domain and of the ClusterResourceQuota.
+func (a *ClusterResourceQuotaReclaimReconciler) evict(ctx context.Context, crq *quotav1.ClusterResourceQuota) error {
+	evicted := sets.New[types.NamespacedName]()
+	reclaimed := corev1.ResourceList{}
+	for _, domain := range crq.Status.Topology {
+		excess := exceededUsage(domain.Used, domain.Hard)
+		if len(excess) == 0 {
+			continue
+		}
+		pods, err := a.reclaimablePods(ctx, crq, domain.Value)
+		if err != nil {
+			return err
+		}
+		usage, err := a.evictPods(ctx, crq, pods, excess, evicted)
+		if err != nil {
+			return err
+		}
+		reclaimed = quota.Add(reclaimed, usage)
+	}
+	excess := quota.RemoveZeros(quota.SubtractWithNonNegativeResult(exceededUsage(crq.Status.Used, crq.Status.Hard), reclaimed))
+	if len(excess) == 0 {
+		return nil
+	}
+	pods, err := a.reclaimablePods(ctx, crq, "")
+	if err != nil {
+		return err
+	}
+	_, err = a.evictPods(ctx, crq, pods, excess, evicted)
+	return err
+}
+
+// evictPods evicts the pods in the order of [SortReclaimablePods] until the usage of evicted pods covers the excess,
+// it returns the usage of the pods evicted, which are added to evicted and skipped if evicted already.
+func (a *ClusterResourceQuotaReclaimReconciler) evictPods(ctx context.Context, crq *quotav1.ClusterResourceQuota, pods []corev1.Pod, excess corev1.ResourceList, evicted sets.Set[types.NamespacedName]) (corev1.ResourceList, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	reclaimed := corev1.ResourceList{}
+	// pods being deleted are reclaimed already, the usage is not updated yet
+	candidates := []corev1.Pod{}
+	for _, pod := range pods {
+		if evicted.Has(client.ObjectKeyFromObject(&pod)) {
+			continue
+		}
+		if pod.DeletionTimestamp == nil {
+			candidates = append(candidates, pod)
+			continue
+		}
+		usage, err := a.Evaluator.Usage(&pod)
+		if err != nil {
+			return nil, err
+		}
+		excess = quota.RemoveZeros(quota.SubtractWithNonNegativeResult(excess, usage))
+	}
+	SortReclaimablePods(candidates)
+
+	for i := range candidates {
+		if len(excess) == 0 {
+			return reclaimed, nil
+		}
+		pod := &candidates[i]
+		usage, err := a.Evaluator.Usage(pod)
+		if err != nil {
+			return nil, err
+		}
+		reclaimed := quota.RemoveZeros(quota.Mask(usage, quota.ResourceNames(excess)))
+		if len(reclaimed) == 0 {
+			continue
+		}
+		eviction := &policyv1.Eviction{ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace}}
+		if err := a.Client.SubResource("eviction").Create(ctx, pod, eviction); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			// the eviction is refused by a PodDisruptionBudget, try the next pod
+			if apierrors.IsTooManyRequests(err) {
+				a.Recorder.Eventf(crq, corev1.EventTypeWarning, "EvictionBlocked",
+					"Eviction of pod %s/%s is blocked: %v", pod.Namespace, pod.Name, err)
+				continue
+			}
+			return nil, err
+		}
+		evicted.Insert(client.ObjectKeyFromObject(pod))
+		reclaimed = quota.Add(reclaimed, usage)
+		log.Info("Pod evicted to reclaim quota", "clusterresourcequota", crq.Name, "pod", client.ObjectKeyFromObject(pod))
+		a.Recorder.Eventf(crq, corev1.EventTypeNormal, "Evicted",
+			"Evicted pod %s/%s to reclaim %s", pod.Namespace, pod.Name, prettyPrint(reclaimed))
+		excess = quota.RemoveZeros(quota.SubtractWithNonNegativeResult(excess, usage))
+	}
+	return reclaimed, nil
+}
+
+// reclaimablePods returns the running pods charged by the ResourceQuotas of the ClusterResourceQuota,
+// or by the ResourceQuotas of the topology domain if topology is not empty.
+func (a *ClusterResourceQuotaReclaimReconciler) reclaimablePods(ctx context.Context, crq *quotav1.ClusterResourceQuota, topology string) ([]corev1.Pod, error) {
+	pods, err := resourceQuotaPods(ctx, a.Client, a.Evaluator, crq, topology)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(pods, func(pod corev1.Pod) bool {
+		return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+	}), nil
+}
+
+// clusterResourceQuotaPods returns the pods, including terminated pods, matching the ResourceQuotas of the ClusterResourceQuota.
+func clusterResourceQuotaPods(ctx context.Context, cli client.Client, evaluator quota.Evaluator, crq *quotav1.ClusterResourceQuota) ([]corev1.Pod, error) {
+	return resourceQuotaPods(ctx, cli, evaluator, crq, "")
+}
+
+// resourceQuotaPods returns the pods, including terminated pods, matching the ResourceQuotas of the ClusterResourceQuota
+// which limit the topology domain, or which limit no topology domain if topology is empty.
+func resourceQuotaPods(ctx context.Context, cli client.Client, evaluator quota.Evaluator, crq *quotav1.ClusterResourceQuota, topology string) ([]corev1.Pod, error) {
+	quotaslist := &quotav1.ResourceQuotaList{}
+	if err := cli.List(ctx, quotaslist, client.MatchingLabels{LabelClusterResourceQuota: crq.Name}); err != nil {
+		return nil, err
+	}
+	pods := []corev1.Pod{}
+	for i := range quotaslist.Items {
+		rq := &quotaslist.Items[i]
+		if rq.Labels[LabelClusterResourceQuotaTopology] != topology {
+			continue
+		}
+		podlist := &corev1.PodList{}
+		if err := cli.List(ctx, podlist, client.InNamespace(rq.Namespace)); err != nil {
+			return nil, err
+		}
+		for _, pod := range podlist.Items {
+			matched, err := evaluator.Matches(toQuota(rq), &pod)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return pods, nil
+}
+
+func (a *ClusterResourceQuotaReclaimReconciler) setExceededSince(ctx context.Context, crq *quotav1.ClusterResourceQuota, since *metav1.Time) error {
+	if crq.Status.ExceededSince.Equal(since) {
+		return nil
+	}
+	original := crq.DeepCopy()
+	crq.Status.ExceededSince = since
+	if err := a.Client.Status().Patch(ctx, crq, client.MergeFrom(original)); err != nil {
+		return fmt.Errorf("update exceeded time of clusterresourcequota %s: %w", crq.Name, err)
+	}
+	return nil
+}
+
+// isExceeded returns true if the usage of the ClusterResourceQuota exceeds its hard limits, or the hard limits of a topology domain.
+func isExceeded(crq *quotav1.ClusterResourceQuota) bool {
+	if len(exceededUsage(crq.Status.Used, crq.Status.Hard)) != 0 {
+		return true
+	}
+	return slices.ContainsFunc(crq.Status.Topology, func(domain quotav1.TopologyResourceQuotaStatus) bool {
+		return len(exceededUsage(domain.Used, domain.Hard)) != 0
+	})
+}
+
+// exceededUsage returns the usage above the hard limits.
+func exceededUsage(used, hard corev1.ResourceList) corev1.ResourceList {
+	limited := quota.Mask(used, quota.ResourceNames(hard))
+	return quota.RemoveZeros(quota.SubtractWithNonNegativeResult(limited, hard))
+}
+
+// SortReclaimablePods sorts the pods in the order they are evicted, lowest priority first, then newest first.
+func SortReclaimablePods(pods []corev1.Pod) {
+	sort.SliceStable(pods, func(i, j int) bool {
+		pi, pj := podPriority(&pods[i]), podPriority(&pods[j])
+		if pi != pj {
+			return pi < pj
+		}
+		ti, tj := pods[i].CreationTimestamp, pods[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return tj.Before(&ti)
+		}
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+}
@@ -0,0 +1,209 @@
+package clusterresourcequota_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	testingclock "k8s.io/utils/clock/testing"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"xiaoshiai.cn/clusterresourcequota"
+	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+func TestClusterResourceQuotaReclaimReconciler(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	evaluator := newTestPodEvaluator(t)
+	// the time in the status is stored in seconds
+	now := time.Now().Truncate(time.Second)
+
+	for _, tt := range []struct {
+		name        string
+		blocked     string
+		wantEvicted []string
+	}{
+		{name: "lowest-priority-newest-first", wantEvicted: []string{"low-new", "low-old"}},
+		{name: "pdb-blocked", blocked: "low-new", wantEvicted: []string{"low-old", "high"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := []runtime.Object{
+				&thisquotav1.ClusterResourceQuota{
+					ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+					Spec: thisquotav1.ClusterResourceQuotaSpec{
+						Reclaim: &thisquotav1.ReclaimSpec{Policy: thisquotav1.ReclaimPolicyEvict, GracePeriodSeconds: ptr.To[int64](60)},
+					},
+					Status: thisquotav1.ClusterResourceQuotaStatus{
+						ResourceQuotaStatus: corev1.ResourceQuotaStatus{
+							Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1")},
+							Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("3")},
+						},
+					},
+				},
+				&thisquotav1.ResourceQuota{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "crq",
+						Namespace: "ns1",
+						Labels:    map[string]string{clusterresourcequota.LabelClusterResourceQuota: "crq"},
+					},
+					Status: corev1.ResourceQuotaStatus{
+						Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1")},
+						Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("3")},
+					},
+				},
+				newQueuePod("low-old", now.Add(-time.Hour), 0, false),
+				newQueuePod("low-new", now, 0, false),
+				newQueuePod("high", now, 100, false),
+			}
+			cli := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).
+				WithStatusSubresource(&thisquotav1.ClusterResourceQuota{}).
+				WithInterceptorFuncs(interceptor.Funcs{
+					SubResourceCreate: func(ctx context.Context, c client.Client, subResourceName string, obj client.Object, subResource client.Object, opts ...client.SubResourceCreateOption) error {
+						if subResourceName == "eviction" && obj.GetName() == tt.blocked {
+							return apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 10)
+						}
+						return c.SubResource(subResourceName).Create(ctx, obj, subResource, opts...)
+					},
+				}).Build()
+			recorder := record.NewFakeRecorder(10)
+			clock := testingclock.NewFakeClock(now)
+			reconciler := &clusterresourcequota.ClusterResourceQuotaReclaimReconciler{
+				Client: cli, Evaluator: evaluator, Recorder: recorder, Clock: clock,
+			}
+			req := reconcile.Request{NamespacedName: types.NamespacedName{Name: "crq"}}
+
+			// the grace period starts
+			result, err := reconciler.Reconcile(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.RequeueAfter != time.Minute {
+				t.Errorf("requeue after = %v, want %v", result.RequeueAfter, time.Minute)
+			}
+			if evicted := evictedPods(t, cli); len(evicted) != 0 {
+				t.Fatalf("evicted during the grace period: %v", evicted)
+			}
+
+			clock.Step(2 * time.Minute)
+			if _, err := reconciler.Reconcile(ctx, req); err != nil {
+				t.Fatal(err)
+			}
+			evicted := evictedPods(t, cli)
+			if len(evicted) != len(tt.wantEvicted) {
+				t.Fatalf("evicted = %v, want %v", evicted, tt.wantEvicted)
+			}
+			for _, name := range tt.wantEvicted {
+				if !evicted[name] {
+					t.Errorf("pod %s not evicted, evicted: %v", name, evicted)
+				}
+			}
+			if len(recorder.Events) < len(tt.wantEvicted) {
+				t.Errorf("expected an event per eviction, got %d", len(recorder.Events))
+			}
+		})
+	}
+}
+
+func evictedPods(t *testing.T, cli client.Client) map[string]bool {
+	evicted := map[string]bool{}
+	for _, name := range []string{"low-old", "low-new", "high"} {
+		if err := cli.Get(context.Background(), client.ObjectKey{Namespace: "ns1", Name: name}, &corev1.Pod{}); apierrors.IsNotFound(err) {
+			evicted[name] = true
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return evicted
+}
+
+func TestClusterResourceQuotaReclaimReconciler_Topology(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	evaluator := newTestPodEvaluator(t)
+	now := time.Now().Truncate(time.Second)
+
+	newZonePod := func(name, zone string, created time.Time) *corev1.Pod {
+		pod := newQueuePod(name, created, 0, false)
+		pod.Spec.NodeSelector = map[string]string{"topology.kubernetes.io/zone": zone}
+		return pod
+	}
+	cpu := func(value string) corev1.ResourceList {
+		return corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse(value)}
+	}
+	objects := []runtime.Object{
+		&thisquotav1.ClusterResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+			Spec: thisquotav1.ClusterResourceQuotaSpec{
+				Reclaim: &thisquotav1.ReclaimSpec{Policy: thisquotav1.ReclaimPolicyEvict},
+			},
+			Status: thisquotav1.ClusterResourceQuotaStatus{
+				// the usage is under the hard limits, but not in zone-a
+				ResourceQuotaStatus: corev1.ResourceQuotaStatus{Hard: cpu("10"), Used: cpu("3")},
+				Topology: []thisquotav1.TopologyResourceQuotaStatus{
+					{Value: "zone-a", Hard: cpu("1"), Used: cpu("2")},
+					{Value: "zone-b", Hard: cpu("1"), Used: cpu("1")},
+				},
+			},
+		},
+		&thisquotav1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "crq",
+				Namespace: "ns1",
+				Labels:    map[string]string{clusterresourcequota.LabelClusterResourceQuota: "crq"},
+			},
+			Status: corev1.ResourceQuotaStatus{Hard: cpu("10")},
+		},
+		&thisquotav1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      clusterresourcequota.TopologyResourceQuotaName("crq", "zone-a"),
+				Namespace: "ns1",
+				Labels: map[string]string{
+					clusterresourcequota.LabelClusterResourceQuota:         "crq",
+					clusterresourcequota.LabelClusterResourceQuotaTopology: "zone-a",
+				},
+			},
+			Spec: corev1.ResourceQuotaSpec{
+				Hard: cpu("1"),
+				ScopeSelector: &corev1.ScopeSelector{MatchExpressions: []corev1.ScopedResourceSelectorRequirement{{
+					ScopeName: clusterresourcequota.ResourceQuotaScopeTopology,
+					Operator:  corev1.ScopeSelectorOpIn,
+					Values:    []string{"topology.kubernetes.io/zone=zone-a"},
+				}}},
+			},
+			Status: corev1.ResourceQuotaStatus{Hard: cpu("1")},
+		},
+		newZonePod("zone-a-old", "zone-a", now.Add(-time.Hour)),
+		newZonePod("zone-a-new", "zone-a", now.Add(-time.Minute)),
+		// the newest pod is not in the domain exceeded
+		newZonePod("zone-b", "zone-b", now),
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).
+		WithStatusSubresource(&thisquotav1.ClusterResourceQuota{}).Build()
+	reconciler := &clusterresourcequota.ClusterResourceQuotaReclaimReconciler{
+		Client: cli, Evaluator: evaluator, Recorder: record.NewFakeRecorder(10), Clock: testingclock.NewFakeClock(now),
+	}
+	if _, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: "crq"}}); err != nil {
+		t.Fatal(err)
+	}
+	for name, wantEvicted := range map[string]bool{"zone-a-old": false, "zone-a-new": true, "zone-b": false} {
+		err := cli.Get(ctx, client.ObjectKey{Namespace: "ns1", Name: name}, &corev1.Pod{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		if evicted := apierrors.IsNotFound(err); evicted != wantEvicted {
+			t.Errorf("pod %s evicted = %v, want %v", name, evicted, wantEvicted)
+		}
+	}
+}
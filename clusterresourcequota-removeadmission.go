@@ -100,6 +100,9 @@ func (c *ResourceQuotaRemoveAdmission) handleDelete(ctx context.Context, req adm
 	if clusterresourcequota.DeletionTimestamp != nil {
 		return admission.Allowed("ClusterResourceQuota is being deleted")
 	}
+	if topology, ok := target.Labels[LabelClusterResourceQuotaTopology]; ok && !HasTopologyDomain(clusterresourcequota, topology) {
+		return admission.Allowed("Topology domain removed from ClusterResourceQuota")
+	}
 	// if clusterresourcequota exists, forbid deletion
 	msg := fmt.Errorf("resourcequota managed by ClusterResourceQuota %q cannot be deleted", clusterresourcequotaname)
 	log.V(1).Error(msg, "Forbidden deletion")
@@ -0,0 +1,189 @@
+package clusterresourcequota
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	quotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+	"xiaoshiai.cn/common"
+)
+
+// AnnotationForceHardReduction allows the hard limits of a ClusterResourceQuota to be reduced below its usage,
+// when set to "true" by the update reducing them. It's removed by the controller once the reduction is synced.
+const AnnotationForceHardReduction = "force-reduction.clusterresourcequota." + common.GroupPrefix
+
+// ResourceQuotaSpecAdmission validates the spec of ResourceQuota and ClusterResourceQuota,
+// it rejects scope selectors which can not be evaluated, e.g. CEL expressions fail to compile,
+// and hard limits of ClusterResourceQuota reduced below the usage unless forced.
+// Client lists the ResourceQuotas of the ClusterResourceQuota for the usage of topology domains per namespace.
+type ResourceQuotaSpecAdmission struct {
+	Decoder admission.Decoder
+	Client  client.Client
+}
+
+func NewResourceQuotaSpecAdmission(decoder admission.Decoder, client client.Client) *ResourceQuotaSpecAdmission {
+	return &ResourceQuotaSpecAdmission{Decoder: decoder, Client: client}
+}
+
+func (c *ResourceQuotaSpecAdmission) Handle(ctx context.Context, req admission.Request) admission.Response {
+	log := logr.FromContextOrDiscard(ctx)
+
+	var spec corev1.ResourceQuotaSpec
+	var warnings []string
+	switch req.Kind.Kind {
+	case "ClusterResourceQuota":
+		inst := &quotav1.ClusterResourceQuota{}
+		if err := c.Decoder.Decode(req, inst); err != nil {
+			log.Error(err, "Decode request")
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if err := ValidateTopologyResourceQuota(inst); err != nil {
+			log.V(1).Error(err, "Invalid topology")
+			return admission.Errored(http.StatusUnprocessableEntity, fmt.Errorf("invalid topology: %w", err))
+		}
+		if req.Operation == "UPDATE" {
+			old := &quotav1.ClusterResourceQuota{}
+			if err := c.Decoder.DecodeRaw(req.OldObject, old); err != nil {
+				log.Error(err, "Decode old object")
+				return admission.Errored(http.StatusBadRequest, err)
+			}
+			quotaslist := &quotav1.ResourceQuotaList{}
+			if err := c.Client.List(ctx, quotaslist, client.MatchingLabels{LabelClusterResourceQuota: inst.Name}); err != nil {
+				log.Error(err, "List resource quotas")
+				return admission.Errored(http.StatusInternalServerError, err)
+			}
+			if err := ValidateHardReduction(old, inst, quotaslist.Items); err != nil {
+				// the annotation left by a previous update does not force this one
+				if inst.Annotations[AnnotationForceHardReduction] != "true" || old.Annotations[AnnotationForceHardReduction] == "true" {
+					log.V(1).Info("Hard limits reduced below usage", "reason", err.Error())
+					return admission.Denied(fmt.Sprintf("%v, set annotation %s=true to force", err, AnnotationForceHardReduction))
+				}
+				warnings = append(warnings, err.Error())
+			}
+		}
+		spec = inst.Spec.ResourceQuotaSpec
+	case "ResourceQuota":
+		inst := &quotav1.ResourceQuota{}
+		if err := c.Decoder.Decode(req, inst); err != nil {
+			log.Error(err, "Decode request")
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		spec = inst.Spec
+	default:
+		return admission.Allowed("Not a resource quota")
+	}
+	if err := ValidateScopeSelector(spec.ScopeSelector); err != nil {
+		log.V(1).Error(err, "Invalid scope selector")
+		return admission.Errored(http.StatusUnprocessableEntity, fmt.Errorf("invalid scopeSelector: %w", err))
+	}
+	return admission.Allowed("ResourceQuota spec validated").WithWarnings(warnings...)
+}
+
+// ValidateHardReduction returns an error if hard limits of the ClusterResourceQuota, or of its topology domains, are reduced below the usage,
+// the error explains each resource and lists the namespaces contributing to its usage.
+// quotas are the ResourceQuotas of the ClusterResourceQuota, whose usage is the usage of topology domains per namespace.
+func ValidateHardReduction(old, updated *quotav1.ClusterResourceQuota, quotas []quotav1.ResourceQuota) error {
+	var resources []string
+	for _, name := range reducedBelowUsage(old.Spec.Hard, updated.Spec.Hard, old.Status.Used) {
+		hard, used := updated.Spec.Hard[name], old.Status.Used[name]
+		var namespaces []string
+		for _, ns := range old.Status.Namespaces {
+			if usage, ok := ns.Used[name]; ok && !usage.IsZero() {
+				namespaces = append(namespaces, ns.Name)
+			}
+		}
+		resources = append(resources, fmt.Sprintf("%s: hard %s is less than used %s%s", name, hard.String(), used.String(), formatNamespaces(namespaces)))
+	}
+	if updated.Spec.Topology != nil && old.Spec.Topology != nil && updated.Spec.Topology.Key == old.Spec.Topology.Key {
+		for _, domain := range updated.Spec.Topology.Domains {
+			i := slices.IndexFunc(old.Spec.Topology.Domains, func(d quotav1.TopologyDomainResourceQuota) bool { return d.Value == domain.Value })
+			j := slices.IndexFunc(old.Status.Topology, func(d quotav1.TopologyResourceQuotaStatus) bool { return d.Value == domain.Value })
+			if i == -1 || j == -1 {
+				continue
+			}
+			for _, name := range reducedBelowUsage(old.Spec.Topology.Domains[i].Hard, domain.Hard, old.Status.Topology[j].Used) {
+				hard, used := domain.Hard[name], old.Status.Topology[j].Used[name]
+				var namespaces []string
+				for _, rq := range quotas {
+					if usage, ok := rq.Status.Used[name]; ok && !usage.IsZero() && rq.Labels[LabelClusterResourceQuotaTopology] == domain.Value {
+						namespaces = append(namespaces, rq.Namespace)
+					}
+				}
+				resources = append(resources, fmt.Sprintf("%s in topology %s: hard %s is less than used %s%s", name, domain.Value, hard.String(), used.String(), formatNamespaces(namespaces)))
+			}
+		}
+	}
+	if len(resources) == 0 {
+		return nil
+	}
+	sort.Strings(resources)
+	return fmt.Errorf("hard limits reduced below usage: %s", strings.Join(resources, "; "))
+}
+
+// formatNamespaces formats the namespaces contributing to the usage of a resource, it's empty if there is none.
+func formatNamespaces(namespaces []string) string {
+	if len(namespaces) == 0 {
+		return ""
+	}
+	sort.Strings(namespaces)
+	return fmt.Sprintf(" by namespaces %s", strings.Join(namespaces, ", "))
+}
+
+// reducedBelowUsage returns the resources whose hard limits are reduced below the usage.
+func reducedBelowUsage(oldHard, hard, used corev1.ResourceList) []corev1.ResourceName {
+	var names []corev1.ResourceName
+	for name, limit := range hard {
+		oldlimit, ok := oldHard[name]
+		if !ok || limit.Cmp(oldlimit) >= 0 {
+			continue
+		}
+		usage, ok := used[name]
+		if !ok || limit.Cmp(usage) >= 0 {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// ValidateTopologyResourceQuota validates the topology of the ClusterResourceQuota,
+// each domain value must be a valid label value and form a valid ResourceQuota name.
+func ValidateTopologyResourceQuota(clusterResourceQuota *quotav1.ClusterResourceQuota) error {
+	topology := clusterResourceQuota.Spec.Topology
+	if topology == nil {
+		return nil
+	}
+	var errs []error
+	for _, msg := range validation.IsQualifiedName(topology.Key) {
+		errs = append(errs, fmt.Errorf("key %q: %s", topology.Key, msg))
+	}
+	seen := map[string]bool{}
+	for _, domain := range topology.Domains {
+		if seen[domain.Value] {
+			errs = append(errs, fmt.Errorf("duplicate domain %q", domain.Value))
+			continue
+		}
+		seen[domain.Value] = true
+		if domain.Value == "" {
+			errs = append(errs, fmt.Errorf("domain value must not be empty"))
+			continue
+		}
+		for _, msg := range validation.IsValidLabelValue(domain.Value) {
+			errs = append(errs, fmt.Errorf("domain %q: %s", domain.Value, msg))
+		}
+		for _, msg := range validation.IsDNS1123Subdomain(TopologyResourceQuotaName(clusterResourceQuota.Name, domain.Value)) {
+			errs = append(errs, fmt.Errorf("domain %q: %s", domain.Value, msg))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,138 @@
+package clusterresourcequota_test
+
+import (
+	"cmp"
+	"context"
+	"strings"
+	"testing"
+
+	admv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"xiaoshiai.cn/clusterresourcequota"
+	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+func TestResourceQuotaSpecAdmission_HardReduction(t *testing.T) {
+	ctx := context.Background()
+	newTopologyQuota := func(namespace, cpu string) *thisquotav1.ResourceQuota {
+		return &thisquotav1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      clusterresourcequota.TopologyResourceQuotaName("crq", "zone-a"),
+				Namespace: namespace,
+				Labels: map[string]string{
+					clusterresourcequota.LabelClusterResourceQuota:         "crq",
+					clusterresourcequota.LabelClusterResourceQuotaTopology: "zone-a",
+				},
+			},
+			Status: corev1.ResourceQuotaStatus{Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse(cpu)}},
+		}
+	}
+	cli := fake.NewClientBuilder().WithScheme(clusterresourcequota.GetScheme()).
+		WithRuntimeObjects(newTopologyQuota("ns1", "5"), newTopologyQuota("ns2", "0")).Build()
+	handler := clusterresourcequota.NewResourceQuotaSpecAdmission(admission.NewDecoder(clusterresourcequota.GetScheme()), cli)
+
+	old := &thisquotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+		Spec: thisquotav1.ClusterResourceQuotaSpec{
+			ResourceQuotaSpec: corev1.ResourceQuotaSpec{
+				Hard: corev1.ResourceList{
+					corev1.ResourceRequestsCPU:    resource.MustParse("10"),
+					corev1.ResourceRequestsMemory: resource.MustParse("10Gi"),
+				},
+			},
+			Topology: &thisquotav1.TopologyResourceQuotaSpec{
+				Key: corev1.LabelTopologyZone,
+				Domains: []thisquotav1.TopologyDomainResourceQuota{
+					{Value: "zone-a", Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("6")}},
+				},
+			},
+		},
+		Status: thisquotav1.ClusterResourceQuotaStatus{
+			Topology: []thisquotav1.TopologyResourceQuotaStatus{
+				{Value: "zone-a", Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("5")}},
+			},
+			ResourceQuotaStatus: corev1.ResourceQuotaStatus{
+				Used: corev1.ResourceList{
+					corev1.ResourceRequestsCPU:    resource.MustParse("8"),
+					corev1.ResourceRequestsMemory: resource.MustParse("2Gi"),
+				},
+			},
+			Namespaces: []thisquotav1.NamespaceResourceQuota{
+				{Name: "ns1", Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("6")}},
+				{Name: "ns2", Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("2")}},
+			},
+		},
+	}
+	withHard := func(cpu string, force bool) *thisquotav1.ClusterResourceQuota {
+		crq := old.DeepCopy()
+		crq.Spec.Hard[corev1.ResourceRequestsCPU] = resource.MustParse(cpu)
+		if force {
+			crq.Annotations = map[string]string{clusterresourcequota.AnnotationForceHardReduction: "true"}
+		}
+		return crq
+	}
+
+	forced := old.DeepCopy()
+	forced.Annotations = map[string]string{clusterresourcequota.AnnotationForceHardReduction: "true"}
+	withTopologyHard := withHard("10", false)
+	withTopologyHard.Spec.Topology.Domains[0].Hard[corev1.ResourceRequestsCPU] = resource.MustParse("4")
+
+	for _, tt := range []struct {
+		name        string
+		old         *thisquotav1.ClusterResourceQuota
+		obj         *thisquotav1.ClusterResourceQuota
+		wantAllowed bool
+		wantMessage string
+	}{
+		{name: "increase", obj: withHard("20", false), wantAllowed: true},
+		{name: "reduce-above-usage", obj: withHard("8", false), wantAllowed: true},
+		{
+			// each namespace contributing to the usage is listed, not only those above the new limits
+			name:        "reduce-below-usage",
+			obj:         withHard("4", false),
+			wantMessage: "requests.cpu: hard 4 is less than used 8 by namespaces ns1, ns2",
+		},
+		{
+			name:        "reduce-below-usage-forced",
+			obj:         withHard("4", true),
+			wantAllowed: true,
+			wantMessage: "by namespaces ns1, ns2",
+		},
+		{
+			// the annotation left by a previous update does not force the reduction
+			name:        "reduce-below-usage-forced-previously",
+			old:         forced,
+			obj:         withHard("4", true),
+			wantMessage: "requests.cpu: hard 4 is less than used 8",
+		},
+		{
+			name:        "reduce-topology-below-usage",
+			obj:         withTopologyHard,
+			wantMessage: "requests.cpu in topology zone-a: hard 4 is less than used 5 by namespaces ns1,",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := handler.Handle(ctx, admission.Request{AdmissionRequest: admv1.AdmissionRequest{
+				Operation: admv1.Update,
+				Kind:      metav1.GroupVersionKind{Group: "quota.xiaoshiai.cn", Version: "v1", Kind: "ClusterResourceQuota"},
+				Object:    toRawExtension(tt.obj),
+				OldObject: toRawExtension(cmp.Or(tt.old, old)),
+			}})
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("allowed = %v, want %v: %+v", resp.Allowed, tt.wantAllowed, resp.Result)
+			}
+			message := resp.Result.Message + strings.Join(resp.Warnings, "\n")
+			if tt.wantMessage == "" && len(resp.Warnings) != 0 {
+				t.Errorf("unexpected warnings: %v", resp.Warnings)
+			}
+			if !strings.Contains(message, tt.wantMessage) {
+				t.Errorf("message %q does not contain %q", message, tt.wantMessage)
+			}
+		})
+	}
+}
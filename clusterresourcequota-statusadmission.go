@@ -14,6 +14,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	quota "k8s.io/apiserver/pkg/quota/v1"
 	"k8s.io/client-go/util/retry"
@@ -26,6 +27,15 @@ type ResourceQuotaStatusAdmission struct {
 	Decoder admission.Decoder
 	Cache   *ResourceQuotaCache
 	Client  client.Client
+	// Optimistic validates the usage against a fresh read of the ClusterResourceQuota by Reader,
+	// instead of the usage cached by this process, so several webhook replicas can validate the same ClusterResourceQuota.
+	// The status of the ClusterResourceQuota is the usage admitted by all replicas,
+	// and its resourceVersion serializes the admissions, a conflicted admission is validated again against a fresh read.
+	// The usage is written to the status before the ResourceQuota is updated, if the update fails it's rolled back
+	// by the controller once the reservation expires, or at the latest in [StatusResyncInterval].
+	Optimistic bool
+	// Reader reads the ClusterResourceQuota in optimistic mode, it should not be cached, e.g. the API reader of the manager.
+	Reader client.Reader
 }
 
 func NewResourceQuotaStatusAdmission(cache *ResourceQuotaCache, client client.Client) *ResourceQuotaStatusAdmission {
@@ -36,6 +46,15 @@ func NewResourceQuotaStatusAdmission(cache *ResourceQuotaCache, client client.Cl
 	}
 }
 
+// NewOptimisticResourceQuotaStatusAdmission returns the status admission validating against a fresh read of the ClusterResourceQuota,
+// see [ResourceQuotaStatusAdmission.Optimistic].
+func NewOptimisticResourceQuotaStatusAdmission(cache *ResourceQuotaCache, client client.Client, reader client.Reader) *ResourceQuotaStatusAdmission {
+	admission := NewResourceQuotaStatusAdmission(cache, client)
+	admission.Optimistic = true
+	admission.Reader = reader
+	return admission
+}
+
 func (c *ResourceQuotaStatusAdmission) Handle(ctx context.Context, req admission.Request) admission.Response {
 	log := logr.FromContextOrDiscard(ctx)
 
@@ -54,15 +73,32 @@ func (c *ResourceQuotaStatusAdmission) Handle(ctx context.Context, req admission
 		log.V(1).Info("Not managed by ClusterResourceQuota; Allowed")
 		return admission.Allowed("Not managed by ClusterResourceQuota")
 	}
+	// the persisted usage of the ResourceQuota, the delta of the update is validated in optimistic mode
+	var oldused corev1.ResourceList
+	if len(req.OldObject.Raw) > 0 {
+		old := &quotav1.ResourceQuota{}
+		if err := c.Decoder.DecodeRaw(req.OldObject, old); err != nil {
+			log.Error(err, "Decode old object")
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		oldused = old.Status.Used
+	}
 	backoff := wait.Backoff{
 		Duration: 100 * time.Millisecond,
 		Factor:   2.0,
 		Jitter:   0.1,
 		Steps:    5,
 	}
+	topology := inst.Labels[LabelClusterResourceQuotaTopology]
+	conflicts := 0
 	err := retry.RetryOnConflict(backoff, func() error {
-		return c.validate(ctx, inst, clusterresourcequotaname, !isWebhook)
+		err := c.validate(ctx, req.UID, inst, oldused, clusterresourcequotaname, topology, !isWebhook)
+		if apierrors.IsConflict(err) {
+			conflicts++
+		}
+		return err
 	})
+	statusUpdateConflicts.Observe(float64(conflicts))
 	if err != nil {
 		log.Error(err, "Validate ResourceQuota status against ClusterResourceQuota")
 		if apierrors.IsForbidden(err) {
@@ -81,50 +117,105 @@ func isResourceQuotaAdmissionControllerServiceAccount(user *authnv1.UserInfo) bo
 		slices.Contains(user.Groups, "system:masters")
 }
 
-func (c *ResourceQuotaStatusAdmission) validate(ctx context.Context, rq *quotav1.ResourceQuota, clusterresourcequotaname string, skipvalidation bool) error {
-	return c.Cache.GetOrCreate(ctx, clusterresourcequotaname).OnLock(ctx, func(cache *ClusterResourceQuotaCache) error {
-		crq := &quotav1.ClusterResourceQuota{}
-		if err := c.Client.Get(ctx, client.ObjectKey{Name: clusterresourcequotaname}, crq); err != nil {
-			if apierrors.IsNotFound(err) {
+// validate checks the usage of the ResourceQuota against the ClusterResourceQuota,
+// or against the topology domain of the ClusterResourceQuota if topology is not empty.
+// The admitted usage is reserved by the admission UID until the informer observes it, or the reservation expires.
+func (c *ResourceQuotaStatusAdmission) validate(ctx context.Context, uid types.UID, rq *quotav1.ResourceQuota, oldused corev1.ResourceList, clusterresourcequotaname, topology string, skipvalidation bool) error {
+	cachekey := ResourceQuotaCacheKey(clusterresourcequotaname, topology)
+	reader := client.Reader(c.Client)
+	if c.Optimistic {
+		reader = c.Reader
+	}
+	// read before locking the cache not to hold the lock over the read from the apiserver,
+	// the update of the status conflicts if it's changed since the read
+	crq := &quotav1.ClusterResourceQuota{}
+	if err := reader.Get(ctx, client.ObjectKey{Name: clusterresourcequotaname}, crq); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return c.Cache.OnLock(ctx, cachekey, func(cache *ClusterResourceQuotaCache) error {
+		hard, used := crq.Status.Hard, crq.Status.Used
+		if topology != "" {
+			i := slices.IndexFunc(crq.Status.Topology, func(t quotav1.TopologyResourceQuotaStatus) bool {
+				return t.Value == topology
+			})
+			if i == -1 {
+				// the domain is not observed by the controller yet or has been removed,
+				// the usage is aggregated by the controller later
 				return nil
 			}
-			return err
+			hard, used = crq.Status.Topology[i].Hard, crq.Status.Topology[i].Used
 		}
 
-		oldtotal := corev1.ResourceList{}
-		for _, usage := range cache.Quotas {
-			oldtotal = quota.Add(oldtotal, usage.Used)
+		// a retried admission replaces its own reservation
+		delete(cache.Reservations, uid)
+		oldtotal := cache.Used()
+		// reserve the usage until the updated status is observed, it's rolled back if the update fails
+		now := c.Cache.Clock.Now()
+		cache.Reserve(uid, &Reservation{
+			Namespace:       rq.Namespace,
+			Used:            rq.Status.Used,
+			ResourceVersion: rq.ResourceVersion,
+			Reserved:        now,
+			Expires:         now.Add(c.Cache.ReservationTimeout),
+		})
+		newtotal := cache.Used()
+		delta := quota.Subtract(newtotal, oldtotal)
+		if c.Optimistic {
+			// the usage admitted by other replicas is only known from the status
+			delta = quota.Subtract(rq.Status.Used, oldused)
+			oldtotal = used
+			newtotal = quota.Add(oldtotal, delta)
 		}
-		var oldusage corev1.ResourceList
-		if usage, ok := cache.Quotas[rq.Namespace]; ok {
-			oldusage = usage.Used
-		}
-		delta := quota.Subtract(rq.Status.Used, oldusage)
-		newtotal := quota.Add(oldtotal, delta)
 
 		// add current request and check against clusterresourcequota status hard limit
 		if !skipvalidation {
-			if ok, exceeded := quota.LessThanOrEqual(newtotal, crq.Status.Hard); !ok {
+			if ok, exceeded := quota.LessThanOrEqual(newtotal, hard); !ok {
+				delete(cache.Reservations, uid)
+				name, reason := crq.Name, AdmissionReasonExceeded
+				if topology != "" {
+					name, reason = fmt.Sprintf("%s, topology: %s", crq.Name, topology), AdmissionReasonTopologyExceeded
+				}
+				recordAdmission(crq.Name, AdmissionDecisionDenied, reason, quota.Mask(delta, exceeded))
 				err := fmt.Errorf("exceeded cluster quota: %s, requested: %s, used: %s, limited: %s",
-					crq.Name,
+					name,
 					prettyPrint(quota.Mask(delta, exceeded)),
 					prettyPrint(quota.Mask(oldtotal, exceeded)),
-					prettyPrint(quota.Mask(crq.Status.Hard, exceeded)))
+					prettyPrint(quota.Mask(hard, exceeded)))
 				return apierrors.NewForbidden(schema.GroupResource{}, "", err)
 			}
 		}
 		// update clusterresourcequota status
-		updateClusterResourceQuotaStatusUsed(crq, rq, newtotal)
+		if topology != "" {
+			updateClusterResourceQuotaStatusTopologyUsed(crq, topology, newtotal)
+		} else {
+			updateClusterResourceQuotaStatusUsed(crq, rq, newtotal)
+		}
 		// atomic update
 		if err := c.Client.Status().Update(ctx, crq); err != nil {
+			delete(cache.Reservations, uid)
 			return err
 		}
-		// update clusterresourcequota status used
-		cache.Quotas[rq.Namespace] = &ResourceUsageInfo{LastUpdate: time.Now(), Used: rq.Status.Used}
+		if !skipvalidation {
+			recordAdmission(crq.Name, AdmissionDecisionAllowed, AdmissionReasonWithinQuota, increased(delta))
+		}
 		return nil
 	})
 }
 
+// increased returns the resources increased by delta.
+func increased(delta corev1.ResourceList) corev1.ResourceList {
+	result := corev1.ResourceList{}
+	for name, quantity := range delta {
+		if quantity.Sign() > 0 {
+			result[name] = quantity
+		}
+	}
+	return result
+}
+
 func updateClusterResourceQuotaStatusUsed(crq *quotav1.ClusterResourceQuota, rq *quotav1.ResourceQuota, newtotal corev1.ResourceList) {
 	crq.Status.Used = newtotal
 	i := slices.IndexFunc(crq.Status.Namespaces, func(n quotav1.NamespaceResourceQuota) bool {
@@ -137,6 +228,14 @@ func updateClusterResourceQuotaStatusUsed(crq *quotav1.ClusterResourceQuota, rq
 	}
 }
 
+func updateClusterResourceQuotaStatusTopologyUsed(crq *quotav1.ClusterResourceQuota, topology string, newtotal corev1.ResourceList) {
+	for i := range crq.Status.Topology {
+		if crq.Status.Topology[i].Value == topology {
+			crq.Status.Topology[i].Used = newtotal
+		}
+	}
+}
+
 // prettyPrint formats a resource list for usage in errors
 // it outputs resources sorted in increasing order
 func prettyPrint(item corev1.ResourceList) string {
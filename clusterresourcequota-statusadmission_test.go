@@ -3,7 +3,12 @@ package clusterresourcequota_test
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	admv1 "k8s.io/api/admission/v1"
 	authnv1 "k8s.io/api/authentication/v1"
@@ -11,7 +16,11 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	testingclock "k8s.io/utils/clock/testing"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	"xiaoshiai.cn/clusterresourcequota"
@@ -128,6 +137,165 @@ func TestResourceQuotaStatusAdmission_Handle(t *testing.T) {
 	})
 }
 
+func TestResourceQuotaStatusAdmission_OptimisticReplicas(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	crq := &thisquotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+		Status: thisquotav1.ClusterResourceQuotaStatus{
+			ResourceQuotaStatus: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10")},
+				Used: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("0")},
+			},
+		},
+	}
+	client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(crq).WithStatusSubresource(crq).Build()
+
+	// every replica has its own cache, they share only the apiserver
+	const replicas, namespaces, increments = 3, 6, 5
+	handlers := make([]*clusterresourcequota.ResourceQuotaStatusAdmission, replicas)
+	for i := range handlers {
+		handlers[i] = clusterresourcequota.NewOptimisticResourceQuotaStatusAdmission(clusterresourcequota.NewResourceQuotaCache(), client, client)
+	}
+	newRQ := func(namespace string, used int64) *thisquotav1.ResourceQuota {
+		return &thisquotav1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "clusterresourcequota.crq",
+				Namespace:       namespace,
+				ResourceVersion: strconv.FormatInt(used+1, 10),
+				Labels:          map[string]string{clusterresourcequota.LabelClusterResourceQuota: "crq"},
+			},
+			Status: corev1.ResourceQuotaStatus{
+				Used: corev1.ResourceList{corev1.ResourceCPU: *resource.NewQuantity(used, resource.DecimalSI)},
+			},
+		}
+	}
+
+	// each namespace increases its usage one by one, the requests are spread over the replicas,
+	// an admitted usage is persisted, an errored request (e.g. conflicts exhausted) is retried
+	admitted := make([]int64, namespaces)
+	var wg sync.WaitGroup
+	for n := range namespaces {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			namespace := fmt.Sprintf("ns%d", n)
+			for attempt := 0; admitted[n] < increments; attempt++ {
+				handler := handlers[(n+attempt)%replicas]
+				resp := handler.Handle(ctx, admission.Request{AdmissionRequest: admv1.AdmissionRequest{
+					UID:       types.UID(fmt.Sprintf("%s-%d", namespace, attempt)),
+					Object:    toRawExtension(newRQ(namespace, admitted[n]+1)),
+					OldObject: toRawExtension(newRQ(namespace, admitted[n])),
+					UserInfo:  authnv1.UserInfo{Username: "system:apiserver"},
+				}})
+				if resp.Allowed {
+					admitted[n]++
+					continue
+				}
+				if resp.Result.Code == http.StatusForbidden {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var total int64
+	for _, n := range admitted {
+		total += n
+	}
+	if total != 10 {
+		t.Errorf("admitted %d cpu over all replicas %v, want exactly the hard limit 10", total, admitted)
+	}
+	updated := &thisquotav1.ClusterResourceQuota{}
+	if err := client.Get(ctx, types.NamespacedName{Name: "crq"}, updated); err != nil {
+		t.Fatal(err)
+	}
+	if used := updated.Status.Used[corev1.ResourceCPU]; used.Value() != total {
+		t.Errorf("status used = %s, want the admitted usage %d", used.String(), total)
+	}
+}
+
+func TestResourceQuotaStatusAdmission_OptimisticRollback(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	hard := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")}
+	crq := &thisquotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+		Spec: thisquotav1.ClusterResourceQuotaSpec{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+			ResourceQuotaSpec: corev1.ResourceQuotaSpec{Hard: hard},
+		},
+		Status: thisquotav1.ClusterResourceQuotaStatus{
+			ResourceQuotaStatus: corev1.ResourceQuotaStatus{
+				Hard: hard,
+				Used: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+			},
+		},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns1", Labels: map[string]string{"team": "a"}}}
+	rq := newCachedResourceQuota("ns1", "10", "1")
+	rq.Spec.Hard = hard
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(crq, ns, rq).WithStatusSubresource(crq).Build()
+	if err := cli.Get(ctx, types.NamespacedName{Namespace: "ns1", Name: "crq"}, rq); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := testingclock.NewFakeClock(time.Now())
+	cache := clusterresourcequota.NewResourceQuotaCache()
+	cache.Clock = clock
+	expired := make(chan event.GenericEvent, 1)
+	syncer := &clusterresourcequota.ResourceQuotaCacheSyncer{Cache: cache, Expired: expired}
+	syncer.OnAdd(rq, true)
+	handler := clusterresourcequota.NewOptimisticResourceQuotaStatusAdmission(cache, cli, cli)
+	controller := clusterresourcequota.NewClusterResourceQuotaReconciler(cli, cache, nil)
+	controller.ResyncInterval = clusterresourcequota.StatusResyncInterval
+
+	// the admission writes the usage to the status of the clusterresourcequota,
+	// then the update of the resourcequota fails, e.g. denied by another webhook
+	updated := rq.DeepCopy()
+	updated.Status.Used = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("3")}
+	if resp := handler.Handle(ctx, admission.Request{AdmissionRequest: admv1.AdmissionRequest{
+		UID:       "a",
+		Object:    toRawExtension(updated),
+		OldObject: toRawExtension(rq),
+		UserInfo:  authnv1.UserInfo{Username: "system:apiserver"},
+	}}); !resp.Allowed {
+		t.Fatalf("expected allowed, got %v", resp.Result)
+	}
+	statusUsed := func() string {
+		t.Helper()
+		current := &thisquotav1.ClusterResourceQuota{}
+		if err := cli.Get(ctx, types.NamespacedName{Name: "crq"}, current); err != nil {
+			t.Fatal(err)
+		}
+		used := current.Status.Used[corev1.ResourceCPU]
+		return used.String()
+	}
+	if got := statusUsed(); got != "3" {
+		t.Fatalf("status used = %s after admitted, want 3", got)
+	}
+
+	clock.Step(clusterresourcequota.DefaultReservationTimeout)
+	syncer.ExpireReservations(ctx)
+	var e event.GenericEvent
+	select {
+	case e = <-expired:
+	default:
+		t.Fatalf("expected the clusterresourcequota notified once the reservation expires")
+	}
+	result, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: e.Object.GetName()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := statusUsed(); got != "1" {
+		t.Errorf("status used = %s after aggregated again, want the persisted usage 1", got)
+	}
+	if result.RequeueAfter != clusterresourcequota.StatusResyncInterval {
+		t.Errorf("requeue after = %v, want the status aggregated again in %v", result.RequeueAfter, clusterresourcequota.StatusResyncInterval)
+	}
+}
+
 func toRawExtension(obj runtime.Object) runtime.RawExtension {
 	raw, _ := json.Marshal(obj)
 	return runtime.RawExtension{Raw: raw}
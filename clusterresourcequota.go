@@ -2,23 +2,44 @@ package clusterresourcequota
 
 import (
 	"context"
-	"time"
 
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
-func NewClusterResourceQuota(ctx context.Context, mgr manager.Manager) error {
-	controller := NewClusterResourceQuotaReconciler(mgr.GetClient())
-	if err := controller.Setup(mgr); err != nil {
+// NewClusterResourceQuota sets up the controller and the webhooks of ClusterResourceQuota by role,
+// the status admission validates against a fresh read of the ClusterResourceQuota if optimistic, for several webhook replicas.
+func NewClusterResourceQuota(ctx context.Context, mgr manager.Manager, role Role, optimistic bool) error {
+	cache := NewResourceQuotaCache()
+	// the replicas not running the controller request the leader to aggregate the status of rolled back reservations
+	syncer := &ResourceQuotaCacheSyncer{Cache: cache, Informers: mgr.GetCache(), Elected: mgr.Elected(), Client: mgr.GetClient()}
+	if role.Controller() {
+		// the status of clusterresourcequotas with rolled back reservations is aggregated again
+		expired := make(chan event.GenericEvent, expiredBufferSize)
+		controller := NewClusterResourceQuotaReconciler(mgr.GetClient(), cache, mgr.GetEventRecorderFor("clusterresourcequota"))
+		controller.Expired = expired
+		controller.ResyncInterval = StatusResyncInterval
+		if err := controller.Setup(mgr); err != nil {
+			return err
+		}
+		syncer.Expired = expired
+	}
+	if !role.Webhook() {
+		return nil
+	}
+	// feed our cache with the events of the ResourceQuota informer
+	if err := mgr.Add(syncer); err != nil {
 		return err
 	}
-	cache := NewResourceQuotaCache()
-	// copy quotas from client cache to our cache periodically
-	mgr.Add(&CacheSyner{Cache: cache, Client: mgr.GetClient(), Interval: 30 * time.Second})
 	webhook := NewResourceQuotaStatusAdmission(cache, mgr.GetClient())
-	mgr.GetWebhookServer().Register("/validate-resourcequota-status", &admission.Webhook{Handler: webhook})
+	if optimistic {
+		webhook = NewOptimisticResourceQuotaStatusAdmission(cache, mgr.GetClient(), mgr.GetAPIReader())
+	}
+	mgr.GetWebhookServer().Register("/validate-resourcequota-status", &admission.Webhook{Handler: InstrumentedHandler{Webhook: "resourcequota-status", Handler: webhook}})
 	webhookRemove := NewResourceQuotaRemoveAdmission(mgr.GetClient())
-	mgr.GetWebhookServer().Register("/validate-resourcequota-remove", &admission.Webhook{Handler: webhookRemove})
+	mgr.GetWebhookServer().Register("/validate-resourcequota-remove", &admission.Webhook{Handler: InstrumentedHandler{Webhook: "resourcequota-remove", Handler: webhookRemove}})
+	webhookSpec := NewResourceQuotaSpecAdmission(admission.NewDecoder(mgr.GetScheme()), mgr.GetClient())
+	mgr.GetWebhookServer().Register("/validate-resourcequota-spec", &admission.Webhook{Handler: InstrumentedHandler{Webhook: "resourcequota-spec", Handler: webhookSpec}})
 	return nil
 }
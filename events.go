@@ -0,0 +1,170 @@
+package clusterresourcequota
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	quotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+	"xiaoshiai.cn/common"
+)
+
+// AnnotationWarningThreshold is the percentage of the hard limits of a ClusterResourceQuota,
+// an ApproachingLimit event is recorded when the usage of a resource reaches it, "0" disables the events.
+const AnnotationWarningThreshold = "warning-threshold.clusterresourcequota." + common.GroupPrefix
+
+// DefaultWarningThreshold is the warning threshold in percent of ClusterResourceQuotas without [AnnotationWarningThreshold].
+const DefaultWarningThreshold = 90
+
+const (
+	EventReasonNamespaceAdded          = "NamespaceAdded"
+	EventReasonNamespaceRemoved        = "NamespaceRemoved"
+	EventReasonResourceQuotaSyncFailed = "ResourceQuotaSyncFailed"
+	EventReasonApproachingLimit        = "ApproachingLimit"
+	EventReasonExceededQuota           = "ExceededQuota"
+	EventReasonReleaseRejected         = "ReleaseRejected"
+)
+
+// warningThreshold returns the warning threshold of the ClusterResourceQuota in percent.
+func warningThreshold(crq *quotav1.ClusterResourceQuota) int {
+	value, ok := crq.Annotations[AnnotationWarningThreshold]
+	if !ok {
+		return DefaultWarningThreshold
+	}
+	threshold, err := strconv.Atoi(value)
+	if err != nil || threshold < 0 || threshold > 100 {
+		return DefaultWarningThreshold
+	}
+	return threshold
+}
+
+// approachingLimits returns the resources whose usage reached the threshold of the hard limits,
+// and was below the threshold of the previous hard limits, so the event is recorded once per crossing.
+func approachingLimits(previousHard, previousUsed, hard, used corev1.ResourceList, threshold int) []corev1.ResourceName {
+	if threshold <= 0 {
+		return nil
+	}
+	reached := func(hard, used corev1.ResourceList, name corev1.ResourceName) bool {
+		limit, ok := hard[name]
+		if !ok || limit.Sign() <= 0 {
+			return false
+		}
+		usage := used[name]
+		return usage.AsApproximateFloat64()*100 >= limit.AsApproximateFloat64()*float64(threshold)
+	}
+	var names []corev1.ResourceName
+	for name := range hard {
+		if reached(hard, used, name) && !reached(previousHard, previousUsed, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// recordStatusEvents records the changes of the selected namespaces and the usage approaching the hard limits,
+// previous is the status before the aggregation.
+func (a *ClusterResourceQuotaReconciler) recordStatusEvents(crq *quotav1.ClusterResourceQuota, previous *quotav1.ClusterResourceQuotaStatus) {
+	if a.Recorder == nil {
+		return
+	}
+	namespaceNames := func(namespaces []quotav1.NamespaceResourceQuota) []string {
+		names := make([]string, 0, len(namespaces))
+		for _, ns := range namespaces {
+			names = append(names, ns.Name)
+		}
+		return names
+	}
+	previousNamespaces, namespaces := namespaceNames(previous.Namespaces), namespaceNames(crq.Status.Namespaces)
+	for _, ns := range namespaces {
+		if !slices.Contains(previousNamespaces, ns) {
+			a.Recorder.Eventf(crq, corev1.EventTypeNormal, EventReasonNamespaceAdded, "Namespace %s is selected", ns)
+		}
+	}
+	for _, ns := range previousNamespaces {
+		if !slices.Contains(namespaces, ns) {
+			a.Recorder.Eventf(crq, corev1.EventTypeNormal, EventReasonNamespaceRemoved, "Namespace %s is no longer selected", ns)
+		}
+	}
+
+	threshold := warningThreshold(crq)
+	for _, name := range approachingLimits(previous.Hard, previous.Used, crq.Status.Hard, crq.Status.Used, threshold) {
+		used, hard := crq.Status.Used[name], crq.Status.Hard[name]
+		a.Recorder.Eventf(crq, corev1.EventTypeWarning, EventReasonApproachingLimit,
+			"Usage of %s is %s, reached %d%% of the hard limit %s", name, used.String(), threshold, hard.String())
+	}
+	for _, domain := range crq.Status.Topology {
+		var previousHard, previousUsed corev1.ResourceList
+		if i := slices.IndexFunc(previous.Topology, func(t quotav1.TopologyResourceQuotaStatus) bool { return t.Value == domain.Value }); i != -1 {
+			previousHard, previousUsed = previous.Topology[i].Hard, previous.Topology[i].Used
+		}
+		for _, name := range approachingLimits(previousHard, previousUsed, domain.Hard, domain.Used, threshold) {
+			used, hard := domain.Used[name], domain.Hard[name]
+			a.Recorder.Eventf(crq, corev1.EventTypeWarning, EventReasonApproachingLimit,
+				"Usage of %s in topology %s is %s, reached %d%% of the hard limit %s", name, domain.Value, used.String(), threshold, hard.String())
+		}
+	}
+}
+
+var (
+	// exceededQuotaPattern matches the denial of the resourcequota admission plugin, the quota is in the namespace of the request
+	exceededQuotaPattern = regexp.MustCompile(`exceeded quota: ([^,\s]+)`)
+	// exceededClusterQuotaPattern matches the denial of [ResourceQuotaStatusAdmission]
+	exceededClusterQuotaPattern = regexp.MustCompile(`exceeded cluster quota: ([^,\s]+)(?:, topology: ([^,\s]+))?`)
+)
+
+// NewExceededQuotaEvents returns the events of requests denied by quotas, reader should be cached,
+// e.g. the client of the manager.
+func NewExceededQuotaEvents(reader client.Reader, recorder record.EventRecorder) *ExceededQuotaEvents {
+	return &ExceededQuotaEvents{Reader: reader, Recorder: recorder}
+}
+
+// ExceededQuotaEvents records an ExceededQuota event with the requesting object on the ResourceQuota
+// and the ClusterResourceQuota denying a request, the quotas are resolved from the message of the denial.
+// Repeated denials are deduplicated and rate limited per quota by the event recorder.
+type ExceededQuotaEvents struct {
+	Reader   client.Reader
+	Recorder record.EventRecorder
+}
+
+// Record records the denial of the request, obj is the requesting object decoded from the request.
+func (e *ExceededQuotaEvents) Record(ctx context.Context, req admission.Request, obj runtime.Object, message string) {
+	name := req.Name
+	if accessor, err := meta.Accessor(obj); err == nil && name == "" {
+		name = accessor.GetGenerateName()
+	}
+	eventf := func(quota client.Object, key client.ObjectKey) {
+		if err := e.Reader.Get(ctx, key, quota); err != nil {
+			return
+		}
+		e.Recorder.Eventf(quota, corev1.EventTypeWarning, EventReasonExceededQuota,
+			"Denied %s of %s %s/%s: %s", req.Operation, req.Kind.Kind, req.Namespace, name, message)
+	}
+	if match := exceededQuotaPattern.FindStringSubmatch(message); match != nil {
+		eventf(&quotav1.ResourceQuota{}, client.ObjectKey{Namespace: req.Namespace, Name: match[1]})
+	}
+	if match := exceededClusterQuotaPattern.FindStringSubmatch(message); match != nil {
+		crqname, rqname := match[1], match[1]
+		if topology := match[2]; topology != "" {
+			rqname = TopologyResourceQuotaName(crqname, topology)
+		}
+		eventf(&quotav1.ClusterResourceQuota{}, client.ObjectKey{Name: crqname})
+		eventf(&quotav1.ResourceQuota{}, client.ObjectKey{Namespace: req.Namespace, Name: rqname})
+	}
+}
+
+// resourceQuotaSyncFailed records the failure to create or update the ResourceQuota of a namespace.
+func (a *ClusterResourceQuotaReconciler) resourceQuotaSyncFailed(crq *quotav1.ClusterResourceQuota, namespace, name string, err error) {
+	if a.Recorder == nil {
+		return
+	}
+	a.Recorder.Eventf(crq, corev1.EventTypeWarning, EventReasonResourceQuotaSyncFailed,
+		"Failed to create or update ResourceQuota %s/%s: %v", namespace, name, err)
+}
@@ -0,0 +1,59 @@
+package clusterresourcequota_test
+
+import (
+	"context"
+	"testing"
+
+	admv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"xiaoshiai.cn/clusterresourcequota"
+	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+func TestExceededQuotaEvents_Record(t *testing.T) {
+	crq := &thisquotav1.ClusterResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: "crq"}}
+	cli := fake.NewClientBuilder().WithScheme(clusterresourcequota.GetScheme()).WithObjects(
+		crq,
+		&thisquotav1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: "crq", Namespace: "ns1"}},
+		&thisquotav1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: clusterresourcequota.TopologyResourceQuotaName("crq", "zone-a"), Namespace: "ns1"}},
+		&thisquotav1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: "rq", Namespace: "ns1"}},
+	).Build()
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "web-", Namespace: "ns1"}}
+	req := admission.Request{AdmissionRequest: admv1.AdmissionRequest{
+		Operation: admv1.Create,
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "ns1",
+		Object:    toRawExtension(pod),
+	}}
+	for _, tt := range []struct {
+		name    string
+		message string
+		want    int
+	}{
+		{name: "resource quota", message: "exceeded quota: rq, requested: cpu=2, used: cpu=1, limited: cpu=2", want: 1},
+		{name: "cluster resource quota", message: "exceeded cluster quota: crq, requested: cpu=2, used: cpu=1, limited: cpu=2", want: 2},
+		{name: "topology", message: "exceeded cluster quota: crq, topology: zone-a, requested: cpu=2, used: cpu=1, limited: cpu=2", want: 2},
+		{name: "quota not found", message: "exceeded quota: missing, requested: cpu=2, used: cpu=1, limited: cpu=2", want: 0},
+		{name: "not a quota", message: "pods is forbidden", want: 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			clusterresourcequota.NewExceededQuotaEvents(cli, recorder).Record(context.Background(), req, pod, tt.message)
+			if got := len(recorder.Events); got != tt.want {
+				t.Fatalf("recorded %d events, want %d", got, tt.want)
+			}
+			for range tt.want {
+				want := "Warning ExceededQuota Denied CREATE of Pod ns1/web-: " + tt.message
+				if got := <-recorder.Events; got != want {
+					t.Errorf("event = %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
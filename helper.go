@@ -9,6 +9,7 @@ import (
 	authenticationv1 "k8s.io/api/authentication/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	apiserveradmission "k8s.io/apiserver/pkg/admission"
@@ -21,6 +22,8 @@ import (
 type ValidationInterfaceAdaptor struct {
 	Validation apiserveradmission.ValidationInterface
 	Schema     *runtime.Scheme
+	// Exceeded records the requests denied by quotas if set
+	Exceeded *ExceededQuotaEvents
 }
 
 func (v ValidationInterfaceAdaptor) Handle(ctx context.Context, req admission.Request) admission.Response {
@@ -55,6 +58,9 @@ func (v ValidationInterfaceAdaptor) Handle(ctx context.Context, req admission.Re
 		if !errors.As(err, &statusErr) {
 			return admission.Errored(http.StatusBadRequest, err)
 		}
+		if v.Exceeded != nil && apierrors.IsForbidden(err) {
+			v.Exceeded.Record(ctx, req, current, statusErr.Status().Message)
+		}
 		return admission.Response{
 			AdmissionResponse: admissionv1.AdmissionResponse{
 				Allowed: false,
@@ -70,7 +76,7 @@ func (v ValidationInterfaceAdaptor) decodeObject(_ context.Context, req admissio
 	var current, old, options runtime.Object
 	gvk := schema.GroupVersionKind{Group: req.Kind.Group, Version: req.Kind.Version, Kind: req.Kind.Kind}
 	if req.Object.Raw != nil {
-		empty, err := v.Schema.New(gvk)
+		empty, err := v.newObject(gvk)
 		if err != nil {
 			return nil, nil, nil, err
 		}
@@ -80,7 +86,7 @@ func (v ValidationInterfaceAdaptor) decodeObject(_ context.Context, req admissio
 		current = empty
 	}
 	if req.OldObject.Raw != nil {
-		empty, err := v.Schema.New(gvk)
+		empty, err := v.newObject(gvk)
 		if err != nil {
 			return nil, nil, nil, err
 		}
@@ -114,6 +120,17 @@ func (v ValidationInterfaceAdaptor) decodeObject(_ context.Context, req admissio
 	return current, old, options, nil
 }
 
+// newObject returns an empty object of the kind, kinds not registered in the scheme, e.g. custom resources,
+// are decoded as unstructured objects.
+func (v ValidationInterfaceAdaptor) newObject(gvk schema.GroupVersionKind) (runtime.Object, error) {
+	if !v.Schema.Recognizes(gvk) {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(gvk)
+		return u, nil
+	}
+	return v.Schema.New(gvk)
+}
+
 func (v ValidationInterfaceAdaptor) convertUserInfoExtra(in map[string]authenticationv1.ExtraValue) map[string][]string {
 	out := make(map[string][]string, len(in))
 	for k, v := range in {
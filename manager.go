@@ -5,14 +5,18 @@ import (
 	"fmt"
 	"math/rand/v2"
 	"os"
+	"slices"
 	"strconv"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/meta"
 	metainternal "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	resourcequotaapi "k8s.io/apiserver/pkg/admission/plugin/resourcequota/apis/resourcequota"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -21,6 +25,7 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/rest"
 	"k8s.io/controller-manager/pkg/informerfactory"
+	quotainstall "k8s.io/kubernetes/pkg/quota/v1/install"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
@@ -47,7 +52,27 @@ func GetScheme() *runtime.Scheme {
 	return scheme
 }
 
+// Role is the components run by a process, webhook replicas can scale horizontally while the leader of controllers reconciles.
+type Role string
+
+const (
+	RoleAll        Role = "all"
+	RoleWebhook    Role = "webhook"
+	RoleController Role = "controller"
+)
+
+// Webhook returns true if the role serves the webhooks.
+func (r Role) Webhook() bool {
+	return r == RoleAll || r == RoleWebhook
+}
+
+// Controller returns true if the role runs the controllers, they are run by the leader only if leader election is enabled.
+func (r Role) Controller() bool {
+	return r == RoleAll || r == RoleController
+}
+
 type Options struct {
+	Role           string                 `json:"role,omitempty" description:"The components to run, webhook, controller or all"`
 	LeaderElection *LeaderElectionOptions `json:"leaderElection,omitempty"`
 	Webhook        *WebhookOptions        `json:"webhook,omitempty"`
 	Metrics        *MetricsOptions        `json:"metrics,omitempty"`
@@ -57,12 +82,29 @@ type Options struct {
 	// a configuration for the resourcequota admission plugin (k8s.io/apiserver/pkg/admission/plugin/resourcequota.Configuration).
 	// If provided, the configuration will be loaded at startup and passed to the admission plugin.
 	ResourceQuotaConfigFile string `json:"resourceQuotaConfigFile,omitempty" description:"Path to resourcequota admission plugin configuration YAML file"`
+	// Workload is the optional check of Deployments, StatefulSets and Jobs against the remaining quota.
+	Workload *WorkloadOptions `json:"workload,omitempty"`
+	// ObjectCount keeps the rules of the object count webhook in sync with the discovered namespaced resources.
+	ObjectCount *ObjectCountOptions `json:"objectCount,omitempty"`
 }
 
 type WebhookOptions struct {
 	Enabled bool   `json:"enabled,omitempty" description:"Enable webhook"`
 	Addr    string `json:"addr,omitempty" description:"The address the webhook server binds to."`
 	CertDir string `json:"certDir,omitempty" description:"The directory that contains the server key and certificate."`
+	// Optimistic must be enabled when the webhook runs with several replicas, see [ResourceQuotaStatusAdmission.Optimistic].
+	Optimistic bool `json:"optimistic,omitempty" description:"Validate cluster quota against a fresh read of the ClusterResourceQuota, required by several webhook replicas"`
+}
+
+type WorkloadOptions struct {
+	Enabled bool   `json:"enabled,omitempty" description:"Enable the check of workloads against the remaining quota"`
+	Mode    string `json:"mode,omitempty" description:"What to do if a workload can not fit in the remaining quota, Warn or Deny"`
+}
+
+type ObjectCountOptions struct {
+	Enabled              bool   `json:"enabled,omitempty" description:"Sync the rules of the object count webhook with the discovered namespaced resources"`
+	WebhookConfiguration string `json:"webhookConfiguration,omitempty" description:"The name of the ValidatingWebhookConfiguration of the object count webhook"`
+	Webhook              string `json:"webhook,omitempty" description:"The name of the object count webhook"`
 }
 
 type LeaderElectionOptions struct {
@@ -73,6 +115,9 @@ type LeaderElectionOptions struct {
 type MetricsOptions struct {
 	Enabled bool   `json:"enabled,omitempty" description:"Enable metrics endpoint"`
 	Addr    string `json:"addr,omitempty" description:"The address the metric endpoint binds to."`
+	// Resources and PerNamespace bound the cardinality of the quota metrics.
+	Resources    string `json:"resources,omitempty" description:"Comma separated resources labelled in metrics, other resources are left out of gauges and counted as other, all resources if empty"`
+	PerNamespace bool   `json:"perNamespace,omitempty" description:"Export the usage of ClusterResourceQuotas per namespace and the usage of ResourceQuotas"`
 }
 
 type ProbeOptions struct {
@@ -82,6 +127,7 @@ type ProbeOptions struct {
 
 func NewDefaultOptions() *Options {
 	return &Options{
+		Role: string(RoleAll),
 		LeaderElection: &LeaderElectionOptions{
 			Enabled: false,
 			ID:      "clusterresourcequota" + common.GroupPrefix,
@@ -92,13 +138,23 @@ func NewDefaultOptions() *Options {
 			CertDir: "certs",
 		},
 		Metrics: &MetricsOptions{
-			Enabled: true,
-			Addr:    ":9090",
+			Enabled:      true,
+			Addr:         ":9090",
+			PerNamespace: true,
 		},
 		Probe: &ProbeOptions{
 			Enabled: true,
 			Addr:    ":8080",
 		},
+		Workload: &WorkloadOptions{
+			Enabled: false,
+			Mode:    string(WorkloadAdmissionModeWarn),
+		},
+		ObjectCount: &ObjectCountOptions{
+			Enabled:              false,
+			WebhookConfiguration: "clusterresourcequota",
+			Webhook:              "count.resourcequota." + common.GroupPrefix,
+		},
 		ResyncPeriod: time.Hour,
 	}
 }
@@ -156,7 +212,15 @@ func RunWithConfig(ctx context.Context, cfg *rest.Config, options *Options) erro
 }
 
 func Setup(ctx context.Context, mgr ctrl.Manager, options *Options) error {
-	if err := NewClusterResourceQuota(ctx, mgr); err != nil {
+	role := Role(options.Role)
+	if role == "" {
+		role = RoleAll
+	}
+	if role != RoleAll && role != RoleWebhook && role != RoleController {
+		return fmt.Errorf("invalid role %q, must be %s, %s or %s", role, RoleAll, RoleWebhook, RoleController)
+	}
+	optimistic := options.Webhook != nil && options.Webhook.Optimistic
+	if err := NewClusterResourceQuota(ctx, mgr, role, optimistic); err != nil {
 		return fmt.Errorf("create cluster resource quota controller: %w", err)
 	}
 	cli, restconfig := mgr.GetClient(), mgr.GetConfig()
@@ -169,26 +233,109 @@ func Setup(ctx context.Context, mgr ctrl.Manager, options *Options) error {
 	if err != nil {
 		return fmt.Errorf("load resource quota config: %w", err)
 	}
-	resourceQuotaController, resourceQuotaAdmission, err := NewResourceQuota(ctx, context, rqConfig)
+	resourceQuotaController, resourceQuotaAdmission, err := NewResourceQuota(ctx, context, rqConfig, role)
 	if err != nil {
 		return fmt.Errorf("create resource quota admission: %w", err)
 	}
-	go context.Start(ctx)
-	go resourceQuotaController.Run(ctx)
+	// the evaluator registers its informers before the informer factory starts
+	podEvaluator := NewConditionalPodEvaluator(context.InformerFactory, rqConfig.PodWeightedResources())
+	if err := NewClusterResourceQuotaQueue(mgr, podEvaluator, role); err != nil {
+		return fmt.Errorf("create cluster resource quota queue: %w", err)
+	}
+	if role.Controller() {
+		if err := NewClusterResourceQuotaReclaim(mgr, podEvaluator); err != nil {
+			return fmt.Errorf("create cluster resource quota reclaim: %w", err)
+		}
+		if err := NewClusterResourceQuotaBudget(mgr, podEvaluator); err != nil {
+			return fmt.Errorf("create cluster resource quota budget: %w", err)
+		}
+	}
+	if role.Webhook() && options.Workload != nil && options.Workload.Enabled {
+		mode := WorkloadAdmissionMode(options.Workload.Mode)
+		if mode != WorkloadAdmissionModeWarn && mode != WorkloadAdmissionModeDeny {
+			return fmt.Errorf("invalid workload admission mode %q, must be %s or %s", mode, WorkloadAdmissionModeWarn, WorkloadAdmissionModeDeny)
+		}
+		webhookWorkload := NewWorkloadAdmission(cli, podEvaluator, mode)
+		mgr.GetWebhookServer().Register("/validate-workload", &admission.Webhook{Handler: InstrumentedHandler{Webhook: "workload", Handler: webhookWorkload}})
+	}
+	if role.Controller() && options.ObjectCount != nil && options.ObjectCount.Enabled {
+		syncer := &ObjectCountRulesSyncer{
+			Client:               cli,
+			DiscoveryFunc:        context.Clientset.Discovery().ServerPreferredNamespacedResources,
+			IgnoredResources:     quotainstall.DefaultIgnoredResources(),
+			WebhookConfiguration: options.ObjectCount.WebhookConfiguration,
+			Webhook:              options.ObjectCount.Webhook,
+			Interval:             time.Minute,
+		}
+		if err := mgr.Add(syncer); err != nil {
+			return fmt.Errorf("create object count rules syncer: %w", err)
+		}
+	}
+	if err := mgr.Add(context); err != nil {
+		return fmt.Errorf("add informers: %w", err)
+	}
+	// the webhooks are ready once the informers have synced, and the controller has synced the discovered resources
+	if err := mgr.AddReadyzCheck("informers", context.Synced); err != nil {
+		return fmt.Errorf("add informers readyz check: %w", err)
+	}
+	if err := mgr.AddMetricsServerExtraHandler("/debug/informers", context); err != nil {
+		return fmt.Errorf("add informers debug handler: %w", err)
+	}
+	if options.Metrics != nil && options.Metrics.Enabled {
+		if err := RegisterMetrics(mgr.GetCache(), options.Metrics, role, mgr.Elected()); err != nil {
+			return fmt.Errorf("register metrics: %w", err)
+		}
+	}
+	if role.Controller() {
+		if err := mgr.AddReadyzCheck("resourcequota-controller", resourceQuotaController.Synced); err != nil {
+			return fmt.Errorf("add resource quota controller readyz check: %w", err)
+		}
+		if err := mgr.Add(resourceQuotaController); err != nil {
+			return fmt.Errorf("add resource quota controller: %w", err)
+		}
+	}
+	if role.Webhook() {
+		mgr.GetWebhookServer().
+			Register("/validate",
+				&admission.Webhook{
+					Handler: InstrumentedHandler{
+						Webhook: "resourcequota",
+						Handler: ValidationInterfaceAdaptor{
+							Validation: resourceQuotaAdmission,
+							Schema:     cli.Scheme(),
+							Exceeded:   NewExceededQuotaEvents(cli, mgr.GetEventRecorderFor("clusterresourcequota-webhook")),
+						},
+					},
+				})
+	}
+	return nil
+}
 
-	mgr.GetWebhookServer().
-		Register("/validate",
-			&admission.Webhook{
-				Handler: ValidationInterfaceAdaptor{
-					Validation: resourceQuotaAdmission,
-					Schema:     cli.Scheme(),
-				},
-			})
+// ResourceQuotaConfiguration is the configuration loaded from [Options.ResourceQuotaConfigFile],
+// it extends the configuration of the resourcequota admission plugin with the settings of this project.
+type ResourceQuotaConfiguration struct {
+	resourcequotaapi.Configuration `json:",inline"`
+	// WeightedResources are synthetic resources calculated from resources requested by pods
+	WeightedResources []WeightedResource `json:"weightedResources,omitempty"`
+	// CostResources are synthetic resources of the hourly cost of resources requested by pods, priced from price tables
+	CostResources []CostResource `json:"costResources,omitempty"`
+	// Evaluators are evaluators of custom resources calculating usage from the fields of objects
+	Evaluators []CustomEvaluator `json:"evaluators,omitempty"`
+	// PodGroupTimeout is the time the quota reserved by the first member of a pod group waits for the rest of the group,
+	// defaults to [DefaultPodGroupTimeout]
+	PodGroupTimeout metav1.Duration `json:"podGroupTimeout,omitempty"`
+}
 
-	return nil
+// PodWeightedResources returns the synthetic resources of pods, the weighted resources and the cost resources.
+func (c *ResourceQuotaConfiguration) PodWeightedResources() []WeightedResource {
+	weightedResources := slices.Clone(c.WeightedResources)
+	for _, cost := range c.CostResources {
+		weightedResources = append(weightedResources, cost.WeightedResource())
+	}
+	return weightedResources
 }
 
-func GetResourceQuotaConfig(ctx context.Context, path string) (*resourcequotaapi.Configuration, error) {
+func GetResourceQuotaConfig(ctx context.Context, path string) (*ResourceQuotaConfiguration, error) {
 	if path == "" {
 		return DefaultResourceQuotaConfig(), nil
 	}
@@ -197,22 +344,33 @@ func GetResourceQuotaConfig(ctx context.Context, path string) (*resourcequotaapi
 	if err != nil {
 		return nil, fmt.Errorf("read resourcequota config file: %w", err)
 	}
-	var cfg resourcequotaapi.Configuration
+	var cfg ResourceQuotaConfiguration
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("unmarshal resourcequota config file: %w", err)
 	}
+	if err := ValidateWeightedResources(cfg.WeightedResources); err != nil {
+		return nil, fmt.Errorf("invalid resourcequota config file: %w", err)
+	}
+	if err := ValidateCostResources(cfg.CostResources); err != nil {
+		return nil, fmt.Errorf("invalid resourcequota config file: %w", err)
+	}
+	if err := ValidateCustomEvaluators(cfg.Evaluators); err != nil {
+		return nil, fmt.Errorf("invalid resourcequota config file: %w", err)
+	}
 	return &cfg, nil
 }
 
-func DefaultResourceQuotaConfig() *resourcequotaapi.Configuration {
-	return &resourcequotaapi.Configuration{
-		LimitedResources: []resourcequotaapi.LimitedResource{
-			{
-				APIGroup: "v1",
-				Resource: "pods",
-				// all resources on pods are covered, it means that if any resource is requested on pod,
-				// but not defined in ResourceQuota, it will be rejected
-				MatchContains: []string{"*"},
+func DefaultResourceQuotaConfig() *ResourceQuotaConfiguration {
+	return &ResourceQuotaConfiguration{
+		Configuration: resourcequotaapi.Configuration{
+			LimitedResources: []resourcequotaapi.LimitedResource{
+				{
+					APIGroup: "v1",
+					Resource: "pods",
+					// all resources on pods are covered, it means that if any resource is requested on pod,
+					// but not defined in ResourceQuota, it will be rejected
+					MatchContains: []string{"*"},
+				},
 			},
 		},
 	}
@@ -243,17 +401,22 @@ func NewControllerContext(ctx context.Context, restconfig *rest.Config, options
 	if err != nil {
 		return nil, fmt.Errorf("create metadata client: %w", err)
 	}
+	dynamicClient, err := dynamic.NewForConfig(restconfig)
+	if err != nil {
+		return nil, fmt.Errorf("create dynamic client: %w", err)
+	}
 	thisclientset, err := thisclientset.NewForConfig(restconfig)
 	if err != nil {
 		return nil, fmt.Errorf("create this client: %w", err)
 	}
-	return NewControllerContextFromClientSet(ctx, clientset, thisclientset, metadataClient, options.ResyncPeriod)
+	return NewControllerContextFromClientSet(ctx, clientset, thisclientset, metadataClient, dynamicClient, options.ResyncPeriod)
 }
 
 func NewControllerContextFromClientSet(ctx context.Context,
 	clientset kubernetes.Interface,
 	thisclientset thisclientset.Interface,
 	metadataClient metadata.Interface,
+	dynamicClient dynamic.Interface,
 	resyncPeriod time.Duration,
 ) (*ControllerContext, error) {
 	sharedInformers := informers.NewSharedInformerFactoryWithOptions(clientset, ResyncPeriod(resyncPeriod)())
@@ -261,11 +424,15 @@ func NewControllerContextFromClientSet(ctx context.Context,
 	// hijack informer is same as thisinformersfactory but ConditionalResourceQuotaInformer is adapted to ResourceQuotaInformer
 	hijackedthisinformersfactory := thisinformers.NewSharedInformerFactoryWithOptions(thisclientset, ResyncPeriod(resyncPeriod)())
 	metadataInformers := metadatainformer.NewSharedInformerFactoryWithOptions(metadataClient, ResyncPeriod(resyncPeriod)(), metadatainformer.WithTransform(TrimMetadata))
+	// dynamic informers are used by evaluators of custom resources which need the full objects
+	dynamicInformers := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, ResyncPeriod(resyncPeriod)())
 	context := &ControllerContext{
 		InformersStarted:                make(chan struct{}),
 		Clientset:                       clientset,
 		InformerFactory:                 sharedInformers,
 		ObjectOrMetadataInformerFactory: informerfactory.NewInformerFactory(sharedInformers, metadataInformers),
+		MetadataInformerFactory:         metadataInformers,
+		DynamicInformerFactory:          dynamicInformers,
 		ThisClientSet:                   thisclientset,
 		ThisInformerFactory:             thisinformersfactory,
 		HijackedInformerFactory:         hijackedthisinformersfactory,
@@ -279,16 +446,29 @@ type ControllerContext struct {
 	Clientset                       kubernetes.Interface
 	InformerFactory                 informers.SharedInformerFactory
 	ObjectOrMetadataInformerFactory informerfactory.InformerFactory
+	// MetadataInformerFactory is the metadata factory of ObjectOrMetadataInformerFactory, the sync status is checked by it
+	MetadataInformerFactory metadatainformer.SharedInformerFactory
+	DynamicInformerFactory  dynamicinformer.DynamicSharedInformerFactory
 
 	ThisClientSet           thisclientset.Interface
 	ThisInformerFactory     thisinformers.SharedInformerFactory
 	HijackedInformerFactory thisinformers.SharedInformerFactory
 }
 
-func (c *ControllerContext) Start(ctx context.Context) {
-	go c.ThisInformerFactory.Start(ctx.Done())
-	go c.InformerFactory.Start(ctx.Done())
-	go c.ObjectOrMetadataInformerFactory.Start(ctx.Done())
-	go c.HijackedInformerFactory.Start(ctx.Done())
+// Start starts the informer factories, it implements [manager.Runnable].
+func (c *ControllerContext) Start(ctx context.Context) error {
+	c.ThisInformerFactory.Start(ctx.Done())
+	c.InformerFactory.Start(ctx.Done())
+	c.ObjectOrMetadataInformerFactory.Start(ctx.Done())
+	c.DynamicInformerFactory.Start(ctx.Done())
+	c.HijackedInformerFactory.Start(ctx.Done())
 	close(c.InformersStarted)
+	<-ctx.Done()
+	return nil
+}
+
+// NeedLeaderElection implements [manager.LeaderElectionRunnable],
+// the informers are used by the webhooks of every replica, not only by the controller of the leader.
+func (c *ControllerContext) NeedLeaderElection() bool {
+	return false
 }
@@ -0,0 +1,220 @@
+package clusterresourcequota
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	quotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+const (
+	metricsNamespace = "clusterresourcequota"
+	// metricsOtherResource is the resource label of the resources not selected by [MetricsOptions.Resources]
+	metricsOtherResource = "other"
+	// metricsCollectTimeout is the timeout to list the quotas on scrape
+	metricsCollectTimeout = 10 * time.Second
+
+	AdmissionDecisionAllowed = "allowed"
+	AdmissionDecisionDenied  = "denied"
+
+	AdmissionReasonWithinQuota      = "within_quota"
+	AdmissionReasonExceeded         = "exceeded"
+	AdmissionReasonTopologyExceeded = "topology_exceeded"
+	ReservationResultConfirmed      = "confirmed"
+	ReservationResultExpired        = "expired"
+	ReservationResultRemoved        = "removed"
+)
+
+var (
+	admissionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admissions_total",
+		Help:      "Total number of ResourceQuota usage changes admitted or denied by ClusterResourceQuotas, by resource and reason.",
+	}, []string{"clusterresourcequota", "resource", "decision", "reason"})
+
+	admissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_duration_seconds",
+		Help:      "Latency of the webhook handlers, by webhook and decision.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"webhook", "decision"})
+
+	statusUpdateConflicts = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "status_update_conflicts",
+		Help:      "Number of conflicts updating the status of a ClusterResourceQuota per admission.",
+		Buckets:   []float64{0, 1, 2, 3, 4, 5},
+	})
+
+	cacheSyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_sync_duration_seconds",
+		Help:      "Duration of syncing the usage cache of the admission with the ResourceQuotas of a ClusterResourceQuota.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	cacheReservationAge = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_reservation_age_seconds",
+		Help:      "Staleness of the usage cache, the age of the usage reserved by the admission when it's confirmed by the informer, expired or removed.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"result"})
+
+	// metricsResources selects the resource label of the admission metrics, see [MetricsOptions.Resources]
+	metricsResources = NewMetricsResourceFilter("")
+)
+
+func init() {
+	metrics.Registry.MustRegister(admissionsTotal, admissionDuration, statusUpdateConflicts, cacheSyncDuration, cacheReservationAge)
+}
+
+// MetricsResourceFilter bounds the cardinality of the resource label, the resources not selected are reported as [metricsOtherResource].
+type MetricsResourceFilter map[corev1.ResourceName]struct{}
+
+// NewMetricsResourceFilter returns the filter of comma separated resources, it selects all resources if empty.
+func NewMetricsResourceFilter(resources string) MetricsResourceFilter {
+	filter := MetricsResourceFilter{}
+	for _, resource := range strings.Split(resources, ",") {
+		if resource = strings.TrimSpace(resource); resource != "" {
+			filter[corev1.ResourceName(resource)] = struct{}{}
+		}
+	}
+	return filter
+}
+
+func (f MetricsResourceFilter) label(resource corev1.ResourceName) string {
+	if len(f) == 0 {
+		return string(resource)
+	}
+	if _, ok := f[resource]; ok {
+		return string(resource)
+	}
+	return metricsOtherResource
+}
+
+// RegisterMetrics bounds the labels of all metrics by the options, and registers the quota gauges collected from reader
+// if the role runs the controllers, the gauges are collected once elected is closed so only the leader exports them.
+func RegisterMetrics(reader client.Reader, options *MetricsOptions, role Role, elected <-chan struct{}) error {
+	metricsResources = NewMetricsResourceFilter(options.Resources)
+	if !role.Controller() {
+		return nil
+	}
+	return metrics.Registry.Register(&QuotaCollector{Reader: reader, Resources: metricsResources, PerNamespace: options.PerNamespace, Elected: elected})
+}
+
+// recordAdmission counts the admission of the usage of each resource.
+func recordAdmission(clusterresourcequota, decision, reason string, resources corev1.ResourceList) {
+	for resource := range resources {
+		admissionsTotal.WithLabelValues(clusterresourcequota, metricsResources.label(resource), decision, reason).Inc()
+	}
+}
+
+// InstrumentedHandler records the latency of the webhook handler.
+type InstrumentedHandler struct {
+	Webhook string
+	Handler admission.Handler
+}
+
+func (h InstrumentedHandler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	start := time.Now()
+	resp := h.Handler.Handle(ctx, req)
+	decision := AdmissionDecisionAllowed
+	if !resp.Allowed {
+		decision = AdmissionDecisionDenied
+	}
+	admissionDuration.WithLabelValues(h.Webhook, decision).Observe(time.Since(start).Seconds())
+	return resp
+}
+
+var (
+	descClusterResourceQuotaHard = prometheus.NewDesc(metricsNamespace+"_hard",
+		"Hard limit of a ClusterResourceQuota by resource.", []string{"clusterresourcequota", "resource"}, nil)
+	descClusterResourceQuotaUsed = prometheus.NewDesc(metricsNamespace+"_used",
+		"Usage of a ClusterResourceQuota by resource.", []string{"clusterresourcequota", "resource"}, nil)
+	descClusterResourceQuotaNamespaceUsed = prometheus.NewDesc(metricsNamespace+"_namespace_used",
+		"Usage of a ClusterResourceQuota in a namespace by resource.", []string{"clusterresourcequota", "namespace", "resource"}, nil)
+	descResourceQuotaHard = prometheus.NewDesc(metricsNamespace+"_resourcequota_hard",
+		"Hard limit of a ResourceQuota by resource.", []string{"namespace", "resourcequota", "resource"}, nil)
+	descResourceQuotaUsed = prometheus.NewDesc(metricsNamespace+"_resourcequota_used",
+		"Usage of a ResourceQuota by resource.", []string{"namespace", "resourcequota", "resource"}, nil)
+)
+
+// QuotaCollector collects the hard limits and usage of ClusterResourceQuotas and ResourceQuotas on scrape,
+// so the series of removed quotas disappear with them.
+type QuotaCollector struct {
+	Reader    client.Reader
+	Resources MetricsResourceFilter
+	// PerNamespace collects the usage of ClusterResourceQuotas per namespace and the ResourceQuotas
+	PerNamespace bool
+	// Elected is closed once this replica is elected, nothing is collected before,
+	// so the gauges are not duplicated by every replica. It's collected if nil.
+	Elected <-chan struct{}
+}
+
+var _ prometheus.Collector = &QuotaCollector{}
+
+func (c *QuotaCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descClusterResourceQuotaHard
+	ch <- descClusterResourceQuotaUsed
+	if c.PerNamespace {
+		ch <- descClusterResourceQuotaNamespaceUsed
+		ch <- descResourceQuotaHard
+		ch <- descResourceQuotaUsed
+	}
+}
+
+func (c *QuotaCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.Elected != nil {
+		select {
+		case <-c.Elected:
+		default:
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricsCollectTimeout)
+	defer cancel()
+
+	crqs := &quotav1.ClusterResourceQuotaList{}
+	if err := c.Reader.List(ctx, crqs); err != nil {
+		ch <- prometheus.NewInvalidMetric(descClusterResourceQuotaUsed, err)
+		return
+	}
+	for _, crq := range crqs.Items {
+		c.collectResources(ch, descClusterResourceQuotaHard, crq.Status.Hard, crq.Name)
+		c.collectResources(ch, descClusterResourceQuotaUsed, crq.Status.Used, crq.Name)
+		if c.PerNamespace {
+			for _, namespace := range crq.Status.Namespaces {
+				c.collectResources(ch, descClusterResourceQuotaNamespaceUsed, namespace.Used, crq.Name, namespace.Name)
+			}
+		}
+	}
+	if !c.PerNamespace {
+		return
+	}
+	rqs := &quotav1.ResourceQuotaList{}
+	if err := c.Reader.List(ctx, rqs); err != nil {
+		ch <- prometheus.NewInvalidMetric(descResourceQuotaUsed, err)
+		return
+	}
+	for _, rq := range rqs.Items {
+		c.collectResources(ch, descResourceQuotaHard, rq.Status.Hard, rq.Namespace, rq.Name)
+		c.collectResources(ch, descResourceQuotaUsed, rq.Status.Used, rq.Namespace, rq.Name)
+	}
+}
+
+// collectResources collects the selected resources, the resources not selected are left out rather than summed up,
+// as quantities of different resources can't be added.
+func (c *QuotaCollector) collectResources(ch chan<- prometheus.Metric, desc *prometheus.Desc, resources corev1.ResourceList, labels ...string) {
+	for resource, quantity := range resources {
+		if c.Resources.label(resource) == metricsOtherResource {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, quantity.AsApproximateFloat64(), append(labels, string(resource))...)
+	}
+}
@@ -0,0 +1,179 @@
+package clusterresourcequota_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	admv1 "k8s.io/api/admission/v1"
+	authnv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"xiaoshiai.cn/clusterresourcequota"
+	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+// gatheredValue returns the value of the metric of the given labels, or -1 if it's not gathered.
+func gatheredValue(t *testing.T, gatherer prometheus.Gatherer, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if !matchLabels(metric, labels) {
+				continue
+			}
+			switch {
+			case metric.GetGauge() != nil:
+				return metric.GetGauge().GetValue()
+			case metric.GetCounter() != nil:
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return -1
+}
+
+func matchLabels(metric *dto.Metric, labels map[string]string) bool {
+	matched := 0
+	for _, pair := range metric.GetLabel() {
+		if value, ok := labels[pair.GetName()]; ok {
+			if value != pair.GetValue() {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(labels)
+}
+
+func TestQuotaCollector(t *testing.T) {
+	scheme := clusterresourcequota.GetScheme()
+	crq := &thisquotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+		Status: thisquotav1.ClusterResourceQuotaStatus{
+			ResourceQuotaStatus: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("4"), corev1.ResourceRequestsMemory: resource.MustParse("8Gi")},
+				Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1500m")},
+			},
+			Namespaces: []thisquotav1.NamespaceResourceQuota{
+				{Name: "ns1", Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1500m")}},
+			},
+		},
+	}
+	rq := &thisquotav1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "rq", Namespace: "ns1"},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("2")},
+			Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1500m")},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(crq, rq).Build()
+
+	for _, tt := range []struct {
+		name    string
+		options clusterresourcequota.MetricsOptions
+		name2   string
+		labels  map[string]string
+		want    float64
+	}{
+		{name: "hard", options: clusterresourcequota.MetricsOptions{}, name2: "clusterresourcequota_hard",
+			labels: map[string]string{"clusterresourcequota": "crq", "resource": "requests.cpu"}, want: 4},
+		{name: "used", options: clusterresourcequota.MetricsOptions{}, name2: "clusterresourcequota_used",
+			labels: map[string]string{"clusterresourcequota": "crq", "resource": "requests.cpu"}, want: 1.5},
+		{name: "namespace used", options: clusterresourcequota.MetricsOptions{PerNamespace: true}, name2: "clusterresourcequota_namespace_used",
+			labels: map[string]string{"clusterresourcequota": "crq", "namespace": "ns1", "resource": "requests.cpu"}, want: 1.5},
+		{name: "resourcequota hard", options: clusterresourcequota.MetricsOptions{PerNamespace: true}, name2: "clusterresourcequota_resourcequota_hard",
+			labels: map[string]string{"namespace": "ns1", "resourcequota": "rq", "resource": "requests.cpu"}, want: 2},
+		{name: "per namespace disabled", options: clusterresourcequota.MetricsOptions{}, name2: "clusterresourcequota_namespace_used",
+			labels: map[string]string{"clusterresourcequota": "crq"}, want: -1},
+		{name: "resource not selected", options: clusterresourcequota.MetricsOptions{Resources: "requests.cpu"}, name2: "clusterresourcequota_hard",
+			labels: map[string]string{"resource": "requests.memory"}, want: -1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(&clusterresourcequota.QuotaCollector{
+				Reader:       cli,
+				Resources:    clusterresourcequota.NewMetricsResourceFilter(tt.options.Resources),
+				PerNamespace: tt.options.PerNamespace,
+			})
+			if got := gatheredValue(t, registry, tt.name2, tt.labels); got != tt.want {
+				t.Errorf("%s%v = %v, want %v", tt.name2, tt.labels, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaCollector_Elected(t *testing.T) {
+	scheme := clusterresourcequota.GetScheme()
+	crq := &thisquotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+		Status: thisquotav1.ClusterResourceQuotaStatus{
+			ResourceQuotaStatus: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("2")},
+			},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(crq).Build()
+	elected := make(chan struct{})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&clusterresourcequota.QuotaCollector{Reader: cli, Resources: clusterresourcequota.NewMetricsResourceFilter(""), Elected: elected})
+
+	labels := map[string]string{"clusterresourcequota": "crq", "resource": "requests.cpu"}
+	if got := gatheredValue(t, registry, "clusterresourcequota_hard", labels); got != -1 {
+		t.Errorf("clusterresourcequota_hard = %v before elected, want not collected", got)
+	}
+	close(elected)
+	if got := gatheredValue(t, registry, "clusterresourcequota_hard", labels); got != 2 {
+		t.Errorf("clusterresourcequota_hard = %v once elected, want 2", got)
+	}
+}
+
+func TestResourceQuotaStatusAdmission_Metrics(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+	crq := &thisquotav1.ClusterResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "metrics-crq"},
+		Status: thisquotav1.ClusterResourceQuotaStatus{
+			ResourceQuotaStatus: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")},
+			},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(crq).WithStatusSubresource(crq).Build()
+	handler := clusterresourcequota.NewResourceQuotaStatusAdmission(clusterresourcequota.NewResourceQuotaCache(), cli)
+	admit := func(used string) {
+		handler.Handle(ctx, admission.Request{AdmissionRequest: admv1.AdmissionRequest{
+			UID: types.UID("uid-" + used),
+			Object: toRawExtension(&thisquotav1.ResourceQuota{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "rq", Namespace: "ns1",
+					Labels: map[string]string{clusterresourcequota.LabelClusterResourceQuota: "metrics-crq"},
+				},
+				Status: corev1.ResourceQuotaStatus{Used: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(used)}},
+			}),
+			UserInfo: authnv1.UserInfo{Username: "system:apiserver"},
+		}})
+	}
+	admit("1")
+	admit("3")
+
+	for decision, reason := range map[string]string{"allowed": "within_quota", "denied": "exceeded"} {
+		labels := map[string]string{"clusterresourcequota": "metrics-crq", "resource": "cpu", "decision": decision, "reason": reason}
+		if got := gatheredValue(t, metrics.Registry, "clusterresourcequota_admissions_total", labels); got != 1 {
+			t.Errorf("admissions %v = %v, want 1", labels, got)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package clusterresourcequota
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// InformerStatus is the sync status of an informer started by a factory of the [ControllerContext].
+type InformerStatus struct {
+	Factory  string `json:"factory"`
+	Resource string `json:"resource"`
+	Synced   bool   `json:"synced"`
+}
+
+// InformerStatus returns the sync status of the informers started by the factories, it doesn't wait for them.
+func (c *ControllerContext) InformerStatus() []InformerStatus {
+	// the informers are checked exactly once as the channel is closed
+	checkOnce := make(chan struct{})
+	close(checkOnce)
+
+	status := []InformerStatus{}
+	addTyped := func(factory string, synced map[reflect.Type]bool) {
+		for typ, ok := range synced {
+			status = append(status, InformerStatus{Factory: factory, Resource: strings.TrimPrefix(typ.String(), "*"), Synced: ok})
+		}
+	}
+	addResource := func(factory string, synced map[schema.GroupVersionResource]bool) {
+		for gvr, ok := range synced {
+			status = append(status, InformerStatus{Factory: factory, Resource: gvr.String(), Synced: ok})
+		}
+	}
+	addTyped("kubernetes", c.InformerFactory.WaitForCacheSync(checkOnce))
+	addTyped("clusterresourcequota", c.ThisInformerFactory.WaitForCacheSync(checkOnce))
+	addTyped("hijacked", c.HijackedInformerFactory.WaitForCacheSync(checkOnce))
+	addResource("metadata", c.MetadataInformerFactory.WaitForCacheSync(checkOnce))
+	addResource("dynamic", c.DynamicInformerFactory.WaitForCacheSync(checkOnce))
+
+	slices.SortFunc(status, func(a, b InformerStatus) int {
+		return strings.Compare(a.Factory+"/"+a.Resource, b.Factory+"/"+b.Resource)
+	})
+	return status
+}
+
+// Synced is a readyz check passing after the informers of all factories have synced,
+// so the webhooks don't answer against empty listers.
+func (c *ControllerContext) Synced(_ *http.Request) error {
+	select {
+	case <-c.InformersStarted:
+	default:
+		return fmt.Errorf("informers not started")
+	}
+	var unsynced []string
+	for _, status := range c.InformerStatus() {
+		if !status.Synced {
+			unsynced = append(unsynced, status.Factory+"/"+status.Resource)
+		}
+	}
+	if len(unsynced) > 0 {
+		return fmt.Errorf("informers not synced: %s", strings.Join(unsynced, ", "))
+	}
+	return nil
+}
+
+// ServeHTTP serves the sync status of the informers, see [ControllerContext.InformerStatus].
+func (c *ControllerContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.InformerStatus()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,69 @@
+package clusterresourcequota_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"xiaoshiai.cn/clusterresourcequota"
+)
+
+func TestControllerContext_Synced(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	controllerContext := NewFakeControllerContext(ctx, []runtime.Object{
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "configmap", Namespace: "test"}},
+	}, []runtime.Object{})
+	controller, _, err := clusterresourcequota.NewResourceQuota(ctx, controllerContext, nil, clusterresourcequota.RoleAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := controllerContext.Synced(nil); err == nil {
+		t.Errorf("expected not ready before the informers start")
+	}
+	// the controller is not running, e.g. on the replicas not elected
+	if err := controller.Synced(nil); err != nil {
+		t.Errorf("expected ready while the controller is not running, got: %v", err)
+	}
+
+	go controllerContext.Start(ctx)
+	if err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 10*time.Second, true, func(ctx context.Context) (bool, error) {
+		return controllerContext.Synced(nil) == nil, nil
+	}); err != nil {
+		t.Fatalf("informers not synced: %v", controllerContext.Synced(nil))
+	}
+
+	hijacked := clusterresourcequota.HijackSharedInformerFactory{
+		SharedInformerFactory: controllerContext.InformerFactory,
+		This:                  controllerContext.HijackedInformerFactory,
+	}
+	for typ, synced := range hijacked.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			t.Errorf("informer of %v not synced", typ)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	controllerContext.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/informers", nil))
+	status := []clusterresourcequota.InformerStatus{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range status {
+		if s.Factory == "kubernetes" && s.Resource == "v1.ConfigMap" {
+			found = s.Synced
+		}
+	}
+	if !found {
+		t.Errorf("expected the synced configmap informer reported, got %v", status)
+	}
+}
@@ -87,7 +87,12 @@ func (a HijackResourceQuotaInterface) Patch(ctx context.Context, name string, pt
 }
 
 func (a HijackResourceQuotaInterface) Update(ctx context.Context, resourceQuota *corev1.ResourceQuota, opts metav1.UpdateOptions) (*corev1.ResourceQuota, error) {
-	return nil, errors.NewMethodNotSupported(corev1.Resource(corev1.ResourceQuotas.String()), "update")
+	crq := fromQuota(resourceQuota)
+	result, err := a.ResourceQuotaInterface.Update(ctx, crq, opts)
+	if err != nil {
+		return nil, err
+	}
+	return toQuota(result), nil
 }
 
 func (a HijackResourceQuotaInterface) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
@@ -149,7 +154,7 @@ func (a HijackSharedInformerFactory) Start(stopCh <-chan struct{}) {
 
 // WaitForCacheSync implements informers.SharedInformerFactory.
 func (a HijackSharedInformerFactory) WaitForCacheSync(stopCh <-chan struct{}) map[reflect.Type]bool {
-	var result map[reflect.Type]bool
+	result := map[reflect.Type]bool{}
 	maps.Copy(result, a.SharedInformerFactory.WaitForCacheSync(stopCh))
 	maps.Copy(result, a.This.WaitForCacheSync(stopCh))
 	return result
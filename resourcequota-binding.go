@@ -0,0 +1,89 @@
+package clusterresourcequota
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/admission"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+var _ quota.Evaluator = &PodBindingEvaluator{}
+
+// PodBindingEvaluator evaluates the pod bound to a node, it only matches the quotas which match the bound pod
+// but not the pod before it's bound, e.g. quotas of the Scheduled scope, or of a Topology domain not required by the pod.
+// Those quotas are charged when the pod is bound, the others have been charged when the pod was created.
+type PodBindingEvaluator struct {
+	quota.Evaluator
+}
+
+// Matches implements v1.Evaluator.
+func (e *PodBindingEvaluator) Matches(resourceQuota *corev1.ResourceQuota, item runtime.Object) (bool, error) {
+	pod, ok := item.(*corev1.Pod)
+	if !ok {
+		return false, nil
+	}
+	bound, err := e.Evaluator.Matches(resourceQuota, pod)
+	if err != nil || !bound {
+		return false, err
+	}
+	unbound, err := e.Evaluator.Matches(resourceQuota, UnboundPod(pod))
+	if err != nil {
+		return false, err
+	}
+	return !unbound, nil
+}
+
+// UnboundPod returns a copy of the pod before it's bound to a node.
+func UnboundPod(pod *corev1.Pod) *corev1.Pod {
+	unbound := pod.DeepCopy()
+	unbound.Spec.NodeName = ""
+	unbound.Status.Conditions = nil
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type != corev1.PodScheduled {
+			unbound.Status.Conditions = append(unbound.Status.Conditions, condition)
+		}
+	}
+	return unbound
+}
+
+// PodBindingAdmission admits the binding of pods to nodes, other requests are admitted by the embedded admission.
+// The bound pod is admitted as a created pod by Binding, whose pod evaluator is a [PodBindingEvaluator],
+// so quotas which only match bound pods reject the binding instead of only counting the pod after it's scheduled.
+type PodBindingAdmission struct {
+	admission.ValidationInterface
+	Binding admission.ValidationInterface
+	Pods    corev1client.PodsGetter
+}
+
+// Validate implements admission.ValidationInterface.
+func (a *PodBindingAdmission) Validate(ctx context.Context, attr admission.Attributes, o admission.ObjectInterfaces) error {
+	if attr.GetResource().GroupResource() != corev1.Resource("pods") || attr.GetSubresource() != "binding" {
+		return a.ValidationInterface.Validate(ctx, attr, o)
+	}
+	if attr.GetOperation() != admission.Create {
+		return nil
+	}
+	binding, ok := attr.GetObject().(*corev1.Binding)
+	if !ok {
+		return apierrors.NewBadRequest("resource was marked with kind Binding but was unable to be converted")
+	}
+	pod, err := a.Pods.Pods(attr.GetNamespace()).Get(ctx, attr.GetName(), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// the binding is rejected by the apiserver
+			return nil
+		}
+		return err
+	}
+	pod.Spec.NodeName = binding.Target.Name
+	bound := admission.NewAttributesRecord(pod, nil,
+		corev1.SchemeGroupVersion.WithKind("Pod"), pod.Namespace, pod.Name,
+		corev1.SchemeGroupVersion.WithResource("pods"), "",
+		admission.Create, &metav1.CreateOptions{}, attr.IsDryRun(), attr.GetUserInfo())
+	return a.Binding.Validate(ctx, bound, o)
+}
@@ -0,0 +1,140 @@
+package clusterresourcequota_test
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/admission"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"xiaoshiai.cn/clusterresourcequota"
+)
+
+// recordingValidation records the attributes it validates.
+type recordingValidation struct {
+	attrs []admission.Attributes
+}
+
+func (r *recordingValidation) Handles(admission.Operation) bool { return true }
+
+func (r *recordingValidation) Validate(_ context.Context, attr admission.Attributes, _ admission.ObjectInterfaces) error {
+	r.attrs = append(r.attrs, attr)
+	return nil
+}
+
+func TestPodBindingEvaluator_Matches(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{corev1.LabelTopologyZone: "zone-a"}}}
+	if err := informerFactory.Core().V1().Nodes().Informer().GetStore().Add(node); err != nil {
+		t.Fatal(err)
+	}
+	evaluator := &clusterresourcequota.PodBindingEvaluator{Evaluator: clusterresourcequota.NewConditionalPodEvaluator(informerFactory, nil)}
+
+	newQuota := func(requirements ...corev1.ScopedResourceSelectorRequirement) *corev1.ResourceQuota {
+		rq := &corev1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: "rq", Namespace: "test"},
+			Spec: corev1.ResourceQuotaSpec{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1")},
+			},
+			Status: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1")},
+			},
+		}
+		if len(requirements) > 0 {
+			rq.Spec.ScopeSelector = &corev1.ScopeSelector{MatchExpressions: requirements}
+		}
+		return rq
+	}
+	scheduled := corev1.ScopedResourceSelectorRequirement{
+		ScopeName: clusterresourcequota.ResourceQuotaScopeScheduled, Operator: corev1.ScopeSelectorOpExists,
+	}
+	unscheduled := corev1.ScopedResourceSelectorRequirement{
+		ScopeName: clusterresourcequota.ResourceQuotaScopeUnscheduled, Operator: corev1.ScopeSelectorOpExists,
+	}
+	zoneA := corev1.ScopedResourceSelectorRequirement{
+		ScopeName: clusterresourcequota.ResourceQuotaScopeTopology, Operator: corev1.ScopeSelectorOpIn,
+		Values: []string{corev1.LabelTopologyZone + "=zone-a"},
+	}
+	newBoundPod := func(nodeSelector map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "test"},
+			Spec: corev1.PodSpec{
+				NodeName:     node.Name,
+				NodeSelector: nodeSelector,
+				Containers: []corev1.Container{{
+					Name: "container",
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+					},
+				}},
+			},
+		}
+	}
+	tests := []struct {
+		name string
+		rq   *corev1.ResourceQuota
+		pod  *corev1.Pod
+		want bool
+	}{
+		{name: "charged on creation", rq: newQuota(), pod: newBoundPod(nil), want: false},
+		{name: "scheduled", rq: newQuota(scheduled), pod: newBoundPod(nil), want: true},
+		{name: "unscheduled", rq: newQuota(unscheduled), pod: newBoundPod(nil), want: false},
+		{name: "topology of bound node", rq: newQuota(zoneA), pod: newBoundPod(nil), want: true},
+		{
+			name: "topology required by pod",
+			rq:   newQuota(zoneA),
+			pod:  newBoundPod(map[string]string{corev1.LabelTopologyZone: "zone-a"}),
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evaluator.Matches(tt.rq, tt.pod)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodBindingAdmission(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "test"}}
+	clientset := fake.NewSimpleClientset(pod)
+	pods, binding := &recordingValidation{}, &recordingValidation{}
+	a := &clusterresourcequota.PodBindingAdmission{ValidationInterface: pods, Binding: binding, Pods: clientset.CoreV1()}
+
+	attr := admission.NewAttributesRecord(
+		&corev1.Binding{ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace}, Target: corev1.ObjectReference{Kind: "Node", Name: "node-1"}},
+		nil, corev1.SchemeGroupVersion.WithKind("Binding"), pod.Namespace, pod.Name,
+		corev1.SchemeGroupVersion.WithResource("pods"), "binding",
+		admission.Create, &metav1.CreateOptions{}, false, &user.DefaultInfo{Name: "system:kube-scheduler"})
+	if err := a.Validate(context.Background(), attr, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods.attrs) != 0 || len(binding.attrs) != 1 {
+		t.Fatalf("expected the binding admitted by the binding admission only, got %d and %d", len(pods.attrs), len(binding.attrs))
+	}
+	bound := binding.attrs[0]
+	if bound.GetOperation() != admission.Create || bound.GetSubresource() != "" {
+		t.Errorf("expected the creation of the bound pod, got %s of subresource %q", bound.GetOperation(), bound.GetSubresource())
+	}
+	if got := bound.GetObject().(*corev1.Pod).Spec.NodeName; got != "node-1" {
+		t.Errorf("expected the pod bound to node-1, got %q", got)
+	}
+
+	created := admission.NewAttributesRecord(pod, nil, corev1.SchemeGroupVersion.WithKind("Pod"), pod.Namespace, pod.Name,
+		corev1.SchemeGroupVersion.WithResource("pods"), "", admission.Create, &metav1.CreateOptions{}, false, &user.DefaultInfo{})
+	if err := a.Validate(context.Background(), created, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods.attrs) != 1 || len(binding.attrs) != 1 {
+		t.Errorf("expected the creation admitted by the embedded admission only, got %d and %d", len(pods.attrs), len(binding.attrs))
+	}
+}
@@ -0,0 +1,146 @@
+package clusterresourcequota
+
+import (
+	"cmp"
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/lru"
+)
+
+const (
+	// ResourceQuotaScopeCEL matches pods by CEL expressions evaluated against the pod,
+	// the pod is available as variable "object" in the expression.
+	ResourceQuotaScopeCEL corev1.ResourceQuotaScope = "CEL"
+
+	// CELCostLimit is the max runtime cost of evaluating a single CEL expression against a pod.
+	CELCostLimit = 100000
+	// celProgramCacheSize is the max number of compiled CEL programs kept in cache.
+	celProgramCacheSize = 1024
+)
+
+// DefaultCELProgramCache is shared by admission and the usage calculation,
+// so the same expression always evaluates through the same compiled program.
+var DefaultCELProgramCache = NewCELProgramCache(celProgramCacheSize)
+
+// CELProgramCache compiles CEL expressions and caches the compiled programs by expression.
+type CELProgramCache struct {
+	once    sync.Once
+	env     *cel.Env
+	envErr  error
+	entries *lru.Cache
+}
+
+func NewCELProgramCache(size int) *CELProgramCache {
+	return &CELProgramCache{entries: lru.New(size)}
+}
+
+func (c *CELProgramCache) environment() (*cel.Env, error) {
+	c.once.Do(func() {
+		c.env, c.envErr = cel.NewEnv(
+			cel.Variable("object", cel.DynType),
+			ext.Strings(),
+		)
+	})
+	return c.env, c.envErr
+}
+
+// Compile compiles the expression, the compiled program is cached for later use.
+func (c *CELProgramCache) Compile(expression string) (cel.Program, error) {
+	if val, ok := c.entries.Get(expression); ok {
+		return val.(cel.Program), nil
+	}
+	env, err := c.environment()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("compile CEL expression %q: %w", expression, issues.Err())
+	}
+	if outtype := ast.OutputType(); outtype != cel.BoolType && outtype != cel.DynType {
+		return nil, fmt.Errorf("CEL expression %q must evaluate to bool, got %v", expression, outtype)
+	}
+	program, err := env.Program(ast, cel.CostLimit(CELCostLimit))
+	if err != nil {
+		return nil, fmt.Errorf("create CEL program %q: %w", expression, err)
+	}
+	c.entries.Add(expression, program)
+	return program, nil
+}
+
+// Eval evaluates the expression against the object.
+func (c *CELProgramCache) Eval(expression string, object runtime.Object) (bool, error) {
+	program, err := c.Compile(expression)
+	if err != nil {
+		return false, err
+	}
+	return evalCELProgram(program, object)
+}
+
+func evalCELProgram(program cel.Program, object runtime.Object) (bool, error) {
+	unstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	if err != nil {
+		return false, err
+	}
+	val, _, err := program.Eval(map[string]any{"object": unstructured})
+	if err != nil {
+		return false, err
+	}
+	result, ok := val.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("evaluated to %v, expected bool", val.Type())
+	}
+	return result, nil
+}
+
+// ValidateCELScope checks the operator of a CEL scope selector and compiles its expressions.
+func ValidateCELScope(selector corev1.ScopedResourceSelectorRequirement) error {
+	if selector.Operator != corev1.ScopeSelectorOpIn && selector.Operator != corev1.ScopeSelectorOpNotIn {
+		return fmt.Errorf("unsupported operator %v for CEL scope", selector.Operator)
+	}
+	for _, expression := range selector.Values {
+		if _, err := DefaultCELProgramCache.Compile(expression); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PodCELMatch matches the pod against a CEL scope selector.
+// Operator In matches if any of the expressions evaluates to true, NotIn matches if none of them does.
+// If no expression evaluates to true and one fails to evaluate, e.g. accessing an absent field or exceeding [CELCostLimit],
+// the error is returned so the admission fails closed instead of matching the pod by mistake, use has() to test optional fields.
+func PodCELMatch(pod *corev1.Pod, selector corev1.ScopedResourceSelectorRequirement) (bool, error) {
+	if selector.Operator != corev1.ScopeSelectorOpIn && selector.Operator != corev1.ScopeSelectorOpNotIn {
+		return false, fmt.Errorf("unsupported operator %v for CEL scope", selector.Operator)
+	}
+	matched := false
+	var evalErr error
+	for _, expression := range selector.Values {
+		program, err := DefaultCELProgramCache.Compile(expression)
+		if err != nil {
+			return false, err
+		}
+		ok, err := evalCELProgram(program, pod)
+		if err != nil {
+			evalErr = cmp.Or(evalErr, fmt.Errorf("evaluate CEL expression %q on pod %s/%s: %w", expression, pod.Namespace, pod.Name, err))
+			continue
+		}
+		if ok {
+			matched = true
+			break
+		}
+	}
+	if !matched && evalErr != nil {
+		return false, evalErr
+	}
+	if selector.Operator == corev1.ScopeSelectorOpNotIn {
+		return !matched, nil
+	}
+	return matched, nil
+}
@@ -0,0 +1,70 @@
+package clusterresourcequota
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/kubernetes/pkg/apis/core/v1/helper"
+)
+
+// CostResource is a synthetic resource of pods priced from a price table, its usage is the hourly cost of the resources requested by pods,
+// e.g. "xiaoshiai.cn/cost" counts an A100 as 2.5 and 1Gi of memory as 0.005 per hour.
+// The usage is reported as "requests.<name>", which is the resource name to limit in quotas.
+type CostResource struct {
+	// Name is the name of the synthetic resource, it must be an extended resource name, e.g. "xiaoshiai.cn/cost"
+	Name corev1.ResourceName `json:"name"`
+	// Prices is the price table of requested resources,
+	// the first price matching both the resource and the node labels of the pod applies.
+	Prices []ResourcePrice `json:"prices"`
+}
+
+type ResourcePrice struct {
+	// Resource is the name of the resource requested by containers, e.g. "cpu", "memory" or "nvidia.com/gpu"
+	Resource corev1.ResourceName `json:"resource"`
+	// NodeSelector is a label selector matched against the node labels of the pod, e.g. "nvidia.com/gpu.product=A100".
+	// The node labels are resolved the same way as the Topology scope, an empty selector matches all pods.
+	NodeSelector string `json:"nodeSelector,omitempty"`
+	// Unit is the amount of the resource the price applies to, e.g. "1Gi" of memory, defaults to 1
+	Unit *resource.Quantity `json:"unit,omitempty"`
+	// Price is the hourly price of one unit of the resource
+	Price resource.Quantity `json:"price"`
+}
+
+// ValidateCostResources validates the names, node selectors and prices of cost resources.
+func ValidateCostResources(costResources []CostResource) error {
+	var errs []error
+	for _, cost := range costResources {
+		if !helper.IsExtendedResourceName(cost.Name) {
+			errs = append(errs, fmt.Errorf("cost resource %q must be an extended resource name", cost.Name))
+		}
+		for _, price := range cost.Prices {
+			if _, err := labels.Parse(price.NodeSelector); err != nil {
+				errs = append(errs, fmt.Errorf("cost resource %q: invalid node selector %q: %w", cost.Name, price.NodeSelector, err))
+			}
+			if price.Price.Sign() < 0 {
+				errs = append(errs, fmt.Errorf("cost resource %q: price of %q must not be negative", cost.Name, price.Resource))
+			}
+			if price.Unit != nil && price.Unit.Sign() <= 0 {
+				errs = append(errs, fmt.Errorf("cost resource %q: unit of %q must be positive", cost.Name, price.Resource))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// WeightedResource returns the weighted resource calculating the cost, each price is the weight of a unit of the resource.
+func (c CostResource) WeightedResource() WeightedResource {
+	weighted := WeightedResource{Name: c.Name, Weights: make([]ResourceWeight, 0, len(c.Prices))}
+	for _, price := range c.Prices {
+		weighted.Weights = append(weighted.Weights, ResourceWeight{
+			Resource:     price.Resource,
+			NodeSelector: price.NodeSelector,
+			Weight:       price.Price,
+			Unit:         price.Unit,
+		})
+	}
+	return weighted
+}
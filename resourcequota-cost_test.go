@@ -0,0 +1,153 @@
+package clusterresourcequota_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"xiaoshiai.cn/clusterresourcequota"
+	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+func TestConditionalPodEvaluator_CostResources(t *testing.T) {
+	config := `
+costResources:
+- name: xiaoshiai.cn/cost
+  prices:
+  - resource: nvidia.com/gpu
+    nodeSelector: nvidia.com/gpu.product=A100
+    price: "2.5"
+  - resource: nvidia.com/gpu
+    price: "0.5"
+  - resource: cpu
+    price: "0.04"
+  - resource: memory
+    unit: 1Gi
+    price: "0.005"
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rqConfig, err := clusterresourcequota.GetResourceQuotaConfig(t.Context(), path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	evaluator := clusterresourcequota.NewConditionalPodEvaluator(informerFactory, rqConfig.PodWeightedResources())
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-t4", Labels: map[string]string{"nvidia.com/gpu.product": "T4"}}}
+	if err := informerFactory.Core().V1().Nodes().Informer().GetStore().Add(node); err != nil {
+		t.Fatal(err)
+	}
+
+	newPod := func(nodeName string, nodeSelector map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "test"},
+			Spec: corev1.PodSpec{
+				NodeName:     nodeName,
+				NodeSelector: nodeSelector,
+				Containers: []corev1.Container{{
+					Name: "container",
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceCPU:    resource.MustParse("2"),
+							corev1.ResourceMemory: resource.MustParse("4Gi"),
+							"nvidia.com/gpu":      resource.MustParse("1"),
+						},
+						Limits: corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")},
+					},
+				}},
+			},
+		}
+	}
+	for _, tt := range []struct {
+		name string
+		pod  *corev1.Pod
+		want string
+	}{
+		{name: "A100", pod: newPod("", map[string]string{"nvidia.com/gpu.product": "A100"}), want: "2.6"},
+		{name: "other gpu", pod: newPod(node.Name, nil), want: "600m"},
+		{name: "unbound charges the highest price", pod: newPod("", nil), want: "2.6"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			usage, err := evaluator.Usage(tt.pod)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := usage["requests.xiaoshiai.cn/cost"]
+			if want := resource.MustParse(tt.want); got.Cmp(want) != 0 {
+				t.Errorf("hourly cost = %s, want %s", got.String(), tt.want)
+			}
+		})
+	}
+
+	if matched := evaluator.MatchingResources([]corev1.ResourceName{"requests.xiaoshiai.cn/cost"}); len(matched) != 1 {
+		t.Errorf("MatchingResources() = %v, want the cost resource", matched)
+	}
+
+	invalid := []clusterresourcequota.CostResource{{
+		Name:   "cost",
+		Prices: []clusterresourcequota.ResourcePrice{{Resource: corev1.ResourceCPU, Price: resource.MustParse("-1")}},
+	}}
+	if err := clusterresourcequota.ValidateCostResources(invalid); err == nil {
+		t.Errorf("expected error of invalid cost resource")
+	}
+}
+
+func TestAdmitCostResourceUnscheduled(t *testing.T) {
+	ctx := t.Context()
+	const cost = corev1.ResourceName("requests.xiaoshiai.cn/cost")
+	resourceQuota := &thisquotav1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "quota", Namespace: "test", ResourceVersion: "124"},
+		Spec:       corev1.ResourceQuotaSpec{Hard: corev1.ResourceList{cost: resource.MustParse("2")}},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{cost: resource.MustParse("2")},
+			Used: corev1.ResourceList{cost: resource.MustParse("0")},
+		},
+	}
+	// every price has a node selector, an unbound pod matches none of them
+	rqConfig := &clusterresourcequota.ResourceQuotaConfiguration{
+		CostResources: []clusterresourcequota.CostResource{{
+			Name: "xiaoshiai.cn/cost",
+			Prices: []clusterresourcequota.ResourcePrice{
+				{Resource: "nvidia.com/gpu", NodeSelector: "nvidia.com/gpu.product=A100", Price: resource.MustParse("2.5")},
+				{Resource: "nvidia.com/gpu", NodeSelector: "nvidia.com/gpu.product=T4", Price: resource.MustParse("0.5")},
+			},
+		}},
+	}
+	context := NewFakeControllerContext(ctx, []runtime.Object{}, []runtime.Object{resourceQuota})
+	_, admissionHandler, err := clusterresourcequota.NewResourceQuota(ctx, context, rqConfig, clusterresourcequota.RoleAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newGPUPod := func(nodeSelector map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "test"},
+			Spec: corev1.PodSpec{
+				NodeSelector: nodeSelector,
+				Containers: []corev1.Container{{
+					Name: "container",
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")},
+						Limits:   corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")},
+					},
+				}},
+			},
+		}
+	}
+
+	// the pod may run on an A100, it's charged 2.5 per hour over the cap of 2
+	if err := admissionHandler.Validate(ctx, createPodAttributes(newGPUPod(nil)), nil); !apierrors.IsForbidden(err) {
+		t.Fatalf("expected forbidden error, got: %v", err)
+	}
+	if err := admissionHandler.Validate(ctx, createPodAttributes(newGPUPod(map[string]string{"nvidia.com/gpu.product": "T4"})), nil); err != nil {
+		t.Fatalf("expected the pod selecting T4 nodes allowed, got: %v", err)
+	}
+}
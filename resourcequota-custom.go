@@ -0,0 +1,263 @@
+package clusterresourcequota
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apiserver/pkg/admission"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	"k8s.io/apiserver/pkg/quota/v1/generic"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// CustomEvaluator declares an evaluator of a resource, usually a custom resource,
+// whose usage is calculated from the fields of its objects.
+// Objects are also counted as "count/<resource>.<group>".
+type CustomEvaluator struct {
+	Group    string `json:"group,omitempty"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	// Usage is the list of resources charged for each object
+	Usage []CustomResourceUsage `json:"usage,omitempty"`
+}
+
+func (c CustomEvaluator) GroupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: c.Group, Version: c.Version, Resource: c.Resource}
+}
+
+type CustomResourceUsage struct {
+	// Name is the name of the resource charged, e.g. "requests.nvidia.com/gpu"
+	Name corev1.ResourceName `json:"name"`
+	// Expression is the product of factors separated by "*", a factor is either a JSONPath
+	// or a quantity, e.g. "{.spec.replicas} * {.spec.resources.requests.nvidia\.com/gpu}".
+	// Values of a JSONPath matching multiple fields are summed, e.g. "{.spec.containers[*].resources.requests.cpu}".
+	// A JSONPath may be followed by "|<quantity>", the default used if it matches no field, e.g. "{.spec.replicas}|1"
+	// for a field defaulted by the apiserver, otherwise the usage is zero if a JSONPath matches no field.
+	Expression string `json:"expression"`
+}
+
+// ValidateCustomEvaluators validates the resources and the usage expressions of custom evaluators.
+func ValidateCustomEvaluators(evaluators []CustomEvaluator) error {
+	var errs []error
+	seen := map[schema.GroupResource]bool{}
+	for _, evaluator := range evaluators {
+		gvr := evaluator.GroupVersionResource()
+		if gvr.Version == "" || gvr.Resource == "" {
+			errs = append(errs, fmt.Errorf("evaluator %v: version and resource are required", gvr))
+			continue
+		}
+		if seen[gvr.GroupResource()] {
+			errs = append(errs, fmt.Errorf("duplicate evaluator of %v", gvr.GroupResource()))
+		}
+		seen[gvr.GroupResource()] = true
+		for _, usage := range evaluator.Usage {
+			if _, err := EvaluateUsageExpression(usage.Expression, map[string]any{}); err != nil {
+				errs = append(errs, fmt.Errorf("evaluator %v: usage %q: %w", gvr.GroupResource(), usage.Name, err))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// EvaluateUsageExpression evaluates a [CustomResourceUsage.Expression] against the unstructured content of an object.
+func EvaluateUsageExpression(expression string, content map[string]any) (resource.Quantity, error) {
+	factors := splitUsageExpression(expression)
+	if len(factors) == 0 {
+		return resource.Quantity{}, fmt.Errorf("empty expression")
+	}
+	product := *resource.NewQuantity(1, resource.DecimalSI)
+	matched := true
+	for _, factor := range factors {
+		if !strings.HasPrefix(factor, "{") {
+			value, err := resource.ParseQuantity(factor)
+			if err != nil {
+				return resource.Quantity{}, fmt.Errorf("factor %q: %w", factor, err)
+			}
+			product = multiplyQuantities(product, value)
+			continue
+		}
+		template, defaulted, hasDefault := splitFactorDefault(factor)
+		var defaultValue resource.Quantity
+		if hasDefault {
+			value, err := resource.ParseQuantity(defaulted)
+			if err != nil {
+				return resource.Quantity{}, fmt.Errorf("factor %q: default: %w", factor, err)
+			}
+			defaultValue = value
+		}
+		// JSONPath is stateful during execution, a new one is used for each evaluation
+		path := jsonpath.New("usage").AllowMissingKeys(true)
+		if err := path.Parse(template); err != nil {
+			return resource.Quantity{}, fmt.Errorf("factor %q: %w", factor, err)
+		}
+		results, err := path.FindResults(content)
+		if err != nil {
+			return resource.Quantity{}, fmt.Errorf("factor %q: %w", factor, err)
+		}
+		sum, found := resource.Quantity{}, false
+		for _, result := range results {
+			for _, value := range result {
+				if !value.IsValid() || !value.CanInterface() || value.Interface() == nil {
+					continue
+				}
+				quantity, err := resource.ParseQuantity(fmt.Sprint(value.Interface()))
+				if err != nil {
+					return resource.Quantity{}, fmt.Errorf("factor %q: %w", factor, err)
+				}
+				sum.Add(quantity)
+				found = true
+			}
+		}
+		if !found {
+			if !hasDefault {
+				matched = false
+			}
+			sum = defaultValue
+		}
+		product = multiplyQuantities(product, sum)
+	}
+	if !matched {
+		return *resource.NewQuantity(0, resource.DecimalSI), nil
+	}
+	return product, nil
+}
+
+// splitUsageExpression splits the expression by "*" which are not in a JSONPath, e.g. "{.items[*]}".
+func splitUsageExpression(expression string) []string {
+	var factors []string
+	depth, start := 0, 0
+	for i, char := range expression {
+		switch char {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '*':
+			if depth == 0 {
+				factors = append(factors, strings.TrimSpace(expression[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if last := strings.TrimSpace(expression[start:]); last != "" || len(factors) != 0 {
+		factors = append(factors, last)
+	}
+	return factors
+}
+
+// splitFactorDefault splits a JSONPath factor into the JSONPath and the default after the last "|" which is not in it,
+// e.g. "{.spec.replicas}|1".
+func splitFactorDefault(factor string) (string, string, bool) {
+	depth := 0
+	for i, char := range factor {
+		switch char {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '|':
+			if depth == 0 {
+				return strings.TrimSpace(factor[:i]), strings.TrimSpace(factor[i+1:]), true
+			}
+		}
+	}
+	return factor, "", false
+}
+
+var _ quota.Evaluator = &CustomResourceEvaluator{}
+
+// NewCustomResourceEvaluator returns the evaluator declared by config,
+// f lists the objects of the resource when usage is recalculated.
+func NewCustomResourceEvaluator(config CustomEvaluator, f quota.ListerForResourceFunc) *CustomResourceEvaluator {
+	gvr := config.GroupVersionResource()
+	return &CustomResourceEvaluator{
+		config:              config,
+		objectCountName:     generic.ObjectCountQuotaResourceNameFor(gvr.GroupResource()),
+		listFuncByNamespace: generic.ListResourceUsingListerFunc(f, gvr),
+	}
+}
+
+type CustomResourceEvaluator struct {
+	config              CustomEvaluator
+	objectCountName     corev1.ResourceName
+	listFuncByNamespace generic.ListFuncByNamespace
+}
+
+// Constraints implements v1.Evaluator.
+func (e *CustomResourceEvaluator) Constraints(required []corev1.ResourceName, item runtime.Object) error {
+	return nil
+}
+
+// GroupResource implements v1.Evaluator.
+func (e *CustomResourceEvaluator) GroupResource() schema.GroupResource {
+	return e.config.GroupVersionResource().GroupResource()
+}
+
+// Handles implements v1.Evaluator.
+func (e *CustomResourceEvaluator) Handles(a admission.Attributes) bool {
+	if a.GetSubresource() != "" {
+		return false
+	}
+	op := a.GetOperation()
+	return op == admission.Create || op == admission.Update
+}
+
+// Matches implements v1.Evaluator.
+func (e *CustomResourceEvaluator) Matches(resourceQuota *corev1.ResourceQuota, item runtime.Object) (bool, error) {
+	return generic.Matches(resourceQuota, item, e.MatchingResources, generic.MatchesNoScopeFunc)
+}
+
+// MatchingScopes implements v1.Evaluator.
+func (e *CustomResourceEvaluator) MatchingScopes(item runtime.Object, scopes []corev1.ScopedResourceSelectorRequirement) ([]corev1.ScopedResourceSelectorRequirement, error) {
+	return []corev1.ScopedResourceSelectorRequirement{}, nil
+}
+
+// UncoveredQuotaScopes implements v1.Evaluator.
+func (e *CustomResourceEvaluator) UncoveredQuotaScopes(limitedScopes []corev1.ScopedResourceSelectorRequirement, matchedQuotaScopes []corev1.ScopedResourceSelectorRequirement) ([]corev1.ScopedResourceSelectorRequirement, error) {
+	return []corev1.ScopedResourceSelectorRequirement{}, nil
+}
+
+// MatchingResources implements v1.Evaluator.
+func (e *CustomResourceEvaluator) MatchingResources(input []corev1.ResourceName) []corev1.ResourceName {
+	result := []corev1.ResourceName{}
+	for _, item := range input {
+		if item == e.objectCountName || slices.ContainsFunc(e.config.Usage, func(usage CustomResourceUsage) bool { return usage.Name == item }) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Usage implements v1.Evaluator.
+func (e *CustomResourceEvaluator) Usage(item runtime.Object) (corev1.ResourceList, error) {
+	var content map[string]any
+	if u, ok := item.(runtime.Unstructured); ok {
+		content = u.UnstructuredContent()
+	} else {
+		converted, err := runtime.DefaultUnstructuredConverter.ToUnstructured(item)
+		if err != nil {
+			return nil, err
+		}
+		content = converted
+	}
+	result := corev1.ResourceList{e.objectCountName: *resource.NewQuantity(1, resource.DecimalSI)}
+	for _, usage := range e.config.Usage {
+		quantity, err := EvaluateUsageExpression(usage.Expression, content)
+		if err != nil {
+			return nil, fmt.Errorf("evaluate usage %q: %w", usage.Name, err)
+		}
+		result = quota.Add(result, corev1.ResourceList{usage.Name: quantity})
+	}
+	return result, nil
+}
+
+// UsageStats implements v1.Evaluator.
+func (e *CustomResourceEvaluator) UsageStats(options quota.UsageStatsOptions) (quota.UsageStats, error) {
+	return generic.CalculateUsageStats(options, e.listFuncByNamespace, generic.MatchesNoScopeFunc, e.Usage)
+}
@@ -0,0 +1,79 @@
+package clusterresourcequota_test
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"xiaoshiai.cn/clusterresourcequota"
+)
+
+func TestCustomResourceEvaluator_Usage(t *testing.T) {
+	config := clusterresourcequota.CustomEvaluator{
+		Group:    "serving.example.com",
+		Version:  "v1",
+		Resource: "inferenceservices",
+		Usage: []clusterresourcequota.CustomResourceUsage{
+			{Name: "requests.nvidia.com/gpu", Expression: `{.spec.replicas} * {.spec.containers[*].resources.requests.nvidia\.com/gpu}`},
+			{Name: "requests.memory", Expression: `{.spec.replicas} * {.spec.containers[*].resources.requests.memory}`},
+			{Name: "requests.cpu", Expression: `{.spec.replicas}|1 * 500m`},
+		},
+	}
+	if err := clusterresourcequota.ValidateCustomEvaluators([]clusterresourcequota.CustomEvaluator{config}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	evaluator := clusterresourcequota.NewCustomResourceEvaluator(config, nil)
+
+	obj := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "serving.example.com/v1",
+		"kind":       "InferenceService",
+		"metadata":   map[string]any{"name": "llm", "namespace": "test"},
+		"spec": map[string]any{
+			"replicas": int64(3),
+			"containers": []any{
+				map[string]any{"resources": map[string]any{"requests": map[string]any{"nvidia.com/gpu": int64(2), "memory": "1Gi"}}},
+				map[string]any{"resources": map[string]any{"requests": map[string]any{"memory": "512Mi"}}},
+			},
+		},
+	}}
+	usage, err := evaluator.Usage(obj)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, want := range map[corev1.ResourceName]string{
+		"count/inferenceservices.serving.example.com": "1",
+		"requests.nvidia.com/gpu":                     "6",
+		"requests.memory":                             "4608Mi",
+		"requests.cpu":                                "1500m",
+	} {
+		got := usage[name]
+		if got.Cmp(resource.MustParse(want)) != 0 {
+			t.Errorf("%s = %s, want %s", name, got.String(), want)
+		}
+	}
+
+	// a missing field charges nothing
+	unstructured.RemoveNestedField(obj.Object, "spec", "replicas")
+	usage, err = evaluator.Usage(obj)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gpu := usage["requests.nvidia.com/gpu"]; !gpu.IsZero() {
+		t.Errorf("requests.nvidia.com/gpu = %s, want 0", gpu.String())
+	}
+	// unless the factor has a default
+	if cpu := usage["requests.cpu"]; cpu.Cmp(resource.MustParse("500m")) != 0 {
+		t.Errorf("requests.cpu = %s, want 500m", cpu.String())
+	}
+
+	invalid := config
+	invalid.Usage = []clusterresourcequota.CustomResourceUsage{{Name: "requests.cpu", Expression: "{.spec.replicas * abc"}}
+	if err := clusterresourcequota.ValidateCustomEvaluators([]clusterresourcequota.CustomEvaluator{invalid}); err == nil {
+		t.Errorf("expected invalid expression error")
+	}
+	invalid.Usage = []clusterresourcequota.CustomResourceUsage{{Name: "requests.cpu", Expression: "{.spec.replicas}|abc * 500m"}}
+	if err := clusterresourcequota.ValidateCustomEvaluators([]clusterresourcequota.CustomEvaluator{invalid}); err == nil {
+		t.Errorf("expected invalid default error")
+	}
+}
@@ -2,25 +2,48 @@ package clusterresourcequota
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apiserver/pkg/admission"
 	quota "k8s.io/apiserver/pkg/quota/v1"
 	"k8s.io/apiserver/pkg/quota/v1/generic"
 	"k8s.io/client-go/informers"
+	listerappsv1 "k8s.io/client-go/listers/apps/v1"
 	listercorev1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/kubernetes/pkg/quota/v1/evaluator/core"
 	"k8s.io/utils/clock"
 )
 
-const ResourceQuotaScopeNodeSelector corev1.ResourceQuotaScope = "NodeSelector"
+const (
+	ResourceQuotaScopeNodeSelector corev1.ResourceQuotaScope = "NodeSelector"
+	// ResourceQuotaScopeOwnerKind matches pods by the kind of the workload controlling them,
+	// values are kinds in the form of "Kind.group", e.g. "Deployment.apps", "Job.batch".
+	ResourceQuotaScopeOwnerKind corev1.ResourceQuotaScope = "OwnerKind"
+	// ResourceQuotaScopeScheduled matches pods which have been bound to a node.
+	ResourceQuotaScopeScheduled corev1.ResourceQuotaScope = "Scheduled"
+	// ResourceQuotaScopeUnscheduled matches pods which have not been bound to a node yet.
+	ResourceQuotaScopeUnscheduled corev1.ResourceQuotaScope = "Unscheduled"
+	// ResourceQuotaScopeTopology matches pods by the labels of the node they run on or will run on,
+	// values are label selectors, e.g. "topology.kubernetes.io/zone=zone-a".
+	ResourceQuotaScopeTopology corev1.ResourceQuotaScope = "Topology"
+	// ResourceQuotaScopeQueue matches pods by the ClusterResourceQuota queuing them, values are names of ClusterResourceQuotas.
+	// The ResourceQuotas of a ClusterResourceQuota with queueing exclude the pods of its queue by it.
+	ResourceQuotaScopeQueue corev1.ResourceQuotaScope = "Queue"
+)
 
 var _ quota.Evaluator = &ConditionalPodEvaluator{}
 
-func NewConditionalPodEvaluator(informers informers.SharedInformerFactory) quota.Evaluator {
+// NewConditionalPodEvaluator returns the pod evaluator which supports the scopes of this project,
+// the usage of weightedResources is calculated in addition to the usage of pods.
+func NewConditionalPodEvaluator(informers informers.SharedInformerFactory, weightedResources []WeightedResource) quota.Evaluator {
 	// listerFuncForResource only used when [quota.Evaluator.UsageStats] called.
 	// it's ok to pass nil if UsageStats is not used.
 	var listerFuncForResource quota.ListerForResourceFunc
@@ -31,6 +54,8 @@ func NewConditionalPodEvaluator(informers informers.SharedInformerFactory) quota
 		Evaluator:           core.NewPodEvaluator(listerFuncForResource, clock.RealClock{}),
 		listFuncByNamespace: generic.ListResourceUsingListerFunc(listerFuncForResource, corev1.SchemeGroupVersion.WithResource("pods")),
 		nodesLister:         informers.Core().V1().Nodes().Lister(),
+		replicaSetsLister:   informers.Apps().V1().ReplicaSets().Lister(),
+		weightedResources:   weightedResources,
 	}
 }
 
@@ -38,6 +63,8 @@ type ConditionalPodEvaluator struct {
 	Evaluator           quota.Evaluator
 	listFuncByNamespace generic.ListFuncByNamespace
 	nodesLister         listercorev1.NodeLister
+	replicaSetsLister   listerappsv1.ReplicaSetLister
+	weightedResources   []WeightedResource
 }
 
 // Constraints implements v1.Evaluator.
@@ -57,7 +84,14 @@ func (c *ConditionalPodEvaluator) Handles(a admission.Attributes) bool {
 
 // MatchingResources implements v1.Evaluator.
 func (c *ConditionalPodEvaluator) MatchingResources(input []corev1.ResourceName) []corev1.ResourceName {
-	return c.Evaluator.MatchingResources(input)
+	result := c.Evaluator.MatchingResources(input)
+	for _, weighted := range c.weightedResources {
+		name := corev1.ResourceName(corev1.DefaultResourceRequestsPrefix + weighted.Name)
+		if slices.Contains(input, name) && !slices.Contains(result, name) {
+			result = append(result, name)
+		}
+	}
+	return result
 }
 
 // MatchingScopes implements v1.Evaluator.
@@ -68,7 +102,7 @@ func (c *ConditionalPodEvaluator) MatchingScopes(item runtime.Object, scopes []c
 	}
 	// add this evaluator specific scopes
 	for _, selector := range scopes {
-		match, err := ConditionalPodMatchesScopeFunc(selector, item)
+		match, err := c.MatchesScope(selector, item)
 		if err != nil {
 			return []corev1.ScopedResourceSelectorRequirement{}, fmt.Errorf("error on matching scope %v: %v", selector, err)
 		}
@@ -86,12 +120,25 @@ func (c *ConditionalPodEvaluator) UncoveredQuotaScopes(limitedScopes []corev1.Sc
 
 // Usage implements v1.Evaluator.
 func (c *ConditionalPodEvaluator) Usage(item runtime.Object) (corev1.ResourceList, error) {
-	return c.Evaluator.Usage(item)
+	usage, err := c.Evaluator.Usage(item)
+	if err != nil || len(c.weightedResources) == 0 {
+		return usage, err
+	}
+	pod, ok := item.(*corev1.Pod)
+	if !ok {
+		return usage, nil
+	}
+	nodeLabels, bound := c.podNodeLabels(pod)
+	weighted, err := WeightedUsage(c.weightedResources, usage, nodeLabels, bound)
+	if err != nil {
+		return nil, err
+	}
+	return quota.Add(usage, weighted), nil
 }
 
 // Matches implements v1.Evaluator.
 func (c *ConditionalPodEvaluator) Matches(resourceQuota *corev1.ResourceQuota, item runtime.Object) (bool, error) {
-	ok, err := generic.Matches(resourceQuota, item, c.Evaluator.MatchingResources, ConditionalPodMatchesScopeFunc)
+	ok, err := generic.Matches(resourceQuota, item, c.Evaluator.MatchingResources, c.MatchesScope)
 	if err != nil {
 		return false, err
 	}
@@ -104,7 +151,7 @@ func (c *ConditionalPodEvaluator) Matches(resourceQuota *corev1.ResourceQuota, i
 
 // UsageStats calculates aggregate usage for the object.
 func (c *ConditionalPodEvaluator) UsageStats(options quota.UsageStatsOptions) (quota.UsageStats, error) {
-	usage, err := generic.CalculateUsageStats(options, c.listFuncByNamespace, ConditionalPodMatchesScopeFunc, c.Usage)
+	usage, err := generic.CalculateUsageStats(options, c.listFuncByNamespace, c.MatchesScope, c.Usage)
 	if err != nil {
 		return quota.UsageStats{}, err
 	}
@@ -115,20 +162,118 @@ func (c *ConditionalPodEvaluator) UsageStats(options quota.UsageStatsOptions) (q
 	return c.Evaluator.UsageStats(options)
 }
 
+// MatchesScope is the [generic.MatchesScopeFunc] of this evaluator.
+// In addition to [ConditionalPodMatchesScopeFunc], it handles the scopes which need to look up other objects.
+func (c *ConditionalPodEvaluator) MatchesScope(selector corev1.ScopedResourceSelectorRequirement, object runtime.Object) (bool, error) {
+	pod, ok := object.(*corev1.Pod)
+	if !ok {
+		return false, nil
+	}
+	switch selector.ScopeName {
+	case ResourceQuotaScopeOwnerKind:
+		return PodOwnerKindMatch(c.PodOwnerKind(pod), selector)
+	case ResourceQuotaScopeTopology:
+		return NodeLabelsMatch(c.PodNodeLabels(pod), selector)
+	}
+	return ConditionalPodMatchesScopeFunc(selector, object)
+}
+
+// PodNodeLabels returns the labels of the node the pod runs on.
+// For a pod not bound yet, or bound to a node not observed yet, it returns the labels resolved by [PodRequiredNodeLabels].
+func (c *ConditionalPodEvaluator) PodNodeLabels(pod *corev1.Pod) labels.Set {
+	nodeLabels, _ := c.podNodeLabels(pod)
+	return nodeLabels
+}
+
+// podNodeLabels returns the node labels of the pod, and true if they are the labels of the node the pod is bound to.
+func (c *ConditionalPodEvaluator) podNodeLabels(pod *corev1.Pod) (labels.Set, bool) {
+	if pod.Spec.NodeName != "" && c.nodesLister != nil {
+		if node, err := c.nodesLister.Get(pod.Spec.NodeName); err == nil {
+			return node.Labels, true
+		}
+	}
+	return PodRequiredNodeLabels(pod), false
+}
+
+// PodOwnerKind returns the group kind of the workload which controls the pod.
+// Pods controlled by a ReplicaSet resolve to the Deployment controlling that ReplicaSet.
+// It returns an empty group kind if the pod has no controller.
+func (c *ConditionalPodEvaluator) PodOwnerKind(pod *corev1.Pod) schema.GroupKind {
+	owner := metav1.GetControllerOfNoCopy(pod)
+	if owner == nil {
+		return schema.GroupKind{}
+	}
+	gk := schema.FromAPIVersionAndKind(owner.APIVersion, owner.Kind).GroupKind()
+	if gk != appsv1.SchemeGroupVersion.WithKind("ReplicaSet").GroupKind() || c.replicaSetsLister == nil {
+		return gk
+	}
+	// the ReplicaSet may not be observed yet, count the pod as owned by the ReplicaSet in that case
+	rs, err := c.replicaSetsLister.ReplicaSets(pod.Namespace).Get(owner.Name)
+	if err != nil || rs.UID != owner.UID {
+		return gk
+	}
+	if rsowner := metav1.GetControllerOfNoCopy(rs); rsowner != nil {
+		return schema.FromAPIVersionAndKind(rsowner.APIVersion, rsowner.Kind).GroupKind()
+	}
+	return gk
+}
+
 func ConditionalPodMatchesScopeFunc(selector corev1.ScopedResourceSelectorRequirement, object runtime.Object) (bool, error) {
 	pod, ok := object.(*corev1.Pod)
 	if !ok {
 		return false, nil
 	}
-	if selector.ScopeName == ResourceQuotaScopeNodeSelector {
+	switch selector.ScopeName {
+	case ResourceQuotaScopeNodeSelector:
 		return PodNodeSelectorMatch(pod, selector)
+	case ResourceQuotaScopeCEL:
+		return PodCELMatch(pod, selector)
+	case ResourceQuotaScopeScheduled:
+		return PodScheduledMatch(pod, selector, true)
+	case ResourceQuotaScopeUnscheduled:
+		return PodScheduledMatch(pod, selector, false)
+	case ResourceQuotaScopeQueue:
+		return PodQueueMatch(pod, selector)
 	}
 	return false, nil
 }
 
+// ValidateScopeSelector validates the requirements of the scopes provided by this project in the scope selector.
+func ValidateScopeSelector(scopeSelector *corev1.ScopeSelector) error {
+	if scopeSelector == nil {
+		return nil
+	}
+	var errs []error
+	for _, requirement := range scopeSelector.MatchExpressions {
+		switch requirement.ScopeName {
+		case ResourceQuotaScopeNodeSelector, ResourceQuotaScopeOwnerKind, ResourceQuotaScopeCEL,
+			ResourceQuotaScopeScheduled, ResourceQuotaScopeUnscheduled, ResourceQuotaScopeTopology, ResourceQuotaScopeQueue:
+			if requirement.ScopeName == ResourceQuotaScopeCEL && len(requirement.Values) == 0 {
+				errs = append(errs, fmt.Errorf("CEL scope requires at least one expression"))
+				continue
+			}
+			if requirement.ScopeName == ResourceQuotaScopeCEL {
+				// expressions may fail on an empty pod, they are only compiled
+				if err := ValidateCELScope(requirement); err != nil {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			// evaluate against an empty pod to check operator and values
+			if _, err := (&ConditionalPodEvaluator{}).MatchesScope(requirement, &corev1.Pod{}); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
 func PodNodeSelectorMatch(pod *corev1.Pod, selector corev1.ScopedResourceSelectorRequirement) (bool, error) {
-	nodeSelector := pod.Spec.NodeSelector
+	return NodeLabelsMatch(pod.Spec.NodeSelector, selector)
+}
 
+// NodeLabelsMatch matches node labels against a scope selector whose values are label selectors.
+func NodeLabelsMatch(nodeLabels labels.Set, selector corev1.ScopedResourceSelectorRequirement) (bool, error) {
 	switch selector.Operator {
 	case corev1.ScopeSelectorOpIn:
 		for _, value := range selector.Values {
@@ -136,7 +281,7 @@ func PodNodeSelectorMatch(pod *corev1.Pod, selector corev1.ScopedResourceSelecto
 			if err != nil {
 				return false, err
 			}
-			if selector.Matches(labels.Set(nodeSelector)) {
+			if selector.Matches(nodeLabels) {
 				return true, nil
 			}
 		}
@@ -147,16 +292,123 @@ func PodNodeSelectorMatch(pod *corev1.Pod, selector corev1.ScopedResourceSelecto
 			if err != nil {
 				return false, err
 			}
-			if selector.Matches(labels.Set(nodeSelector)) {
+			if selector.Matches(nodeLabels) {
 				return false, nil
 			}
 		}
 		return true, nil
 	case corev1.ScopeSelectorOpExists:
-		return len(nodeSelector) != 0, nil
+		return len(nodeLabels) != 0, nil
+	case corev1.ScopeSelectorOpDoesNotExist:
+		return len(nodeLabels) == 0, nil
+	default:
+		return false, fmt.Errorf("unsupported operator %v for %s scope", selector.Operator, selector.ScopeName)
+	}
+}
+
+// PodRequiredNodeLabels returns the node labels which the pod requires before it is scheduled,
+// they are the node selector of the pod and the single valued In requirements of its required node affinity.
+// Node selector terms are ORed, so only the requirements shared by all terms are returned.
+func PodRequiredNodeLabels(pod *corev1.Pod) labels.Set {
+	nodeLabels := labels.Set{}
+	maps.Copy(nodeLabels, pod.Spec.NodeSelector)
+	affinity := pod.Spec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return nodeLabels
+	}
+	var required labels.Set
+	for i, term := range affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		termLabels := labels.Set{}
+		for _, expr := range term.MatchExpressions {
+			if expr.Operator == corev1.NodeSelectorOpIn && len(expr.Values) == 1 {
+				termLabels[expr.Key] = expr.Values[0]
+			}
+		}
+		if i == 0 {
+			required = termLabels
+			continue
+		}
+		maps.DeleteFunc(required, func(key, value string) bool {
+			return termLabels[key] != value
+		})
+	}
+	for key, value := range required {
+		if _, ok := nodeLabels[key]; !ok {
+			nodeLabels[key] = value
+		}
+	}
+	return nodeLabels
+}
+
+// PodOwnerKindMatch matches the owner kind of a pod against an OwnerKind scope selector.
+// A value without group, e.g. "Deployment", matches the kind in any group.
+func PodOwnerKindMatch(ownerKind schema.GroupKind, selector corev1.ScopedResourceSelectorRequirement) (bool, error) {
+	switch selector.Operator {
+	case corev1.ScopeSelectorOpIn:
+		return ownerKindIn(ownerKind, selector.Values), nil
+	case corev1.ScopeSelectorOpNotIn:
+		return !ownerKindIn(ownerKind, selector.Values), nil
+	case corev1.ScopeSelectorOpExists:
+		return !ownerKind.Empty(), nil
+	case corev1.ScopeSelectorOpDoesNotExist:
+		return ownerKind.Empty(), nil
+	default:
+		return false, fmt.Errorf("unsupported operator %v for OwnerKind scope", selector.Operator)
+	}
+}
+
+func ownerKindIn(ownerKind schema.GroupKind, values []string) bool {
+	if ownerKind.Empty() {
+		return false
+	}
+	for _, value := range values {
+		gk := schema.ParseGroupKind(value)
+		if gk.Kind == ownerKind.Kind && (gk.Group == "" || gk.Group == ownerKind.Group) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPodScheduled returns true if the pod has been bound to a node.
+func IsPodScheduled(pod *corev1.Pod) bool {
+	if pod.Spec.NodeName != "" {
+		return true
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// PodScheduledMatch matches the pod against a Scheduled or Unscheduled scope selector,
+// scheduled is true for the Scheduled scope.
+func PodScheduledMatch(pod *corev1.Pod, selector corev1.ScopedResourceSelectorRequirement, scheduled bool) (bool, error) {
+	switch selector.Operator {
+	case corev1.ScopeSelectorOpExists:
+		return IsPodScheduled(pod) == scheduled, nil
+	case corev1.ScopeSelectorOpDoesNotExist:
+		return IsPodScheduled(pod) != scheduled, nil
+	default:
+		return false, fmt.Errorf("unsupported operator %v for %s scope", selector.Operator, selector.ScopeName)
+	}
+}
+
+// PodQueueMatch matches the ClusterResourceQuota queuing the pod against a Queue scope selector.
+func PodQueueMatch(pod *corev1.Pod, selector corev1.ScopedResourceSelectorRequirement) (bool, error) {
+	queue := PodQueue(pod)
+	switch selector.Operator {
+	case corev1.ScopeSelectorOpIn:
+		return queue != "" && slices.Contains(selector.Values, queue), nil
+	case corev1.ScopeSelectorOpNotIn:
+		return queue == "" || !slices.Contains(selector.Values, queue), nil
+	case corev1.ScopeSelectorOpExists:
+		return queue != "", nil
 	case corev1.ScopeSelectorOpDoesNotExist:
-		return len(nodeSelector) == 0, nil
+		return queue == "", nil
 	default:
-		return false, fmt.Errorf("unsupported operator %v for NodeSelector scope", selector.Operator)
+		return false, fmt.Errorf("unsupported operator %v for %s scope", selector.Operator, selector.ScopeName)
 	}
 }
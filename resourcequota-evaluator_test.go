@@ -0,0 +1,432 @@
+package clusterresourcequota_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+	"xiaoshiai.cn/clusterresourcequota"
+)
+
+func TestConditionalPodEvaluator_OwnerKind(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	evaluator := clusterresourcequota.NewConditionalPodEvaluator(informerFactory, nil)
+
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test", UID: types.UID("deployment")}}
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-5d8f9",
+			Namespace:       "test",
+			UID:             types.UID("replicaset"),
+			OwnerReferences: []metav1.OwnerReference{controllerRef(deployment, "Deployment")},
+		},
+	}
+	if err := informerFactory.Apps().V1().ReplicaSets().Informer().GetStore().Add(rs); err != nil {
+		t.Fatal(err)
+	}
+	daemonset := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "test", UID: types.UID("daemonset")}}
+
+	newPod := func(owners ...metav1.OwnerReference) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "test", OwnerReferences: owners},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name: "container",
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+					},
+				}},
+			},
+		}
+	}
+	newQuota := func(operator corev1.ScopeSelectorOperator, values ...string) *corev1.ResourceQuota {
+		return &corev1.ResourceQuota{
+			Spec: corev1.ResourceQuotaSpec{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("10")},
+				ScopeSelector: &corev1.ScopeSelector{
+					MatchExpressions: []corev1.ScopedResourceSelectorRequirement{
+						{ScopeName: clusterresourcequota.ResourceQuotaScopeOwnerKind, Operator: operator, Values: values},
+					},
+				},
+			},
+			Status: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("10")},
+			},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		quota *corev1.ResourceQuota
+		pod   *corev1.Pod
+		want  bool
+	}{
+		{
+			name:  "replicaset pod resolves to deployment",
+			quota: newQuota(corev1.ScopeSelectorOpIn, "Deployment.apps", "StatefulSet.apps"),
+			pod:   newPod(controllerRef(rs, "ReplicaSet")),
+			want:  true,
+		},
+		{
+			name:  "kind without group",
+			quota: newQuota(corev1.ScopeSelectorOpIn, "Deployment"),
+			pod:   newPod(controllerRef(rs, "ReplicaSet")),
+			want:  true,
+		},
+		{
+			name:  "unknown replicaset stays replicaset",
+			quota: newQuota(corev1.ScopeSelectorOpIn, "ReplicaSet.apps"),
+			pod:   newPod(controllerRef(&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "bare", UID: types.UID("bare")}}, "ReplicaSet")),
+			want:  true,
+		},
+		{
+			name:  "daemonset pods excluded",
+			quota: newQuota(corev1.ScopeSelectorOpNotIn, "DaemonSet.apps"),
+			pod:   newPod(controllerRef(daemonset, "DaemonSet")),
+			want:  false,
+		},
+		{
+			name:  "pod without controller",
+			quota: newQuota(corev1.ScopeSelectorOpDoesNotExist),
+			pod:   newPod(),
+			want:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evaluator.Matches(tt.quota, tt.pod)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func controllerRef(obj metav1.Object, kind string) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: appsv1.SchemeGroupVersion.String(),
+		Kind:       kind,
+		Name:       obj.GetName(),
+		UID:        obj.GetUID(),
+		Controller: ptr.To(true),
+	}
+}
+
+func TestConditionalPodEvaluator_CEL(t *testing.T) {
+	evaluator := clusterresourcequota.NewConditionalPodEvaluator(informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0), nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "test"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "registry.internal/team/app:v1"}},
+		},
+	}
+	tests := []struct {
+		name     string
+		operator corev1.ScopeSelectorOperator
+		values   []string
+		want     bool
+		wantErr  bool
+	}{
+		{
+			name:     "image prefix",
+			operator: corev1.ScopeSelectorOpIn,
+			values:   []string{`object.spec.containers.exists(c, c.image.startsWith("registry.internal/"))`},
+			want:     true,
+		},
+		{
+			name:     "not in",
+			operator: corev1.ScopeSelectorOpNotIn,
+			values:   []string{`object.spec.containers.exists(c, c.image.startsWith("registry.internal/"))`},
+			want:     false,
+		},
+		{
+			name:     "has absent field",
+			operator: corev1.ScopeSelectorOpIn,
+			values:   []string{`has(object.spec.nodeSelector) && object.spec.nodeSelector["zone"] == "a"`},
+			want:     false,
+		},
+		{
+			name:     "absent field fails",
+			operator: corev1.ScopeSelectorOpIn,
+			values:   []string{`object.spec.nodeSelector["zone"] == "a"`, `has(object.spec.nodeSelector)`},
+			wantErr:  true,
+		},
+		{
+			name:     "absent field fails not in",
+			operator: corev1.ScopeSelectorOpNotIn,
+			values:   []string{`object.spec.nodeSelector["zone"] == "a"`},
+			wantErr:  true,
+		},
+		{
+			name:     "absent field ignored once another matches",
+			operator: corev1.ScopeSelectorOpIn,
+			values:   []string{`object.spec.nodeSelector["zone"] == "a"`, `object.metadata.name == "pod"`},
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector := corev1.ScopedResourceSelectorRequirement{ScopeName: clusterresourcequota.ResourceQuotaScopeCEL, Operator: tt.operator, Values: tt.values}
+			got, err := evaluator.MatchingScopes(pod, []corev1.ScopedResourceSelectorRequirement{selector})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MatchingScopes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (len(got) == 1) != tt.want {
+				t.Errorf("MatchingScopes() = %v, want matched %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateScopeSelector(t *testing.T) {
+	tests := []struct {
+		name      string
+		selector  corev1.ScopedResourceSelectorRequirement
+		wantError bool
+	}{
+		{
+			name:     "valid CEL",
+			selector: corev1.ScopedResourceSelectorRequirement{ScopeName: clusterresourcequota.ResourceQuotaScopeCEL, Operator: corev1.ScopeSelectorOpIn, Values: []string{`object.metadata.name == "a"`}},
+		},
+		{
+			name:      "CEL compile error",
+			selector:  corev1.ScopedResourceSelectorRequirement{ScopeName: clusterresourcequota.ResourceQuotaScopeCEL, Operator: corev1.ScopeSelectorOpIn, Values: []string{`object.metadata.name ==`}},
+			wantError: true,
+		},
+		{
+			name:      "CEL non bool",
+			selector:  corev1.ScopedResourceSelectorRequirement{ScopeName: clusterresourcequota.ResourceQuotaScopeCEL, Operator: corev1.ScopeSelectorOpIn, Values: []string{`"a"`}},
+			wantError: true,
+		},
+		{
+			name:      "CEL unsupported operator",
+			selector:  corev1.ScopedResourceSelectorRequirement{ScopeName: clusterresourcequota.ResourceQuotaScopeCEL, Operator: corev1.ScopeSelectorOpExists},
+			wantError: true,
+		},
+		{
+			name:      "invalid node selector",
+			selector:  corev1.ScopedResourceSelectorRequirement{ScopeName: clusterresourcequota.ResourceQuotaScopeNodeSelector, Operator: corev1.ScopeSelectorOpIn, Values: []string{"a=b=c"}},
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := clusterresourcequota.ValidateScopeSelector(&corev1.ScopeSelector{MatchExpressions: []corev1.ScopedResourceSelectorRequirement{tt.selector}})
+			if (err != nil) != tt.wantError {
+				t.Errorf("ValidateScopeSelector() error = %v, wantError %v", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestConditionalPodEvaluator_Scheduled(t *testing.T) {
+	pending := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pending", Namespace: "test"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "container",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+				},
+			}},
+		},
+	}
+	bound := pending.DeepCopy()
+	bound.Name = "bound"
+	bound.Spec.NodeName = "node-1"
+
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(pending, bound), 0)
+	evaluator := clusterresourcequota.NewConditionalPodEvaluator(informerFactory, nil)
+	informerFactory.Core().V1().Pods().Informer()
+	informerFactory.Start(t.Context().Done())
+	informerFactory.WaitForCacheSync(t.Context().Done())
+
+	for _, tt := range []struct {
+		scope corev1.ResourceQuotaScope
+		want  string
+	}{
+		{scope: clusterresourcequota.ResourceQuotaScopeScheduled, want: "1"},
+		{scope: clusterresourcequota.ResourceQuotaScopeUnscheduled, want: "1"},
+	} {
+		stats, err := evaluator.UsageStats(quota.UsageStatsOptions{
+			Namespace: "test",
+			Scopes:    []corev1.ResourceQuotaScope{tt.scope},
+			Resources: []corev1.ResourceName{corev1.ResourceRequestsCPU},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := stats.Used[corev1.ResourceRequestsCPU]; got.String() != tt.want {
+			t.Errorf("%s: used = %v, want %v", tt.scope, got.String(), tt.want)
+		}
+	}
+
+	filter := clusterresourcequota.ConditionalUpdateFilter()
+	if !filter(corev1.SchemeGroupVersion.WithResource("pods"), pending, bound) {
+		t.Errorf("expected update filter to replenish quota when pod is scheduled")
+	}
+}
+
+func TestConditionalPodEvaluator_Topology(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	evaluator := clusterresourcequota.NewConditionalPodEvaluator(informerFactory, nil)
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{corev1.LabelTopologyZone: "zone-b"}}}
+	if err := informerFactory.Core().V1().Nodes().Informer().GetStore().Add(node); err != nil {
+		t.Fatal(err)
+	}
+
+	zoneTerm := func(zones ...string) corev1.NodeSelectorTerm {
+		return corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+			{Key: corev1.LabelTopologyZone, Operator: corev1.NodeSelectorOpIn, Values: zones},
+		}}
+	}
+	withAffinity := func(terms ...corev1.NodeSelectorTerm) corev1.PodSpec {
+		return corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: terms},
+		}}}
+	}
+	tests := []struct {
+		name string
+		spec corev1.PodSpec
+		want bool
+	}{
+		{
+			name: "node selector",
+			spec: corev1.PodSpec{NodeSelector: map[string]string{corev1.LabelTopologyZone: "zone-a"}},
+			want: true,
+		},
+		{
+			name: "node affinity",
+			spec: withAffinity(zoneTerm("zone-a"), zoneTerm("zone-a")),
+			want: true,
+		},
+		{
+			name: "node affinity of multiple zones",
+			spec: withAffinity(zoneTerm("zone-a", "zone-b")),
+			want: false,
+		},
+		{
+			name: "node affinity terms of different zones",
+			spec: withAffinity(zoneTerm("zone-a"), zoneTerm("zone-b")),
+			want: false,
+		},
+		{
+			name: "bound node overrides node selector",
+			spec: corev1.PodSpec{NodeName: node.Name, NodeSelector: map[string]string{corev1.LabelTopologyZone: "zone-a"}},
+			want: false,
+		},
+		{
+			name: "unknown node falls back to node selector",
+			spec: corev1.PodSpec{NodeName: "node-2", NodeSelector: map[string]string{corev1.LabelTopologyZone: "zone-a"}},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "test"}, Spec: tt.spec}
+			selector := corev1.ScopedResourceSelectorRequirement{
+				ScopeName: clusterresourcequota.ResourceQuotaScopeTopology,
+				Operator:  corev1.ScopeSelectorOpIn,
+				Values:    []string{corev1.LabelTopologyZone + "=zone-a"},
+			}
+			got, err := evaluator.MatchingScopes(pod, []corev1.ScopedResourceSelectorRequirement{selector})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (len(got) == 1) != tt.want {
+				t.Errorf("MatchingScopes() = %v, want matched %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConditionalPodEvaluator_WeightedResources(t *testing.T) {
+	config := `
+limitedResources:
+- resource: pods
+  matchContains:
+  - "*"
+weightedResources:
+- name: xiaoshiai.cn/gpu-units
+  weights:
+  - resource: nvidia.com/gpu
+    nodeSelector: nvidia.com/gpu.product=A100
+    weight: "1"
+  - resource: nvidia.com/gpu
+    nodeSelector: nvidia.com/gpu.product=T4
+    weight: "0.25"
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rqConfig, err := clusterresourcequota.GetResourceQuotaConfig(t.Context(), path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rqConfig.LimitedResources) != 1 || len(rqConfig.WeightedResources) != 1 {
+		t.Fatalf("unexpected config: %+v", rqConfig)
+	}
+
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	evaluator := clusterresourcequota.NewConditionalPodEvaluator(informerFactory, rqConfig.WeightedResources)
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-t4", Labels: map[string]string{"nvidia.com/gpu.product": "T4"}}}
+	if err := informerFactory.Core().V1().Nodes().Informer().GetStore().Add(node); err != nil {
+		t.Fatal(err)
+	}
+
+	newPod := func(spec corev1.PodSpec) *corev1.Pod {
+		spec.Containers = []corev1.Container{{
+			Name: "container",
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("2")},
+				Limits:   corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("2")},
+			},
+		}}
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "test"}, Spec: spec}
+	}
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want string
+	}{
+		{name: "A100 by node selector", pod: newPod(corev1.PodSpec{NodeSelector: map[string]string{"nvidia.com/gpu.product": "A100"}}), want: "2"},
+		{name: "T4 by bound node", pod: newPod(corev1.PodSpec{NodeName: node.Name}), want: "500m"},
+		{name: "T4 by node selector", pod: newPod(corev1.PodSpec{NodeSelector: map[string]string{"nvidia.com/gpu.product": "T4"}}), want: "500m"},
+		{name: "unbound charges the highest weight", pod: newPod(corev1.PodSpec{}), want: "2"},
+		{name: "unobserved node charges the highest weight", pod: newPod(corev1.PodSpec{NodeName: "node-x"}), want: "2"},
+		{name: "bound node overrides node selector", pod: newPod(corev1.PodSpec{NodeName: node.Name, NodeSelector: map[string]string{"nvidia.com/gpu.product": "V100"}}), want: "500m"},
+		{name: "model not weighted", pod: newPod(corev1.PodSpec{NodeSelector: map[string]string{"nvidia.com/gpu.product": "V100"}}), want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage, err := evaluator.Usage(tt.pod)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, ok := usage["requests.xiaoshiai.cn/gpu-units"]
+			if !ok {
+				if tt.want != "" {
+					t.Errorf("expected weighted usage %s, got none", tt.want)
+				}
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("weighted usage = %s, want %s", got.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package clusterresourcequota
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/admission"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	"k8s.io/apiserver/pkg/quota/v1/generic"
+)
+
+const (
+	// ResourceConfigMapsBytes is the total size of ConfigMaps in bytes
+	ResourceConfigMapsBytes corev1.ResourceName = "configmaps.bytes"
+	// ResourceSecretsBytes is the total size of Secrets in bytes
+	ResourceSecretsBytes corev1.ResourceName = "secrets.bytes"
+)
+
+// NewConfigMapEvaluator returns an evaluator that counts ConfigMaps and their size in bytes.
+func NewConfigMapEvaluator(f quota.ListerForResourceFunc) quota.Evaluator {
+	return NewObjectBytesEvaluator(corev1.SchemeGroupVersion.WithResource("configmaps"), corev1.ResourceConfigMaps, ResourceConfigMapsBytes, f, ConfigMapBytes)
+}
+
+// NewSecretEvaluator returns an evaluator that counts Secrets and their size in bytes.
+func NewSecretEvaluator(f quota.ListerForResourceFunc) quota.Evaluator {
+	return NewObjectBytesEvaluator(corev1.SchemeGroupVersion.WithResource("secrets"), corev1.ResourceSecrets, ResourceSecretsBytes, f, SecretBytes)
+}
+
+// ConfigMapBytes returns the size of keys and values of data and binaryData of the ConfigMap.
+func ConfigMapBytes(item runtime.Object) (int64, error) {
+	configmap, ok := item.(*corev1.ConfigMap)
+	if !ok {
+		return 0, fmt.Errorf("expect %T, got %T", &corev1.ConfigMap{}, item)
+	}
+	var size int64
+	for key, value := range configmap.Data {
+		size += int64(len(key) + len(value))
+	}
+	for key, value := range configmap.BinaryData {
+		size += int64(len(key) + len(value))
+	}
+	return size, nil
+}
+
+// SecretBytes returns the size of keys and values of data of the Secret,
+// stringData is counted as well in case it's not merged into data yet.
+func SecretBytes(item runtime.Object) (int64, error) {
+	secret, ok := item.(*corev1.Secret)
+	if !ok {
+		return 0, fmt.Errorf("expect %T, got %T", &corev1.Secret{}, item)
+	}
+	var size int64
+	for key, value := range secret.Data {
+		size += int64(len(key) + len(value))
+	}
+	for key, value := range secret.StringData {
+		if _, ok := secret.Data[key]; ok {
+			continue
+		}
+		size += int64(len(key) + len(value))
+	}
+	return size, nil
+}
+
+var _ quota.Evaluator = &ObjectBytesEvaluator{}
+
+// NewObjectBytesEvaluator returns an evaluator that counts objects, as the object count evaluator,
+// and sums their size in bytes calculated by sizeFunc.
+func NewObjectBytesEvaluator(gvr schema.GroupVersionResource, alias, bytesName corev1.ResourceName, f quota.ListerForResourceFunc, sizeFunc func(runtime.Object) (int64, error)) *ObjectBytesEvaluator {
+	listFuncByNamespace := generic.ListResourceUsingListerFunc(f, gvr)
+	return &ObjectBytesEvaluator{
+		Evaluator:           generic.NewObjectCountEvaluator(gvr.GroupResource(), listFuncByNamespace, alias),
+		bytesName:           bytesName,
+		sizeFunc:            sizeFunc,
+		listFuncByNamespace: listFuncByNamespace,
+	}
+}
+
+type ObjectBytesEvaluator struct {
+	// Evaluator counts the objects
+	quota.Evaluator
+	bytesName           corev1.ResourceName
+	sizeFunc            func(runtime.Object) (int64, error)
+	listFuncByNamespace generic.ListFuncByNamespace
+}
+
+// Handles implements v1.Evaluator, the size changes on updates.
+func (e *ObjectBytesEvaluator) Handles(a admission.Attributes) bool {
+	if a.GetSubresource() != "" {
+		return false
+	}
+	op := a.GetOperation()
+	return op == admission.Create || op == admission.Update
+}
+
+// Matches implements v1.Evaluator.
+func (e *ObjectBytesEvaluator) Matches(resourceQuota *corev1.ResourceQuota, item runtime.Object) (bool, error) {
+	return generic.Matches(resourceQuota, item, e.MatchingResources, generic.MatchesNoScopeFunc)
+}
+
+// MatchingResources implements v1.Evaluator.
+func (e *ObjectBytesEvaluator) MatchingResources(input []corev1.ResourceName) []corev1.ResourceName {
+	result := e.Evaluator.MatchingResources(input)
+	if quota.Contains(input, e.bytesName) {
+		result = append(result, e.bytesName)
+	}
+	return result
+}
+
+// Usage implements v1.Evaluator.
+func (e *ObjectBytesEvaluator) Usage(item runtime.Object) (corev1.ResourceList, error) {
+	result, err := e.Evaluator.Usage(item)
+	if err != nil {
+		return nil, err
+	}
+	size, err := e.sizeFunc(item)
+	if err != nil {
+		return nil, err
+	}
+	result[e.bytesName] = *resource.NewQuantity(size, resource.BinarySI)
+	return result, nil
+}
+
+// UsageStats implements v1.Evaluator.
+func (e *ObjectBytesEvaluator) UsageStats(options quota.UsageStatsOptions) (quota.UsageStats, error) {
+	return generic.CalculateUsageStats(options, e.listFuncByNamespace, generic.MatchesNoScopeFunc, e.Usage)
+}
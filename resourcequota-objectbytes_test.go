@@ -0,0 +1,80 @@
+package clusterresourcequota_test
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/admission"
+	"k8s.io/apiserver/pkg/quota/v1/generic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	api "k8s.io/kubernetes/pkg/apis/core"
+	"xiaoshiai.cn/clusterresourcequota"
+	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+func TestObjectBytesEvaluator_Usage(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	f := generic.ListerFuncForResourceFunc(informerFactory.ForResource)
+
+	configmap := &corev1.ConfigMap{
+		Data:       map[string]string{"key": "value"},
+		BinaryData: map[string][]byte{"bin": {1, 2, 3}},
+	}
+	usage, err := clusterresourcequota.NewConfigMapEvaluator(f).Usage(configmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := usage[clusterresourcequota.ResourceConfigMapsBytes]; size.Value() != 14 {
+		t.Errorf("configmaps.bytes = %v, want 14", size.String())
+	}
+	if count := usage["count/configmaps"]; count.Value() != 1 {
+		t.Errorf("count/configmaps = %v, want 1", count.String())
+	}
+
+	secret := &corev1.Secret{
+		Data:       map[string][]byte{"password": []byte("secret")},
+		StringData: map[string]string{"password": "secret", "user": "admin"},
+	}
+	usage, err = clusterresourcequota.NewSecretEvaluator(f).Usage(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := usage[clusterresourcequota.ResourceSecretsBytes]; size.Value() != 23 {
+		t.Errorf("secrets.bytes = %v, want 23", size.String())
+	}
+}
+
+func TestObjectBytesAdmission(t *testing.T) {
+	ctx := t.Context()
+
+	rq := &thisquotav1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "quota", Namespace: "test", ResourceVersion: "124"},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: corev1.ResourceList{clusterresourcequota.ResourceConfigMapsBytes: resource.MustParse("1Ki")},
+		},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{clusterresourcequota.ResourceConfigMapsBytes: resource.MustParse("1Ki")},
+			Used: corev1.ResourceList{clusterresourcequota.ResourceConfigMapsBytes: resource.MustParse("0")},
+		},
+	}
+	context := NewFakeControllerContext(ctx, []runtime.Object{}, []runtime.Object{rq})
+	_, admissionHandler, err := clusterresourcequota.NewResourceQuota(ctx, context, nil, clusterresourcequota.RoleAll)
+	if err != nil {
+		t.Fatalf("Error occurred while creating admission plugin: %v", err)
+	}
+
+	configmap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "big", Namespace: "test"},
+		Data:       map[string]string{"key": strings.Repeat("x", 2048)},
+	}
+	attr := admission.NewAttributesRecord(configmap, nil, api.Kind("ConfigMap").WithVersion("version"), configmap.Namespace, configmap.Name, corev1.Resource("configmaps").WithVersion("version"), "", admission.Create, &metav1.CreateOptions{}, false, nil)
+	if err := admissionHandler.Validate(ctx, attr, nil); !apierrors.IsForbidden(err) || !strings.Contains(err.Error(), "configmaps.bytes") {
+		t.Fatalf("expected forbidden error of configmaps.bytes, got: %v", err)
+	}
+}
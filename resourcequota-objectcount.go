@@ -0,0 +1,150 @@
+package clusterresourcequota
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	resourcequotacontroller "k8s.io/kubernetes/pkg/controller/resourcequota"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ObjectCountRulesSyncer keeps the rules of the object count webhook in sync with the discovered namespaced resources,
+// so `count/<resource>.<group>` of any resource is checked by the resourcequota webhook.
+// Resources matched by the other webhooks of the same endpoint are excluded, they are checked already.
+type ObjectCountRulesSyncer struct {
+	Client               client.Client
+	DiscoveryFunc        resourcequotacontroller.NamespacedResourcesFunc
+	IgnoredResources     map[schema.GroupResource]struct{}
+	WebhookConfiguration string
+	Webhook              string
+	Interval             time.Duration
+}
+
+func (s *ObjectCountRulesSyncer) Start(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx).WithName("objectcount-rules")
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := s.Sync(ctx); err != nil {
+			log.Error(err, "sync object count webhook rules")
+		}
+	}, s.Interval)
+	return nil
+}
+
+func (s *ObjectCountRulesSyncer) Sync(ctx context.Context) error {
+	resources, err := resourcequotacontroller.GetQuotableResources(s.DiscoveryFunc)
+	if resources == nil {
+		return err
+	}
+	// keep the rules of resources whose group failed to discover, until the group is discovered again
+	partial := err != nil
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configuration := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+		if err := s.Client.Get(ctx, client.ObjectKey{Name: s.WebhookConfiguration}, configuration); err != nil {
+			return err
+		}
+		i := slices.IndexFunc(configuration.Webhooks, func(webhook admissionregistrationv1.ValidatingWebhook) bool {
+			return webhook.Name == s.Webhook
+		})
+		if i == -1 {
+			return fmt.Errorf("webhook %s not found in validatingwebhookconfiguration %s", s.Webhook, s.WebhookConfiguration)
+		}
+		var others []admissionregistrationv1.RuleWithOperations
+		for j, webhook := range configuration.Webhooks {
+			if j != i && equality.Semantic.DeepEqual(webhook.ClientConfig, configuration.Webhooks[i].ClientConfig) {
+				others = append(others, webhook.Rules...)
+			}
+		}
+		gvrs := []schema.GroupVersionResource{}
+		for gvr := range resources {
+			if _, ok := s.IgnoredResources[gvr.GroupResource()]; ok || rulesMatchCreate(others, gvr) {
+				continue
+			}
+			gvrs = append(gvrs, gvr)
+		}
+		if partial {
+			for _, rule := range configuration.Webhooks[i].Rules {
+				for _, gvr := range ruleResources(rule) {
+					if _, ok := resources[gvr]; !ok && !slices.Contains(gvrs, gvr) {
+						gvrs = append(gvrs, gvr)
+					}
+				}
+			}
+		}
+		rules := ObjectCountRules(gvrs)
+		if equality.Semantic.DeepEqual(configuration.Webhooks[i].Rules, rules) {
+			return nil
+		}
+		configuration.Webhooks[i].Rules = rules
+		return s.Client.Update(ctx, configuration)
+	})
+}
+
+// ObjectCountRules returns the webhook rules matching the creation of the resources, a rule per group version.
+func ObjectCountRules(gvrs []schema.GroupVersionResource) []admissionregistrationv1.RuleWithOperations {
+	resources := map[schema.GroupVersion][]string{}
+	for _, gvr := range gvrs {
+		resources[gvr.GroupVersion()] = append(resources[gvr.GroupVersion()], gvr.Resource)
+	}
+	groupVersions := make([]schema.GroupVersion, 0, len(resources))
+	for gv := range resources {
+		groupVersions = append(groupVersions, gv)
+	}
+	sort.Slice(groupVersions, func(i, j int) bool {
+		return groupVersions[i].String() < groupVersions[j].String()
+	})
+	rules := []admissionregistrationv1.RuleWithOperations{}
+	for _, gv := range groupVersions {
+		names := resources[gv]
+		sort.Strings(names)
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			// object counts only change on creation
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{gv.Group},
+				APIVersions: []string{gv.Version},
+				Resources:   names,
+				Scope:       ptr.To(admissionregistrationv1.NamespacedScope),
+			},
+		})
+	}
+	return rules
+}
+
+// rulesMatchCreate returns true if any rule matches the creation of the resource.
+func rulesMatchCreate(rules []admissionregistrationv1.RuleWithOperations, gvr schema.GroupVersionResource) bool {
+	matchAny := func(values []string, value string) bool {
+		return slices.Contains(values, "*") || slices.Contains(values, value)
+	}
+	for _, rule := range rules {
+		if !slices.Contains(rule.Operations, admissionregistrationv1.Create) && !slices.Contains(rule.Operations, admissionregistrationv1.OperationAll) {
+			continue
+		}
+		if matchAny(rule.APIGroups, gvr.Group) && matchAny(rule.APIVersions, gvr.Version) && matchAny(rule.Resources, gvr.Resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleResources returns the resources of a rule generated by [ObjectCountRules].
+func ruleResources(rule admissionregistrationv1.RuleWithOperations) []schema.GroupVersionResource {
+	var gvrs []schema.GroupVersionResource
+	for _, group := range rule.APIGroups {
+		for _, version := range rule.APIVersions {
+			for _, resource := range rule.Resources {
+				gvrs = append(gvrs, schema.GroupVersionResource{Group: group, Version: version, Resource: resource})
+			}
+		}
+	}
+	return gvrs
+}
@@ -0,0 +1,87 @@
+package clusterresourcequota_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	quotainstall "k8s.io/kubernetes/pkg/quota/v1/install"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"xiaoshiai.cn/clusterresourcequota"
+)
+
+func fakeNamespacedResources() ([]*metav1.APIResourceList, error) {
+	verbs := metav1.Verbs{"create", "list", "watch", "delete"}
+	return []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "pods", Namespaced: true, Verbs: verbs},
+				{Name: "configmaps", Namespaced: true, Verbs: verbs},
+				{Name: "events", Namespaced: true, Verbs: verbs},
+				{Name: "bindings", Namespaced: true, Verbs: metav1.Verbs{"create"}},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Namespaced: true, Verbs: verbs},
+			},
+		},
+	}, nil
+}
+
+func TestObjectCountRulesSyncer_Sync(t *testing.T) {
+	ctx := context.Background()
+
+	clientConfig := func(path string) admissionregistrationv1.WebhookClientConfig {
+		return admissionregistrationv1.WebhookClientConfig{
+			Service: &admissionregistrationv1.ServiceReference{Namespace: "default", Name: "clusterresourcequota", Path: ptr.To(path)},
+		}
+	}
+	rule := func(group string, resources ...string) admissionregistrationv1.RuleWithOperations {
+		return admissionregistrationv1.RuleWithOperations{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+			Rule:       admissionregistrationv1.Rule{APIGroups: []string{group}, APIVersions: []string{"v1"}, Resources: resources},
+		}
+	}
+	configuration := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "clusterresourcequota"},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{Name: "validate.resourcequota.xiaoshiai.cn", ClientConfig: clientConfig("/validate"), Rules: []admissionregistrationv1.RuleWithOperations{rule("", "pods")}},
+			// deployments are checked by a different endpoint, their count is not
+			{Name: "validate.workload.xiaoshiai.cn", ClientConfig: clientConfig("/validate-workload"), Rules: []admissionregistrationv1.RuleWithOperations{rule("apps", "deployments")}},
+			{Name: "count.resourcequota.xiaoshiai.cn", ClientConfig: clientConfig("/validate")},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(clusterresourcequota.GetScheme()).WithObjects(configuration).Build()
+	syncer := &clusterresourcequota.ObjectCountRulesSyncer{
+		Client:               cli,
+		DiscoveryFunc:        fakeNamespacedResources,
+		IgnoredResources:     quotainstall.DefaultIgnoredResources(),
+		WebhookConfiguration: "clusterresourcequota",
+		Webhook:              "count.resourcequota.xiaoshiai.cn",
+	}
+	if err := syncer.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Get(ctx, client.ObjectKeyFromObject(configuration), configuration); err != nil {
+		t.Fatal(err)
+	}
+	expected := clusterresourcequota.ObjectCountRules([]schema.GroupVersionResource{
+		{Group: "apps", Version: "v1", Resource: "deployments"},
+		{Version: "v1", Resource: "configmaps"},
+	})
+	if got := configuration.Webhooks[2].Rules; !reflect.DeepEqual(got, expected) {
+		t.Errorf("rules = %v, want %v", got, expected)
+	}
+	if len(expected) != 2 || expected[0].APIGroups[0] != "apps" || expected[1].APIGroups[0] != "" || expected[0].Operations[0] != admissionregistrationv1.Create {
+		t.Errorf("unexpected rules: %v", expected)
+	}
+}
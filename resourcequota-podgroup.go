@@ -0,0 +1,557 @@
+package clusterresourcequota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/admission"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/clock"
+	"k8s.io/utils/keymutex"
+	"xiaoshiai.cn/common"
+)
+
+const (
+	// LabelPodGroup is the name of the pod group the pod belongs to,
+	// members of a group are admitted all-or-nothing.
+	LabelPodGroup = "podgroup.clusterresourcequota." + common.GroupPrefix
+	// AnnotationPodGroupSize is the number of pods in the pod group,
+	// it's read from the annotation, or from the label of the same key.
+	AnnotationPodGroupSize = "podgroup-size.clusterresourcequota." + common.GroupPrefix
+	// AnnotationPodGroupReservations is the reservations of pod groups held by a ResourceQuota in JSON,
+	// it's written by the admission and preserved when the ResourceQuota is synced from its ClusterResourceQuota.
+	AnnotationPodGroupReservations = "podgroup-reservations.clusterresourcequota." + common.GroupPrefix
+)
+
+// DefaultPodGroupTimeout is the time a reservation waits for the rest of the pod group.
+const DefaultPodGroupTimeout = 5 * time.Minute
+
+// MaxPodGroupReservationsSize is the maximum size of [AnnotationPodGroupReservations] of a quota,
+// a new reservation is held by the next quota matching the group when it's full.
+const MaxPodGroupReservationsSize = 64 << 10
+
+// PodGroupOf returns the pod group of the pod and its size, ok is false if the pod is not a member of a group.
+func PodGroupOf(pod *corev1.Pod) (name string, size int, ok bool, err error) {
+	name = pod.Labels[LabelPodGroup]
+	if name == "" {
+		return "", 0, false, nil
+	}
+	value, found := pod.Annotations[AnnotationPodGroupSize]
+	if !found {
+		value, found = pod.Labels[AnnotationPodGroupSize]
+	}
+	if !found {
+		return "", 0, false, fmt.Errorf("pod group %s: %s is required", name, AnnotationPodGroupSize)
+	}
+	size, err = strconv.Atoi(value)
+	if err != nil || size < 1 {
+		return "", 0, false, fmt.Errorf("pod group %s: invalid size %q", name, value)
+	}
+	return name, size, true, nil
+}
+
+var _ quota.Evaluator = &PodGroupEvaluator{}
+
+// NewPodGroupEvaluator wraps the pod evaluator to reserve quota for pod groups,
+// quotaClient persists the reservations on the quotas, quotaLister reads them on recalculation.
+func NewPodGroupEvaluator(evaluator quota.Evaluator, quotaClient corev1client.ResourceQuotasGetter, quotaLister corev1listers.ResourceQuotaLister, timeout time.Duration) *PodGroupEvaluator {
+	if timeout <= 0 {
+		timeout = DefaultPodGroupTimeout
+	}
+	return &PodGroupEvaluator{
+		Evaluator:   evaluator,
+		QuotaClient: quotaClient,
+		QuotaLister: quotaLister,
+		Timeout:     timeout,
+		Clock:       clock.RealClock{},
+		locks:       keymutex.NewHashed(0),
+		charges:     map[types.NamespacedName]int64{},
+	}
+}
+
+// PodGroupEvaluator charges the first member of a pod group for the whole group,
+// the following members are admitted against the reservation without being charged again.
+// The reservation is persisted in [AnnotationPodGroupReservations] of a quota matching the group,
+// so it's shared by the replicas of the webhook and survives restarts.
+// Members which have not arrived yet are counted in [PodGroupEvaluator.UsageStats],
+// so the reservation survives the recalculation of the quota controller.
+type PodGroupEvaluator struct {
+	quota.Evaluator
+	QuotaClient corev1client.ResourceQuotasGetter
+	QuotaLister corev1listers.ResourceQuotaLister
+	Timeout     time.Duration
+	Clock       clock.Clock
+
+	// locks serializes the admission of members of the same group in this process,
+	// the replicas are serialized by the resource version of the quota holding the reservation
+	locks keymutex.KeyMutex
+	lock  sync.Mutex
+	// charges is the multiplier of usage of the pods under admission
+	charges map[types.NamespacedName]int64
+}
+
+// Usage implements v1.Evaluator.
+func (e *PodGroupEvaluator) Usage(item runtime.Object) (corev1.ResourceList, error) {
+	usage, err := e.Evaluator.Usage(item)
+	if err != nil {
+		return nil, err
+	}
+	pod, ok := item.(*corev1.Pod)
+	if !ok {
+		return usage, nil
+	}
+	e.lock.Lock()
+	multiplier, ok := e.charges[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}]
+	e.lock.Unlock()
+	if !ok {
+		return usage, nil
+	}
+	return scaleResourceList(usage, multiplier), nil
+}
+
+// UsageStats implements v1.Evaluator.
+func (e *PodGroupEvaluator) UsageStats(options quota.UsageStatsOptions) (quota.UsageStats, error) {
+	stats, err := e.Evaluator.UsageStats(options)
+	if err != nil {
+		return quota.UsageStats{}, err
+	}
+	reserved, err := e.reservedUsage(options)
+	if err != nil {
+		return quota.UsageStats{}, err
+	}
+	stats.Used = quota.Add(stats.Used, quota.Mask(reserved, options.Resources))
+	return stats, nil
+}
+
+// reservedUsage returns the usage of the members of the groups not arrived yet, which is counted by the quotas of the scopes.
+// A reservation is counted if one of the quotas it matched has the same scopes.
+// The expired reservations are counted until they are released, as the status of the quotas still includes them.
+func (e *PodGroupEvaluator) reservedUsage(options quota.UsageStatsOptions) (corev1.ResourceList, error) {
+	quotas, err := e.QuotaLister.ResourceQuotas(options.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(quotas, func(a, b *corev1.ResourceQuota) int { return strings.Compare(a.Name, b.Name) })
+	scoped := sets.New[string]()
+	for _, resourceQuota := range quotas {
+		if equality.Semantic.DeepEqual(resourceQuota.Spec.Scopes, options.Scopes) && equality.Semantic.DeepEqual(resourceQuota.Spec.ScopeSelector, options.ScopeSelector) {
+			scoped.Insert(resourceQuota.Name)
+		}
+	}
+	groups := sets.New[string]()
+	usage := corev1.ResourceList{}
+	for _, resourceQuota := range quotas {
+		for group, reservation := range PodGroupReservations(resourceQuota) {
+			if groups.Has(group) {
+				continue
+			}
+			groups.Insert(group)
+			if scoped.HasAny(reservation.Quotas...) {
+				usage = quota.Add(usage, scaleResourceList(reservation.Usage, int64(reservation.Outstanding())))
+			}
+		}
+	}
+	return usage, nil
+}
+
+// Admit admits a member of the pod group by validate.
+// The first member, or any member after the reservation expired, is charged for the whole group,
+// and the group is rejected if it can not fit. Other members are not charged while the reservation holds a place for them.
+// The place is claimed on the persisted reservation before validate, and returned if validate fails.
+func (e *PodGroupEvaluator) Admit(ctx context.Context, pod *corev1.Pod, group string, size int, validate func() error) error {
+	groupkey := types.NamespacedName{Namespace: pod.Namespace, Name: group}
+	podkey := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+
+	e.locks.LockKey(groupkey.String())
+	defer e.locks.UnlockKey(groupkey.String())
+
+	var covered, member bool
+	var claimed, released *PodGroupReservation
+	if size > 1 {
+		now := e.Clock.Now()
+		usage, err := e.Evaluator.Usage(pod)
+		if err != nil {
+			return err
+		}
+		if err := e.updateReservation(ctx, groupkey, pod, func(current *PodGroupReservation) *PodGroupReservation {
+			covered, member, claimed, released = false, false, nil, nil
+			if current != nil && now.After(current.Expires.Time) {
+				released, current = current, nil
+			}
+			if current != nil && slices.Contains(current.Members, pod.Name) {
+				covered, member = true, true
+				return current
+			}
+			if current != nil && current.Outstanding() > 0 {
+				covered, claimed = true, current.WithMember(pod.Name)
+			} else {
+				claimed = &PodGroupReservation{
+					Size:    size,
+					Members: []string{pod.Name},
+					Usage:   usage,
+					Expires: metav1.NewTime(now.Add(e.Timeout)),
+				}
+			}
+			if claimed.Outstanding() == 0 {
+				// all members arrived, they are counted by themselves from now on
+				return nil
+			}
+			return claimed
+		}); err != nil {
+			return err
+		}
+		if released != nil {
+			e.releaseUsage(ctx, groupkey, released)
+		}
+	}
+	multiplier := int64(0)
+	if !covered {
+		multiplier = int64(size)
+	}
+	e.lock.Lock()
+	e.charges[podkey] = multiplier
+	e.lock.Unlock()
+
+	err := validate()
+
+	e.lock.Lock()
+	delete(e.charges, podkey)
+	e.lock.Unlock()
+	if err == nil {
+		return nil
+	}
+	if claimed != nil {
+		// return the place claimed, the admission is retried by the client
+		if rollbackErr := e.updateReservation(ctx, groupkey, pod, func(current *PodGroupReservation) *PodGroupReservation {
+			switch {
+			case !covered:
+				if current != nil && len(current.Members) != 0 && current.Members[0] == pod.Name && current.Expires.Equal(&claimed.Expires) {
+					return nil
+				}
+				return current
+			case current == nil && claimed.Outstanding() == 0:
+				// the claim completed the group
+				return claimed.WithoutMember(pod.Name)
+			case current == nil:
+				return nil
+			default:
+				return current.WithoutMember(pod.Name)
+			}
+		}); rollbackErr != nil {
+			logr.FromContextOrDiscard(ctx).Error(rollbackErr, "return pod group reservation", "podgroup", groupkey, "pod", pod.Name)
+		}
+	}
+	if covered || member || size == 1 {
+		return err
+	}
+	return apierrors.NewForbidden(corev1.Resource("pods"), pod.Name,
+		fmt.Errorf("pod group %s of %d pods can not fit in quota: %w", group, size, err))
+}
+
+// Run releases the reservations expired periodically until ctx is done.
+func (e *PodGroupEvaluator) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := e.ReleaseExpired(ctx); err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "release expired pod group reservations")
+		}
+	}, 10*time.Second)
+}
+
+// ReleaseExpired returns the quota reserved for members not arrived before timeout.
+func (e *PodGroupEvaluator) ReleaseExpired(ctx context.Context) error {
+	quotas, err := e.QuotaLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	now := e.Clock.Now()
+	expired := sets.New[types.NamespacedName]()
+	for _, resourceQuota := range quotas {
+		for group, reservation := range PodGroupReservations(resourceQuota) {
+			if now.After(reservation.Expires.Time) {
+				expired.Insert(types.NamespacedName{Namespace: resourceQuota.Namespace, Name: group})
+			}
+		}
+	}
+	var errs []error
+	for key := range expired {
+		if err := e.release(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// release removes the reservation if it's expired, and subtracts the usage of members not arrived.
+func (e *PodGroupEvaluator) release(ctx context.Context, key types.NamespacedName) error {
+	e.locks.LockKey(key.String())
+	defer e.locks.UnlockKey(key.String())
+
+	now := e.Clock.Now()
+	var released *PodGroupReservation
+	if err := e.updateReservation(ctx, key, nil, func(current *PodGroupReservation) *PodGroupReservation {
+		released = nil
+		if current == nil || !now.After(current.Expires.Time) {
+			return current
+		}
+		released = current
+		return nil
+	}); err != nil {
+		return err
+	}
+	if released != nil {
+		e.releaseUsage(ctx, key, released)
+	}
+	return nil
+}
+
+// updateReservation replaces the reservation of the group by the result of fn, the reservation is nil if there is none.
+// fn must not modify the reservation, the reservation is unchanged if it returns the same one.
+// The reservation is persisted on the quota holding it, a new reservation records the quotas matching pod,
+// and is held by the first of them with room for it.
+// fn is called again on conflicts, so the replicas never update the same reservation concurrently.
+func (e *PodGroupEvaluator) updateReservation(ctx context.Context, key types.NamespacedName, pod *corev1.Pod, fn func(*PodGroupReservation) *PodGroupReservation) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		quotas, err := e.QuotaClient.ResourceQuotas(key.Namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		slices.SortFunc(quotas.Items, func(a, b corev1.ResourceQuota) int { return strings.Compare(a.Name, b.Name) })
+		var holder *corev1.ResourceQuota
+		var reservations map[string]*PodGroupReservation
+		for i := range quotas.Items {
+			if r := PodGroupReservations(&quotas.Items[i]); r[key.Name] != nil {
+				holder, reservations = &quotas.Items[i], r
+				break
+			}
+		}
+		current := reservations[key.Name]
+		next := fn(current)
+		if next == current {
+			return nil
+		}
+		var candidates []*corev1.ResourceQuota
+		if holder != nil {
+			candidates = append(candidates, holder)
+		} else if next != nil && pod != nil {
+			next.Quotas = nil
+			for i := range quotas.Items {
+				matched, err := e.Evaluator.Matches(&quotas.Items[i], pod)
+				if err != nil {
+					return err
+				}
+				if matched {
+					next.Quotas = append(next.Quotas, quotas.Items[i].Name)
+					candidates = append(candidates, &quotas.Items[i])
+				}
+			}
+		}
+		if len(candidates) == 0 {
+			// no quota is charged for the group
+			return nil
+		}
+		var data []byte
+		for _, candidate := range candidates {
+			holder, reservations = candidate, PodGroupReservations(candidate)
+			if next == nil {
+				delete(reservations, key.Name)
+			} else {
+				reservations[key.Name] = next
+			}
+			if data, err = json.Marshal(reservations); err != nil {
+				return err
+			}
+			if len(data) <= MaxPodGroupReservationsSize {
+				break
+			}
+		}
+		if len(data) > MaxPodGroupReservationsSize && next != nil {
+			return apierrors.NewForbidden(corev1.Resource("pods"), pod.GetName(),
+				fmt.Errorf("pod group %s: reservations of quota %s exceed %d bytes", key.Name, holder.Name, MaxPodGroupReservationsSize))
+		}
+		if len(reservations) == 0 {
+			delete(holder.Annotations, AnnotationPodGroupReservations)
+		} else {
+			if holder.Annotations == nil {
+				holder.Annotations = map[string]string{}
+			}
+			holder.Annotations[AnnotationPodGroupReservations] = string(data)
+		}
+		previous := holder.ResourceVersion
+		updated, err := e.QuotaClient.ResourceQuotas(key.Namespace).Update(ctx, holder, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		e.waitForCache(ctx, updated, previous)
+		return nil
+	})
+}
+
+// waitForCache waits a while for the quota updated to be observed by the lister,
+// the admission plugin updates the status of the quota from the lister, which conflicts until then.
+func (e *PodGroupEvaluator) waitForCache(ctx context.Context, updated *corev1.ResourceQuota, previous string) {
+	if updated.ResourceVersion == previous {
+		return
+	}
+	_ = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Second, true, func(context.Context) (bool, error) {
+		cached, err := e.QuotaLister.ResourceQuotas(updated.Namespace).Get(updated.Name)
+		if err != nil {
+			// the admission plugin looks up the quotas not cached from the apiserver
+			return apierrors.IsNotFound(err), nil
+		}
+		return cached.ResourceVersion != previous, nil
+	})
+}
+
+// releaseUsage subtracts the usage of members not arrived from the status of the matching quotas,
+// the quotas are recalculated by the controller if it fails.
+func (e *PodGroupEvaluator) releaseUsage(ctx context.Context, key types.NamespacedName, reservation *PodGroupReservation) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("podgroup", key, "outstanding", reservation.Outstanding())
+	log.Info("pod group reservation expired")
+
+	usage := scaleResourceList(reservation.Usage, int64(reservation.Outstanding()))
+	if quota.IsZero(usage) {
+		return
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		quotas, err := e.QuotaClient.ResourceQuotas(key.Namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range quotas.Items {
+			resourceQuota := &quotas.Items[i]
+			if !slices.Contains(reservation.Quotas, resourceQuota.Name) {
+				continue
+			}
+			reserved := quota.Mask(usage, quota.ResourceNames(resourceQuota.Status.Hard))
+			if len(reserved) == 0 {
+				continue
+			}
+			used := quota.Subtract(resourceQuota.Status.Used, reserved)
+			for name, quantity := range used {
+				if quantity.Sign() < 0 {
+					used[name] = *resource.NewQuantity(0, quantity.Format)
+				}
+			}
+			resourceQuota.Status.Used = used
+			if _, err := e.QuotaClient.ResourceQuotas(key.Namespace).UpdateStatus(ctx, resourceQuota, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(err, "release pod group reservation")
+	}
+}
+
+// PodGroupReservation is the quota reserved by the first member of a pod group for the rest of the group.
+type PodGroupReservation struct {
+	Size    int      `json:"size"`
+	Members []string `json:"members,omitempty"`
+	// Usage is the usage of the first member, the members not arrived yet are charged the same
+	Usage corev1.ResourceList `json:"usage"`
+	// Quotas are the quotas matching the first member, which are charged for the members not arrived yet
+	Quotas  []string    `json:"quotas,omitempty"`
+	Expires metav1.Time `json:"expires"`
+}
+
+// Outstanding returns the number of members not arrived yet.
+func (r *PodGroupReservation) Outstanding() int {
+	return max(r.Size-len(r.Members), 0)
+}
+
+// WithMember returns a copy of the reservation with the member arrived.
+func (r *PodGroupReservation) WithMember(name string) *PodGroupReservation {
+	result := *r
+	result.Members = append(slices.Clone(r.Members), name)
+	return &result
+}
+
+// WithoutMember returns a copy of the reservation without the member, or the reservation itself if it's not a member.
+func (r *PodGroupReservation) WithoutMember(name string) *PodGroupReservation {
+	if !slices.Contains(r.Members, name) {
+		return r
+	}
+	result := *r
+	result.Members = slices.DeleteFunc(slices.Clone(r.Members), func(member string) bool { return member == name })
+	return &result
+}
+
+// PodGroupReservations returns the reservations of pod groups held by the quota by the name of group,
+// an invalid annotation holds no reservations.
+func PodGroupReservations(resourceQuota *corev1.ResourceQuota) map[string]*PodGroupReservation {
+	reservations := map[string]*PodGroupReservation{}
+	value, ok := resourceQuota.Annotations[AnnotationPodGroupReservations]
+	if !ok {
+		return reservations
+	}
+	if err := json.Unmarshal([]byte(value), &reservations); err != nil {
+		return map[string]*PodGroupReservation{}
+	}
+	for group, reservation := range reservations {
+		if reservation == nil || reservation.Usage == nil {
+			delete(reservations, group)
+		}
+	}
+	return reservations
+}
+
+// scaleResourceList returns each quantity of list multiplied by n.
+func scaleResourceList(list corev1.ResourceList, n int64) corev1.ResourceList {
+	factor := *resource.NewQuantity(n, resource.DecimalSI)
+	result := corev1.ResourceList{}
+	for name, quantity := range list {
+		result[name] = multiplyQuantities(quantity, factor)
+	}
+	return result
+}
+
+var _ admission.ValidationInterface = &PodGroupAdmission{}
+
+// PodGroupAdmission admits the members of pod groups through [PodGroupEvaluator.Admit],
+// other requests are passed to the wrapped admission as is.
+type PodGroupAdmission struct {
+	admission.ValidationInterface
+	Evaluator *PodGroupEvaluator
+}
+
+func (a *PodGroupAdmission) Validate(ctx context.Context, attr admission.Attributes, o admission.ObjectInterfaces) error {
+	if attr.GetOperation() != admission.Create || attr.GetSubresource() != "" || attr.GetResource().GroupResource() != corev1.Resource("pods") {
+		return a.ValidationInterface.Validate(ctx, attr, o)
+	}
+	pod, ok := attr.GetObject().(*corev1.Pod)
+	if !ok {
+		return a.ValidationInterface.Validate(ctx, attr, o)
+	}
+	group, size, ok, err := PodGroupOf(pod)
+	if err != nil {
+		return admission.NewForbidden(attr, err)
+	}
+	if !ok {
+		return a.ValidationInterface.Validate(ctx, attr, o)
+	}
+	return a.Evaluator.Admit(ctx, pod, group, size, func() error {
+		return a.ValidationInterface.Validate(ctx, attr, o)
+	})
+}
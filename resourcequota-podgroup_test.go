@@ -0,0 +1,286 @@
+package clusterresourcequota_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/admission"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	api "k8s.io/kubernetes/pkg/apis/core"
+	testingclock "k8s.io/utils/clock/testing"
+	"xiaoshiai.cn/clusterresourcequota"
+	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+	thisfake "xiaoshiai.cn/clusterresourcequota/generated/clientset/versioned/fake"
+)
+
+func newCPUQuota(hard, used string) *thisquotav1.ResourceQuota {
+	return &thisquotav1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "quota", Namespace: "test", ResourceVersion: "124"},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse(hard)},
+		},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse(hard)},
+			Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse(used)},
+		},
+	}
+}
+
+func newPodGroupMember(group string, size, index int, cpu string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-%d", group, index), Namespace: "test"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "container",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)},
+				},
+			}},
+		},
+	}
+	if group != "" {
+		pod.Labels = map[string]string{clusterresourcequota.LabelPodGroup: group}
+		pod.Annotations = map[string]string{clusterresourcequota.AnnotationPodGroupSize: strconv.Itoa(size)}
+	}
+	return pod
+}
+
+func createPodAttributes(pod *corev1.Pod) admission.Attributes {
+	return admission.NewAttributesRecord(pod, nil, api.Kind("Pod").WithVersion("version"), pod.Namespace, pod.Name, corev1.Resource("pods").WithVersion("version"), "", admission.Create, &metav1.CreateOptions{}, false, nil)
+}
+
+func TestPodGroupAdmission(t *testing.T) {
+	ctx := t.Context()
+
+	context := NewFakeControllerContext(ctx, []runtime.Object{}, []runtime.Object{newCPUQuota("3", "0")})
+	_, admissionHandler, err := clusterresourcequota.NewResourceQuota(ctx, context, nil, clusterresourcequota.RoleAll)
+	if err != nil {
+		t.Fatalf("Error occurred while creating admission plugin: %v", err)
+	}
+
+	// the whole group is checked on the first member
+	err = admissionHandler.Validate(ctx, createPodAttributes(newPodGroupMember("big", 4, 0, "1")), nil)
+	if !apierrors.IsForbidden(err) || !strings.Contains(err.Error(), "pod group big") {
+		t.Fatalf("expected pod group forbidden error, got: %v", err)
+	}
+
+	for i := range 2 {
+		if err := admissionHandler.Validate(ctx, createPodAttributes(newPodGroupMember("small", 2, i, "1")), nil); err != nil {
+			t.Fatalf("member %d: unexpected error: %v", i, err)
+		}
+		rq, err := context.ThisClientSet.QuotaV1().ResourceQuotas("test").Get(ctx, "quota", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used := rq.Status.Used[corev1.ResourceRequestsCPU]; used.String() != "2" {
+			t.Errorf("member %d: used = %v, want 2", i, used.String())
+		}
+	}
+
+	// the size is required
+	pod := newPodGroupMember("nosize", 2, 0, "1")
+	pod.Annotations = nil
+	if err := admissionHandler.Validate(ctx, createPodAttributes(pod), nil); !apierrors.IsForbidden(err) {
+		t.Fatalf("expected forbidden error, got: %v", err)
+	}
+}
+
+func TestPodGroupEvaluator_ReleaseExpired(t *testing.T) {
+	ctx := t.Context()
+
+	thisclientset := thisfake.NewSimpleClientset(newCPUQuota("10", "3"))
+	kubeclientset := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(kubeclientset, 0)
+	podevaluator := clusterresourcequota.NewConditionalPodEvaluator(informerFactory, nil)
+	informerFactory.Core().V1().Pods().Informer()
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	quotaClient := clusterresourcequota.HijackClientSet{Interface: kubeclientset, This: thisclientset}.CoreV1()
+	// the lister is synced from the client explicitly
+	quotaIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	syncQuotas := func() {
+		quotas, err := quotaClient.ResourceQuotas("test").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range quotas.Items {
+			if err := quotaIndexer.Update(&quotas.Items[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	quotaLister := corev1listers.NewResourceQuotaLister(quotaIndexer)
+	clock := testingclock.NewFakeClock(time.Now())
+	// each member is admitted by another replica, the reservation is shared through the quota
+	newEvaluator := func() *clusterresourcequota.PodGroupEvaluator {
+		evaluator := clusterresourcequota.NewPodGroupEvaluator(podevaluator, quotaClient, quotaLister, time.Minute)
+		evaluator.Clock = clock
+		return evaluator
+	}
+
+	// the quota status is charged by the validation, here only the usage is recorded
+	admit := func(pod *corev1.Pod) corev1.ResourceList {
+		evaluator := newEvaluator()
+		var usage corev1.ResourceList
+		err := evaluator.Admit(ctx, pod, "group", 3, func() error {
+			var err error
+			usage, err = evaluator.Usage(pod)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return usage
+	}
+	if usage := admit(newPodGroupMember("group", 3, 0, "1")); !quota.Equals(quota.Mask(usage, []corev1.ResourceName{corev1.ResourceRequestsCPU}), corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("3")}) {
+		t.Errorf("first member usage = %v, want requests.cpu=3", usage)
+	}
+	if usage := admit(newPodGroupMember("group", 3, 1, "1")); !quota.IsZero(usage) {
+		t.Errorf("second member usage = %v, want zero", usage)
+	}
+	// the rejected member returns its place
+	evaluator := newEvaluator()
+	rejected := newPodGroupMember("group", 3, 2, "1")
+	if err := evaluator.Admit(ctx, rejected, "group", 3, func() error {
+		return apierrors.NewForbidden(corev1.Resource("pods"), rejected.Name, fmt.Errorf("rejected"))
+	}); !apierrors.IsForbidden(err) {
+		t.Fatalf("expected forbidden error, got: %v", err)
+	}
+	syncQuotas()
+	rq, err := quotaLister.ResourceQuotas("test").Get("quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reservation := clusterresourcequota.PodGroupReservations(rq)["group"]
+	if reservation == nil || reservation.Outstanding() != 1 {
+		t.Fatalf("expected a reservation of 1 outstanding member, got %+v", reservation)
+	}
+	if annotation := rq.Annotations[clusterresourcequota.AnnotationPodGroupReservations]; strings.Contains(annotation, "containers") {
+		t.Errorf("expected the reservation without the pod spec, got %s", annotation)
+	}
+
+	// the member not arrived yet is counted on recalculation
+	stats, err := evaluator.UsageStats(quota.UsageStatsOptions{Namespace: "test", Resources: []corev1.ResourceName{corev1.ResourceRequestsCPU}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := stats.Used[corev1.ResourceRequestsCPU]; used.String() != "1" {
+		t.Errorf("reserved usage = %v, want 1", used.String())
+	}
+	// but not by the quotas of other scopes
+	stats, err = evaluator.UsageStats(quota.UsageStatsOptions{Namespace: "test", Scopes: []corev1.ResourceQuotaScope{corev1.ResourceQuotaScopeNotTerminating}, Resources: []corev1.ResourceName{corev1.ResourceRequestsCPU}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := stats.Used[corev1.ResourceRequestsCPU]; !used.IsZero() {
+		t.Errorf("reserved usage of other scopes = %v, want 0", used.String())
+	}
+
+	clock.Step(2 * time.Minute)
+	if err := evaluator.ReleaseExpired(ctx); err != nil {
+		t.Fatal(err)
+	}
+	thisrq, err := thisclientset.QuotaV1().ResourceQuotas("test").Get(ctx, "quota", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := thisrq.Status.Used[corev1.ResourceRequestsCPU]; used.String() != "2" {
+		t.Errorf("used after release = %v, want 2", used.String())
+	}
+	if _, ok := thisrq.Annotations[clusterresourcequota.AnnotationPodGroupReservations]; ok {
+		t.Errorf("expected the reservation removed, got %v", thisrq.Annotations)
+	}
+	syncQuotas()
+	stats, err = evaluator.UsageStats(quota.UsageStatsOptions{Namespace: "test", Resources: []corev1.ResourceName{corev1.ResourceRequestsCPU}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := stats.Used[corev1.ResourceRequestsCPU]; !used.IsZero() {
+		t.Errorf("reserved usage after release = %v, want 0", used.String())
+	}
+}
+
+func TestPodGroupEvaluator_ReservationsSize(t *testing.T) {
+	ctx := t.Context()
+
+	full := newCPUQuota("10", "0")
+	// a reservation of a member named after its group, each with about 4KiB
+	reservations := map[string]*clusterresourcequota.PodGroupReservation{}
+	for i := range clusterresourcequota.MaxPodGroupReservationsSize / 4096 {
+		group := fmt.Sprintf("group-%d", i)
+		reservations[group] = &clusterresourcequota.PodGroupReservation{
+			Size:    2,
+			Members: []string{group + strings.Repeat("x", 4096)},
+			Usage:   corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1")},
+			Quotas:  []string{full.Name},
+		}
+	}
+	data, err := json.Marshal(reservations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full.Annotations = map[string]string{clusterresourcequota.AnnotationPodGroupReservations: string(data)}
+	next := newCPUQuota("10", "0")
+	next.Name = "quota-next"
+
+	thisclientset := thisfake.NewSimpleClientset(full, next)
+	kubeclientset := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(kubeclientset, 0)
+	podevaluator := clusterresourcequota.NewConditionalPodEvaluator(informerFactory, nil)
+	informerFactory.Core().V1().Pods().Informer()
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	quotaClient := clusterresourcequota.HijackClientSet{Interface: kubeclientset, This: thisclientset}.CoreV1()
+	quotaLister := corev1listers.NewResourceQuotaLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}))
+	evaluator := clusterresourcequota.NewPodGroupEvaluator(podevaluator, quotaClient, quotaLister, time.Minute)
+
+	if err := evaluator.Admit(ctx, newPodGroupMember("group", 3, 0, "1"), "group", 3, func() error { return nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the new reservation is held by the next quota matching the group
+	rq, err := thisclientset.QuotaV1().ResourceQuotas("test").Get(ctx, next.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reservation := clusterresourcequota.PodGroupReservations(&corev1.ResourceQuota{ObjectMeta: rq.ObjectMeta})["group"]
+	if reservation == nil || reservation.Outstanding() != 2 {
+		t.Fatalf("expected a reservation of 2 outstanding members, got %+v", reservation)
+	}
+	if want := []string{full.Name, next.Name}; !slices.Equal(reservation.Quotas, want) {
+		t.Errorf("reservation quotas = %v, want %v", reservation.Quotas, want)
+	}
+	if cpu := reservation.Usage[corev1.ResourceRequestsCPU]; cpu.String() != "1" {
+		t.Errorf("reservation usage = %v, want requests.cpu=1", reservation.Usage)
+	}
+
+	// a group is rejected if no quota matching it has room
+	for _, name := range []string{full.Name, next.Name} {
+		rq, err := thisclientset.QuotaV1().ResourceQuotas("test").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rq.Annotations[clusterresourcequota.AnnotationPodGroupReservations] = string(data)
+		if _, err := thisclientset.QuotaV1().ResourceQuotas("test").Update(ctx, rq, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := evaluator.Admit(ctx, newPodGroupMember("other", 3, 0, "1"), "other", 3, func() error { return nil }); !apierrors.IsForbidden(err) {
+		t.Errorf("expected forbidden error, got: %v", err)
+	}
+}
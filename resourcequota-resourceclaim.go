@@ -0,0 +1,132 @@
+package clusterresourcequota
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/admission"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	"k8s.io/apiserver/pkg/quota/v1/generic"
+	"k8s.io/client-go/discovery"
+	"k8s.io/kubernetes/pkg/quota/v1/evaluator/core"
+)
+
+// ResourceClaimTemplateDevicesPerClass is the suffix of the resource name counting devices requested by
+// ResourceClaimTemplates per DeviceClass, e.g. "gpu.example.com.deviceclass.resource.k8s.io/template-devices".
+// It's apart from [corev1.ResourceClaimsPerClass], which counts devices of ResourceClaims,
+// as claims generated from a template are counted by the ResourceClaim evaluator.
+const ResourceClaimTemplateDevicesPerClass = ".deviceclass.resource.k8s.io/template-devices"
+
+// ResourceClaimTemplateObjectCountName is the object count resource name of ResourceClaimTemplates.
+var ResourceClaimTemplateObjectCountName = generic.ObjectCountQuotaResourceNameFor(resourceapi.Resource("resourceclaimtemplates"))
+
+// ResourceClaimTemplateResourceByDeviceClass returns the resource name counting devices requested by templates of the device class.
+func ResourceClaimTemplateResourceByDeviceClass(className string) corev1.ResourceName {
+	return corev1.ResourceName(className + ResourceClaimTemplateDevicesPerClass)
+}
+
+// IsDynamicResourceAllocationServed returns true if the server serves resource.k8s.io/v1,
+// the ResourceClaim evaluators are registered only if so, as their informers never sync otherwise.
+func IsDynamicResourceAllocationServed(discovery discovery.DiscoveryInterface) (bool, error) {
+	if _, err := discovery.ServerResourcesForGroupVersion(resourceapi.SchemeGroupVersion.String()); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+var _ quota.Evaluator = &ResourceClaimTemplateEvaluator{}
+
+// NewResourceClaimTemplateEvaluator returns an evaluator that counts ResourceClaimTemplates
+// and the devices requested by them per DeviceClass.
+func NewResourceClaimTemplateEvaluator(f quota.ListerForResourceFunc) quota.Evaluator {
+	return &ResourceClaimTemplateEvaluator{
+		claimEvaluator:      core.NewResourceClaimEvaluator(f),
+		listFuncByNamespace: generic.ListResourceUsingListerFunc(f, resourceapi.SchemeGroupVersion.WithResource("resourceclaimtemplates")),
+	}
+}
+
+type ResourceClaimTemplateEvaluator struct {
+	// claimEvaluator calculates the usage of the claims templated
+	claimEvaluator      quota.Evaluator
+	listFuncByNamespace generic.ListFuncByNamespace
+}
+
+// Constraints implements v1.Evaluator.
+func (e *ResourceClaimTemplateEvaluator) Constraints(required []corev1.ResourceName, item runtime.Object) error {
+	return nil
+}
+
+// GroupResource implements v1.Evaluator.
+func (e *ResourceClaimTemplateEvaluator) GroupResource() schema.GroupResource {
+	return resourceapi.Resource("resourceclaimtemplates")
+}
+
+// Handles implements v1.Evaluator.
+func (e *ResourceClaimTemplateEvaluator) Handles(a admission.Attributes) bool {
+	if a.GetSubresource() != "" {
+		return false
+	}
+	op := a.GetOperation()
+	return op == admission.Create || op == admission.Update
+}
+
+// Matches implements v1.Evaluator.
+func (e *ResourceClaimTemplateEvaluator) Matches(resourceQuota *corev1.ResourceQuota, item runtime.Object) (bool, error) {
+	return generic.Matches(resourceQuota, item, e.MatchingResources, generic.MatchesNoScopeFunc)
+}
+
+// MatchingScopes implements v1.Evaluator.
+func (e *ResourceClaimTemplateEvaluator) MatchingScopes(item runtime.Object, scopes []corev1.ScopedResourceSelectorRequirement) ([]corev1.ScopedResourceSelectorRequirement, error) {
+	return []corev1.ScopedResourceSelectorRequirement{}, nil
+}
+
+// UncoveredQuotaScopes implements v1.Evaluator.
+func (e *ResourceClaimTemplateEvaluator) UncoveredQuotaScopes(limitedScopes []corev1.ScopedResourceSelectorRequirement, matchedQuotaScopes []corev1.ScopedResourceSelectorRequirement) ([]corev1.ScopedResourceSelectorRequirement, error) {
+	return []corev1.ScopedResourceSelectorRequirement{}, nil
+}
+
+// MatchingResources implements v1.Evaluator.
+func (e *ResourceClaimTemplateEvaluator) MatchingResources(input []corev1.ResourceName) []corev1.ResourceName {
+	result := []corev1.ResourceName{}
+	for _, item := range input {
+		if item == ResourceClaimTemplateObjectCountName || strings.HasSuffix(string(item), ResourceClaimTemplateDevicesPerClass) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Usage implements v1.Evaluator.
+func (e *ResourceClaimTemplateEvaluator) Usage(item runtime.Object) (corev1.ResourceList, error) {
+	template, ok := item.(*resourceapi.ResourceClaimTemplate)
+	if !ok {
+		return nil, fmt.Errorf("expect %T, got %T", &resourceapi.ResourceClaimTemplate{}, item)
+	}
+	// the devices requested by the template are the devices requested by each claim generated from it
+	claimUsage, err := e.claimEvaluator.Usage(&resourceapi.ResourceClaim{Spec: template.Spec.Spec})
+	if err != nil {
+		return nil, err
+	}
+	result := corev1.ResourceList{}
+	for name, quantity := range claimUsage {
+		if className, ok := strings.CutSuffix(string(name), corev1.ResourceClaimsPerClass); ok {
+			result[ResourceClaimTemplateResourceByDeviceClass(className)] = quantity
+		}
+	}
+	result[ResourceClaimTemplateObjectCountName] = *resource.NewQuantity(1, resource.DecimalSI)
+	return result, nil
+}
+
+// UsageStats implements v1.Evaluator.
+func (e *ResourceClaimTemplateEvaluator) UsageStats(options quota.UsageStatsOptions) (quota.UsageStats, error) {
+	return generic.CalculateUsageStats(options, e.listFuncByNamespace, generic.MatchesNoScopeFunc, e.Usage)
+}
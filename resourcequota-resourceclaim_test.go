@@ -0,0 +1,55 @@
+package clusterresourcequota_test
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/quota/v1/generic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"xiaoshiai.cn/clusterresourcequota"
+)
+
+func TestResourceClaimTemplateEvaluator_Usage(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	evaluator := clusterresourcequota.NewResourceClaimTemplateEvaluator(generic.ListerFuncForResourceFunc(informerFactory.ForResource))
+
+	template := &resourceapi.ResourceClaimTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "gpu", Namespace: "test"},
+		Spec: resourceapi.ResourceClaimTemplateSpec{
+			Spec: resourceapi.ResourceClaimSpec{
+				Devices: resourceapi.DeviceClaim{
+					Requests: []resourceapi.DeviceRequest{
+						{Name: "gpu", Exactly: &resourceapi.ExactDeviceRequest{
+							DeviceClassName: "gpu.example.com",
+							AllocationMode:  resourceapi.DeviceAllocationModeExactCount,
+							Count:           2,
+						}},
+					},
+				},
+			},
+		},
+	}
+	usage, err := evaluator.Usage(template)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	devices := usage[clusterresourcequota.ResourceClaimTemplateResourceByDeviceClass("gpu.example.com")]
+	if devices.String() != "2" {
+		t.Errorf("devices = %v, want 2", devices.String())
+	}
+	count := usage[clusterresourcequota.ResourceClaimTemplateObjectCountName]
+	if count.String() != "1" {
+		t.Errorf("count = %v, want 1", count.String())
+	}
+	// devices of claims must not be charged by templates
+	if _, ok := usage[corev1.ResourceName("gpu.example.com"+corev1.ResourceClaimsPerClass)]; ok {
+		t.Errorf("unexpected claim devices in usage %v", usage)
+	}
+	matched := evaluator.MatchingResources([]corev1.ResourceName{corev1.ResourceName("gpu.example.com" + corev1.ResourceClaimsPerClass), "count/resourceclaimtemplates.resource.k8s.io"})
+	if len(matched) != 1 {
+		t.Errorf("MatchingResources() = %v, want the object count only", matched)
+	}
+}
@@ -0,0 +1,174 @@
+package clusterresourcequota
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/admission"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	"k8s.io/apiserver/pkg/quota/v1/generic"
+	"k8s.io/client-go/discovery"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// VolumeSnapshotGroupVersionResource is the resource of CSI VolumeSnapshots.
+var VolumeSnapshotGroupVersionResource = schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshots"}
+
+const (
+	// ResourceVolumeSnapshots is the number of VolumeSnapshots, used per VolumeSnapshotClass
+	ResourceVolumeSnapshots corev1.ResourceName = "volumesnapshots"
+	// ResourceVolumeSnapshotsStorage is the total estimated restore size of VolumeSnapshots
+	ResourceVolumeSnapshotsStorage corev1.ResourceName = "volumesnapshots.storage"
+	// volumeSnapshotClassSuffix is the suffix of the resources per VolumeSnapshotClass
+	volumeSnapshotClassSuffix string = ".volumesnapshotclass.snapshot.storage.k8s.io/"
+)
+
+// VolumeSnapshotObjectCountName is the object count resource name of VolumeSnapshots.
+var VolumeSnapshotObjectCountName = generic.ObjectCountQuotaResourceNameFor(VolumeSnapshotGroupVersionResource.GroupResource())
+
+// VolumeSnapshotResourceByClass returns the resource name of VolumeSnapshots of the class,
+// e.g. "csi-snapclass.volumesnapshotclass.snapshot.storage.k8s.io/volumesnapshots".
+func VolumeSnapshotResourceByClass(className string, resourceName corev1.ResourceName) corev1.ResourceName {
+	return corev1.ResourceName(className + volumeSnapshotClassSuffix + string(resourceName))
+}
+
+// IsVolumeSnapshotServed returns true if the server serves snapshot.storage.k8s.io/v1,
+// the VolumeSnapshot evaluator is registered only if so, as its informer never syncs otherwise.
+func IsVolumeSnapshotServed(discovery discovery.DiscoveryInterface) (bool, error) {
+	if _, err := discovery.ServerResourcesForGroupVersion(VolumeSnapshotGroupVersionResource.GroupVersion().String()); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+var _ quota.Evaluator = &VolumeSnapshotEvaluator{}
+
+// NewVolumeSnapshotEvaluator returns an evaluator that counts VolumeSnapshots and their estimated restore size,
+// in total and per VolumeSnapshotClass.
+// The restore size is estimated by the storage requested by the source PersistentVolumeClaim until it's reported in the status.
+func NewVolumeSnapshotEvaluator(f quota.ListerForResourceFunc, pvcLister corelisters.PersistentVolumeClaimLister) quota.Evaluator {
+	return &VolumeSnapshotEvaluator{
+		listFuncByNamespace: generic.ListResourceUsingListerFunc(f, VolumeSnapshotGroupVersionResource),
+		pvcLister:           pvcLister,
+	}
+}
+
+type VolumeSnapshotEvaluator struct {
+	listFuncByNamespace generic.ListFuncByNamespace
+	pvcLister           corelisters.PersistentVolumeClaimLister
+}
+
+// Constraints implements v1.Evaluator.
+func (e *VolumeSnapshotEvaluator) Constraints(required []corev1.ResourceName, item runtime.Object) error {
+	return nil
+}
+
+// GroupResource implements v1.Evaluator.
+func (e *VolumeSnapshotEvaluator) GroupResource() schema.GroupResource {
+	return VolumeSnapshotGroupVersionResource.GroupResource()
+}
+
+// Handles implements v1.Evaluator.
+func (e *VolumeSnapshotEvaluator) Handles(a admission.Attributes) bool {
+	if a.GetSubresource() != "" {
+		return false
+	}
+	op := a.GetOperation()
+	return op == admission.Create || op == admission.Update
+}
+
+// Matches implements v1.Evaluator.
+func (e *VolumeSnapshotEvaluator) Matches(resourceQuota *corev1.ResourceQuota, item runtime.Object) (bool, error) {
+	return generic.Matches(resourceQuota, item, e.MatchingResources, generic.MatchesNoScopeFunc)
+}
+
+// MatchingScopes implements v1.Evaluator.
+func (e *VolumeSnapshotEvaluator) MatchingScopes(item runtime.Object, scopes []corev1.ScopedResourceSelectorRequirement) ([]corev1.ScopedResourceSelectorRequirement, error) {
+	return []corev1.ScopedResourceSelectorRequirement{}, nil
+}
+
+// UncoveredQuotaScopes implements v1.Evaluator.
+func (e *VolumeSnapshotEvaluator) UncoveredQuotaScopes(limitedScopes []corev1.ScopedResourceSelectorRequirement, matchedQuotaScopes []corev1.ScopedResourceSelectorRequirement) ([]corev1.ScopedResourceSelectorRequirement, error) {
+	return []corev1.ScopedResourceSelectorRequirement{}, nil
+}
+
+// MatchingResources implements v1.Evaluator.
+func (e *VolumeSnapshotEvaluator) MatchingResources(input []corev1.ResourceName) []corev1.ResourceName {
+	result := []corev1.ResourceName{}
+	for _, item := range input {
+		if item == VolumeSnapshotObjectCountName || item == ResourceVolumeSnapshotsStorage {
+			result = append(result, item)
+			continue
+		}
+		if _, resourceName, ok := strings.Cut(string(item), volumeSnapshotClassSuffix); ok {
+			if resourceName == string(ResourceVolumeSnapshots) || resourceName == string(ResourceVolumeSnapshotsStorage) {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+// Usage implements v1.Evaluator.
+func (e *VolumeSnapshotEvaluator) Usage(item runtime.Object) (corev1.ResourceList, error) {
+	obj, ok := item.(runtime.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("expect %T, got %T", &unstructured.Unstructured{}, item)
+	}
+	u := &unstructured.Unstructured{Object: obj.UnstructuredContent()}
+	size, err := e.restoreSize(u)
+	if err != nil {
+		return nil, err
+	}
+	one := *resource.NewQuantity(1, resource.DecimalSI)
+	result := corev1.ResourceList{
+		VolumeSnapshotObjectCountName:  one,
+		ResourceVolumeSnapshotsStorage: size,
+	}
+	if className, _, _ := unstructured.NestedString(u.Object, "spec", "volumeSnapshotClassName"); className != "" {
+		result[VolumeSnapshotResourceByClass(className, ResourceVolumeSnapshots)] = one
+		result[VolumeSnapshotResourceByClass(className, ResourceVolumeSnapshotsStorage)] = size
+	}
+	return result, nil
+}
+
+// restoreSize returns the restore size in the status, or the storage requested by the source PersistentVolumeClaim,
+// snapshots of pre-provisioned contents are charged on the restore size only.
+func (e *VolumeSnapshotEvaluator) restoreSize(u *unstructured.Unstructured) (resource.Quantity, error) {
+	if value, ok, _ := unstructured.NestedFieldNoCopy(u.Object, "status", "restoreSize"); ok && value != nil {
+		size, err := resource.ParseQuantity(fmt.Sprint(value))
+		if err != nil {
+			return resource.Quantity{}, fmt.Errorf("invalid restoreSize of volumesnapshot %s: %w", u.GetName(), err)
+		}
+		return size, nil
+	}
+	pvcName, _, _ := unstructured.NestedString(u.Object, "spec", "source", "persistentVolumeClaimName")
+	if pvcName == "" {
+		return *resource.NewQuantity(0, resource.BinarySI), nil
+	}
+	pvc, err := e.pvcLister.PersistentVolumeClaims(u.GetNamespace()).Get(pvcName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return *resource.NewQuantity(0, resource.BinarySI), nil
+		}
+		return resource.Quantity{}, err
+	}
+	if capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+		return capacity, nil
+	}
+	return pvc.Spec.Resources.Requests[corev1.ResourceStorage], nil
+}
+
+// UsageStats implements v1.Evaluator.
+func (e *VolumeSnapshotEvaluator) UsageStats(options quota.UsageStatsOptions) (quota.UsageStats, error) {
+	return generic.CalculateUsageStats(options, e.listFuncByNamespace, generic.MatchesNoScopeFunc, e.Usage)
+}
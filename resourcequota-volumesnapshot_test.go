@@ -0,0 +1,91 @@
+package clusterresourcequota_test
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apiserver/pkg/quota/v1/generic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"xiaoshiai.cn/clusterresourcequota"
+)
+
+func TestVolumeSnapshotEvaluator_Usage(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	pvcInformer := informerFactory.Core().V1().PersistentVolumeClaims()
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "test"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+			},
+		},
+	}
+	if err := pvcInformer.Informer().GetIndexer().Add(pvc); err != nil {
+		t.Fatal(err)
+	}
+	evaluator := clusterresourcequota.NewVolumeSnapshotEvaluator(generic.ListerFuncForResourceFunc(informerFactory.ForResource), pvcInformer.Lister())
+
+	snapshot := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshot",
+		"metadata":   map[string]any{"name": "snapshot", "namespace": "test"},
+		"spec": map[string]any{
+			"volumeSnapshotClassName": "csi",
+			"source":                  map[string]any{"persistentVolumeClaimName": "data"},
+		},
+	}}
+
+	for _, tt := range []struct {
+		name        string
+		restoreSize any
+		wantStorage string
+	}{
+		{name: "estimated-by-pvc", wantStorage: "10Gi"},
+		{name: "restore-size", restoreSize: "8Gi", wantStorage: "8Gi"},
+		{name: "restore-size-in-bytes", restoreSize: int64(1024), wantStorage: "1Ki"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := snapshot.DeepCopy()
+			if tt.restoreSize != nil {
+				if err := unstructured.SetNestedField(obj.Object, tt.restoreSize, "status", "restoreSize"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			usage, err := evaluator.Usage(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := resource.MustParse(tt.wantStorage)
+			for _, name := range []corev1.ResourceName{
+				clusterresourcequota.ResourceVolumeSnapshotsStorage,
+				clusterresourcequota.VolumeSnapshotResourceByClass("csi", clusterresourcequota.ResourceVolumeSnapshotsStorage),
+			} {
+				if got := usage[name]; got.Cmp(want) != 0 {
+					t.Errorf("%s = %v, want %v", name, got.String(), tt.wantStorage)
+				}
+			}
+			for _, name := range []corev1.ResourceName{
+				clusterresourcequota.VolumeSnapshotObjectCountName,
+				clusterresourcequota.VolumeSnapshotResourceByClass("csi", clusterresourcequota.ResourceVolumeSnapshots),
+			} {
+				if got := usage[name]; got.Value() != 1 {
+					t.Errorf("%s = %v, want 1", name, got.String())
+				}
+			}
+		})
+	}
+
+	matched := evaluator.MatchingResources([]corev1.ResourceName{
+		"count/volumesnapshots.snapshot.storage.k8s.io",
+		"csi.volumesnapshotclass.snapshot.storage.k8s.io/volumesnapshots",
+		"csi.storageclass.storage.k8s.io/requests.storage",
+		"requests.storage",
+	})
+	if len(matched) != 2 {
+		t.Errorf("MatchingResources() = %v, want the snapshot resources only", matched)
+	}
+}
@@ -0,0 +1,138 @@
+package clusterresourcequota
+
+import (
+	"fmt"
+
+	"gopkg.in/inf.v0"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/kubernetes/pkg/apis/core/v1/helper"
+)
+
+// WeightedResource is a synthetic resource of pods, its usage is the weighted sum of other resources requested by pods,
+// e.g. "xiaoshiai.cn/gpu-units" counts an A100 as 1 and a T4 as 0.25.
+// The usage is reported as "requests.<name>", which is the resource name to limit in quotas.
+type WeightedResource struct {
+	// Name is the name of the synthetic resource, it must be an extended resource name, e.g. "xiaoshiai.cn/gpu-units"
+	Name corev1.ResourceName `json:"name"`
+	// Weights is the list of weights of requested resources,
+	// the first weight matching both the resource and the node labels of the pod applies.
+	Weights []ResourceWeight `json:"weights"`
+}
+
+type ResourceWeight struct {
+	// Resource is the name of the resource requested by containers, e.g. "nvidia.com/gpu"
+	Resource corev1.ResourceName `json:"resource"`
+	// NodeSelector is a label selector matched against the node labels of the pod, e.g. "nvidia.com/gpu.product=A100".
+	// The node labels are resolved the same way as the Topology scope, an empty selector matches all pods.
+	NodeSelector string `json:"nodeSelector,omitempty"`
+	// Weight is the amount of the synthetic resource counted for one unit of the resource
+	Weight resource.Quantity `json:"weight"`
+	// Unit is the amount of the resource the weight applies to, e.g. "1Gi" of memory, defaults to 1
+	Unit *resource.Quantity `json:"unit,omitempty"`
+}
+
+// ValidateWeightedResources validates the names and node selectors of weighted resources.
+func ValidateWeightedResources(weightedResources []WeightedResource) error {
+	var errs []error
+	for _, weighted := range weightedResources {
+		if !helper.IsExtendedResourceName(weighted.Name) {
+			errs = append(errs, fmt.Errorf("weighted resource %q must be an extended resource name", weighted.Name))
+		}
+		for _, weight := range weighted.Weights {
+			if _, err := labels.Parse(weight.NodeSelector); err != nil {
+				errs = append(errs, fmt.Errorf("weighted resource %q: invalid node selector %q: %w", weighted.Name, weight.NodeSelector, err))
+			}
+			if weight.Weight.Sign() < 0 {
+				errs = append(errs, fmt.Errorf("weighted resource %q: weight of %q must not be negative", weighted.Name, weight.Resource))
+			}
+			if weight.Unit != nil && weight.Unit.Sign() <= 0 {
+				errs = append(errs, fmt.Errorf("weighted resource %q: unit of %q must be positive", weighted.Name, weight.Resource))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// WeightedUsage calculates the usage of the weighted resources from the usage of a pod.
+// If bound, nodeLabels are the labels of the node the pod runs on, and the first matching weight applies.
+// Otherwise nodeLabels are only the labels required by the pod, and the highest weight which may apply once the pod is bound is charged,
+// so a pod is never charged less before it's bound than after, e.g. when every weight has a node selector.
+func WeightedUsage(weightedResources []WeightedResource, usage corev1.ResourceList, nodeLabels labels.Set, bound bool) (corev1.ResourceList, error) {
+	result := corev1.ResourceList{}
+	for _, weighted := range weightedResources {
+		charged := map[corev1.ResourceName]resource.Quantity{}
+		resolved := map[corev1.ResourceName]bool{}
+		for _, weight := range weighted.Weights {
+			if resolved[weight.Resource] {
+				continue
+			}
+			requested, ok := usage[corev1.ResourceName(corev1.DefaultResourceRequestsPrefix+weight.Resource)]
+			if !ok {
+				continue
+			}
+			selector, err := labels.Parse(weight.NodeSelector)
+			if err != nil {
+				return nil, err
+			}
+			if bound && !selector.Matches(nodeLabels) || !bound && !selectorMayMatch(selector, nodeLabels) {
+				continue
+			}
+			weightedQuantity := multiplyQuantities(requested, weight.Weight)
+			if weight.Unit != nil {
+				weightedQuantity = divideQuantities(weightedQuantity, *weight.Unit)
+			}
+			if existing, ok := charged[weight.Resource]; !ok || weightedQuantity.Cmp(existing) > 0 {
+				charged[weight.Resource] = weightedQuantity
+			}
+			// the later weights never apply once a weight surely matches
+			resolved[weight.Resource] = bound || selectorSurelyMatches(selector, nodeLabels)
+		}
+		if len(charged) != 0 {
+			total := *resource.NewQuantity(0, resource.DecimalSI)
+			for _, quantity := range charged {
+				total.Add(quantity)
+			}
+			result[corev1.ResourceName(corev1.DefaultResourceRequestsPrefix+weighted.Name)] = total
+		}
+	}
+	return result, nil
+}
+
+// selectorMayMatch returns false if a requirement of the selector conflicts with the known node labels,
+// the requirements on the labels not known may match the node the pod is bound to.
+func selectorMayMatch(selector labels.Selector, nodeLabels labels.Set) bool {
+	requirements, _ := selector.Requirements()
+	for _, requirement := range requirements {
+		if nodeLabels.Has(requirement.Key()) && !requirement.Matches(nodeLabels) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectorSurelyMatches returns true if the selector matches the known node labels and only requires known labels.
+func selectorSurelyMatches(selector labels.Selector, nodeLabels labels.Set) bool {
+	requirements, _ := selector.Requirements()
+	for _, requirement := range requirements {
+		if !nodeLabels.Has(requirement.Key()) {
+			return false
+		}
+	}
+	return selector.Matches(nodeLabels)
+}
+
+// multiplyQuantities returns the product of a and b.
+func multiplyQuantities(a, b resource.Quantity) resource.Quantity {
+	// AsDec converts the quantity in place, work on copies as the arguments may be shared
+	a, b = a.DeepCopy(), b.DeepCopy()
+	return *resource.NewDecimalQuantity(*new(inf.Dec).Mul(a.AsDec(), b.AsDec()), resource.DecimalSI)
+}
+
+// divideQuantities returns a divided by b, rounded up to the precision of quantities.
+func divideQuantities(a, b resource.Quantity) resource.Quantity {
+	a, b = a.DeepCopy(), b.DeepCopy()
+	return *resource.NewDecimalQuantity(*new(inf.Dec).QuoRound(a.AsDec(), b.AsDec(), 9, inf.RoundUp), resource.DecimalSI)
+}
@@ -0,0 +1,305 @@
+package clusterresourcequota
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	quotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+type WorkloadAdmissionMode string
+
+const (
+	// WorkloadAdmissionModeWarn admits the workload with a warning if it can not fit in the remaining quota
+	WorkloadAdmissionModeWarn WorkloadAdmissionMode = "Warn"
+	// WorkloadAdmissionModeDeny rejects the workload if it can not fit in the remaining quota
+	WorkloadAdmissionModeDeny WorkloadAdmissionMode = "Deny"
+)
+
+// WorkloadAdmission checks Deployments, StatefulSets, Jobs and their scale subresources before any pod is created,
+// the projected usage, replicas × usage of the pod template, is checked against the remaining capacity of
+// the ResourceQuotas matching the pod template and the ClusterResourceQuotas managing them.
+// Pods are still admitted by the resourcequota webhook, it only surfaces the failure early on the workload.
+type WorkloadAdmission struct {
+	Decoder   admission.Decoder
+	Client    client.Client
+	Evaluator quota.Evaluator
+	Mode      WorkloadAdmissionMode
+}
+
+// NewWorkloadAdmission returns the admission, evaluator is the pod evaluator used by the resourcequota webhook,
+// e.g. [NewConditionalPodEvaluator], so the pod template is scoped the same way as the pods.
+func NewWorkloadAdmission(client client.Client, evaluator quota.Evaluator, mode WorkloadAdmissionMode) *WorkloadAdmission {
+	return &WorkloadAdmission{
+		Decoder:   admission.NewDecoder(client.Scheme()),
+		Client:    client,
+		Evaluator: evaluator,
+		Mode:      mode,
+	}
+}
+
+// projectedWorkload is the pod template and the number of pods of a workload.
+type projectedWorkload struct {
+	Template *corev1.PodTemplateSpec
+	Replicas int32
+}
+
+func (c *WorkloadAdmission) Handle(ctx context.Context, req admission.Request) admission.Response {
+	log := logr.FromContextOrDiscard(ctx)
+
+	current, old, err := c.decodeWorkloads(ctx, req)
+	if err != nil {
+		log.Error(err, "Decode request")
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if current == nil {
+		return admission.Allowed("Not a workload")
+	}
+	delta, err := c.projectedDelta(current, old)
+	if err != nil {
+		log.Error(err, "Calculate projected usage")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(delta) == 0 {
+		return admission.Allowed("No additional usage")
+	}
+	pod := &corev1.Pod{ObjectMeta: current.Template.ObjectMeta, Spec: current.Template.Spec}
+	pod.Namespace = req.Namespace
+	exceeded, err := c.exceededQuotas(ctx, pod, delta)
+	if err != nil {
+		log.Error(err, "Check projected usage against quotas")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(exceeded) == 0 {
+		return admission.Allowed("Projected usage fits in quotas")
+	}
+	log.V(1).Info("Projected usage exceeds quotas", "exceeded", exceeded)
+	if c.Mode == WorkloadAdmissionModeDeny {
+		return admission.Denied(strings.Join(exceeded, "; "))
+	}
+	return admission.Allowed("").WithWarnings(exceeded...)
+}
+
+// decodeWorkloads returns the current and the old workload of the request, the current is nil if the request is not a workload.
+func (c *WorkloadAdmission) decodeWorkloads(ctx context.Context, req admission.Request) (*projectedWorkload, *projectedWorkload, error) {
+	if req.SubResource == "scale" {
+		return c.decodeScale(ctx, req)
+	}
+	if req.SubResource != "" {
+		return nil, nil, nil
+	}
+	current, err := c.decodeWorkload(req.Kind.Kind, req.Object)
+	if err != nil {
+		return nil, nil, err
+	}
+	old, err := c.decodeWorkload(req.Kind.Kind, req.OldObject)
+	if err != nil {
+		return nil, nil, err
+	}
+	return current, old, nil
+}
+
+func (c *WorkloadAdmission) decodeWorkload(kind string, raw runtime.RawExtension) (*projectedWorkload, error) {
+	if raw.Raw == nil {
+		return nil, nil
+	}
+	var obj client.Object
+	switch kind {
+	case "Deployment":
+		obj = &appsv1.Deployment{}
+	case "StatefulSet":
+		obj = &appsv1.StatefulSet{}
+	case "Job":
+		obj = &batchv1.Job{}
+	default:
+		return nil, nil
+	}
+	if err := c.Decoder.DecodeRaw(raw, obj); err != nil {
+		return nil, err
+	}
+	return workloadReplicas(obj), nil
+}
+
+// decodeScale returns the workload of the scale subresource with the replicas of the current and the old scale.
+func (c *WorkloadAdmission) decodeScale(ctx context.Context, req admission.Request) (*projectedWorkload, *projectedWorkload, error) {
+	var obj client.Object
+	switch req.Resource.Resource {
+	case "deployments":
+		obj = &appsv1.Deployment{}
+	case "statefulsets":
+		obj = &appsv1.StatefulSet{}
+	default:
+		return nil, nil, nil
+	}
+	scale := &autoscalingv1.Scale{}
+	if err := c.Decoder.DecodeRaw(req.Object, scale); err != nil {
+		return nil, nil, err
+	}
+	if err := c.Client.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: req.Name}, obj); err != nil {
+		return nil, nil, err
+	}
+	workload := workloadReplicas(obj)
+	current := &projectedWorkload{Template: workload.Template, Replicas: scale.Spec.Replicas}
+	old := workload
+	if req.OldObject.Raw != nil {
+		oldscale := &autoscalingv1.Scale{}
+		if err := c.Decoder.DecodeRaw(req.OldObject, oldscale); err != nil {
+			return nil, nil, err
+		}
+		old = &projectedWorkload{Template: workload.Template, Replicas: oldscale.Spec.Replicas}
+	}
+	return current, old, nil
+}
+
+// workloadReplicas returns the pod template and the number of pods running at the same time of a workload,
+// it's the parallelism of Jobs, or zero if the Job is suspended.
+func workloadReplicas(obj client.Object) *projectedWorkload {
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		return &projectedWorkload{Template: &workload.Spec.Template, Replicas: ptr.Deref(workload.Spec.Replicas, 1)}
+	case *appsv1.StatefulSet:
+		return &projectedWorkload{Template: &workload.Spec.Template, Replicas: ptr.Deref(workload.Spec.Replicas, 1)}
+	case *batchv1.Job:
+		replicas := ptr.Deref(workload.Spec.Parallelism, 1)
+		if workload.Spec.Completions != nil {
+			replicas = min(replicas, *workload.Spec.Completions)
+		}
+		if ptr.Deref(workload.Spec.Suspend, false) {
+			replicas = 0
+		}
+		return &projectedWorkload{Template: &workload.Spec.Template, Replicas: replicas}
+	default:
+		return nil
+	}
+}
+
+// projectedDelta returns the additional usage of the current workload over the old one,
+// only resources with positive delta are returned.
+func (c *WorkloadAdmission) projectedDelta(current, old *projectedWorkload) (corev1.ResourceList, error) {
+	usage, err := c.projectedUsage(current)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil {
+		oldusage, err := c.projectedUsage(old)
+		if err != nil {
+			return nil, err
+		}
+		usage = quota.Subtract(usage, oldusage)
+	}
+	delta := corev1.ResourceList{}
+	for name, quantity := range usage {
+		if quantity.Sign() > 0 {
+			delta[name] = quantity
+		}
+	}
+	return delta, nil
+}
+
+func (c *WorkloadAdmission) projectedUsage(workload *projectedWorkload) (corev1.ResourceList, error) {
+	if workload.Replicas <= 0 {
+		return corev1.ResourceList{}, nil
+	}
+	usage, err := c.Evaluator.Usage(&corev1.Pod{ObjectMeta: workload.Template.ObjectMeta, Spec: workload.Template.Spec})
+	if err != nil {
+		return nil, err
+	}
+	replicas := *resource.NewQuantity(int64(workload.Replicas), resource.DecimalSI)
+	result := corev1.ResourceList{}
+	for name, quantity := range usage {
+		result[name] = multiplyQuantities(quantity, replicas)
+	}
+	return result, nil
+}
+
+// exceededQuotas returns the messages of quotas matching the pod which can not hold the delta.
+func (c *WorkloadAdmission) exceededQuotas(ctx context.Context, pod *corev1.Pod, delta corev1.ResourceList) ([]string, error) {
+	quotaslist := &quotav1.ResourceQuotaList{}
+	if err := c.Client.List(ctx, quotaslist, client.InNamespace(pod.Namespace)); err != nil {
+		return nil, err
+	}
+	// clusterresourcequotas are checked once, even if the namespace has several quotas of them
+	checked := map[string]bool{}
+	var messages []string
+	for i := range quotaslist.Items {
+		rq := &quotaslist.Items[i]
+		matched, err := c.Evaluator.Matches(toQuota(rq), pod)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
+		}
+		if msg := exceededMessage(rq.Name, delta, rq.Status.Used, rq.Status.Hard); msg != "" {
+			messages = append(messages, msg)
+		}
+		crqname := rq.Labels[LabelClusterResourceQuota]
+		if crqname == "" {
+			continue
+		}
+		topology := rq.Labels[LabelClusterResourceQuotaTopology]
+		cachekey := ResourceQuotaCacheKey(crqname, topology)
+		if checked[cachekey] {
+			continue
+		}
+		checked[cachekey] = true
+		msg, err := c.exceededClusterResourceQuota(ctx, crqname, topology, delta)
+		if err != nil {
+			return nil, err
+		}
+		if msg != "" {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+func (c *WorkloadAdmission) exceededClusterResourceQuota(ctx context.Context, crqname, topology string, delta corev1.ResourceList) (string, error) {
+	crq := &quotav1.ClusterResourceQuota{}
+	if err := c.Client.Get(ctx, client.ObjectKey{Name: crqname}, crq); err != nil {
+		return "", client.IgnoreNotFound(err)
+	}
+	if topology == "" {
+		return exceededMessage("cluster quota "+crq.Name, delta, crq.Status.Used, crq.Status.Hard), nil
+	}
+	i := slices.IndexFunc(crq.Status.Topology, func(t quotav1.TopologyResourceQuotaStatus) bool {
+		return t.Value == topology
+	})
+	if i == -1 {
+		return "", nil
+	}
+	domain := crq.Status.Topology[i]
+	name := fmt.Sprintf("cluster quota %s, topology: %s", crq.Name, topology)
+	return exceededMessage(name, delta, domain.Used, domain.Hard), nil
+}
+
+// exceededMessage returns a message if used + delta exceeds hard on resources limited by hard, or empty if it fits.
+func exceededMessage(name string, delta, used, hard corev1.ResourceList) string {
+	limited := quota.Intersection(quota.ResourceNames(hard), quota.ResourceNames(delta))
+	if len(limited) == 0 {
+		return ""
+	}
+	requested := quota.Mask(delta, limited)
+	if ok, exceeded := quota.LessThanOrEqual(quota.Add(quota.Mask(used, limited), requested), quota.Mask(hard, limited)); !ok {
+		return fmt.Sprintf("projected usage exceeds quota: %s, requested: %s, used: %s, limited: %s",
+			name,
+			prettyPrint(quota.Mask(delta, exceeded)),
+			prettyPrint(quota.Mask(used, exceeded)),
+			prettyPrint(quota.Mask(hard, exceeded)))
+	}
+	return ""
+}
@@ -0,0 +1,176 @@
+package clusterresourcequota_test
+
+import (
+	"context"
+	"testing"
+
+	admv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"xiaoshiai.cn/clusterresourcequota"
+	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
+)
+
+func TestWorkloadAdmission_Handle(t *testing.T) {
+	ctx := context.Background()
+	scheme := clusterresourcequota.GetScheme()
+
+	template := corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "container",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+				},
+			}},
+		},
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "deploy", Namespace: "ns1"},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To[int32](2), Template: template},
+	}
+	objects := []runtime.Object{
+		deployment,
+		&thisquotav1.ClusterResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: "crq"},
+			Status: thisquotav1.ClusterResourceQuotaStatus{
+				ResourceQuotaStatus: corev1.ResourceQuotaStatus{
+					Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("6")},
+					Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("3")},
+				},
+			},
+		},
+		&thisquotav1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "clusterresourcequota.crq",
+				Namespace: "ns1",
+				Labels:    map[string]string{clusterresourcequota.LabelClusterResourceQuota: "crq"},
+			},
+			Status: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("6")},
+				Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1")},
+			},
+		},
+		&thisquotav1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: "gpu", Namespace: "ns1"},
+			Status: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{"requests.nvidia.com/gpu": resource.MustParse("1")},
+				Used: corev1.ResourceList{"requests.nvidia.com/gpu": resource.MustParse("0")},
+			},
+		},
+	}
+	client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).Build()
+
+	informerFactory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0)
+	evaluator := clusterresourcequota.NewConditionalPodEvaluator(informerFactory, nil)
+	informerFactory.Start(t.Context().Done())
+	informerFactory.WaitForCacheSync(t.Context().Done())
+
+	withReplicas := func(replicas int32) *appsv1.Deployment {
+		deploy := deployment.DeepCopy()
+		deploy.Spec.Replicas = ptr.To(replicas)
+		return deploy
+	}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "ns1"},
+		Spec:       batchv1.JobSpec{Parallelism: ptr.To[int32](10), Completions: ptr.To[int32](2), Template: template},
+	}
+	suspended := job.DeepCopy()
+	suspended.Spec.Parallelism = ptr.To[int32](10)
+	suspended.Spec.Completions = nil
+	suspended.Spec.Suspend = ptr.To(true)
+
+	for _, tt := range []struct {
+		name        string
+		req         admv1.AdmissionRequest
+		wantAllowed bool
+		wantWarning bool
+	}{
+		{
+			name: "create-fits",
+			req: admv1.AdmissionRequest{
+				Operation: admv1.Create, Namespace: "ns1",
+				Kind:   metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+				Object: toRawExtension(withReplicas(3)),
+			},
+			wantAllowed: true,
+		},
+		{
+			// the namespace quota still fits, but the cluster quota has 3 left
+			name: "create-exceeds-cluster-quota",
+			req: admv1.AdmissionRequest{
+				Operation: admv1.Create, Namespace: "ns1",
+				Kind:   metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+				Object: toRawExtension(withReplicas(4)),
+			},
+			wantWarning: true,
+		},
+		{
+			name: "update-charges-added-replicas",
+			req: admv1.AdmissionRequest{
+				Operation: admv1.Update, Namespace: "ns1",
+				Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+				Object:    toRawExtension(withReplicas(5)),
+				OldObject: toRawExtension(withReplicas(2)),
+			},
+			wantAllowed: true,
+		},
+		{
+			name: "scale-exceeds",
+			req: admv1.AdmissionRequest{
+				Operation: admv1.Update, Namespace: "ns1", Name: "deploy", SubResource: "scale",
+				Kind:      metav1.GroupVersionKind{Group: "autoscaling", Version: "v1", Kind: "Scale"},
+				Resource:  metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+				Object:    toRawExtension(&autoscalingv1.Scale{Spec: autoscalingv1.ScaleSpec{Replicas: 6}}),
+				OldObject: toRawExtension(&autoscalingv1.Scale{Spec: autoscalingv1.ScaleSpec{Replicas: 2}}),
+			},
+			wantWarning: true,
+		},
+		{
+			name: "job-completions-cap-parallelism",
+			req: admv1.AdmissionRequest{
+				Operation: admv1.Create, Namespace: "ns1",
+				Kind:   metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+				Object: toRawExtension(job),
+			},
+			wantAllowed: true,
+		},
+		{
+			name: "job-suspended",
+			req: admv1.AdmissionRequest{
+				Operation: admv1.Create, Namespace: "ns1",
+				Kind:   metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+				Object: toRawExtension(suspended),
+			},
+			wantAllowed: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			warn := clusterresourcequota.NewWorkloadAdmission(client, evaluator, clusterresourcequota.WorkloadAdmissionModeWarn)
+			resp := warn.Handle(ctx, admission.Request{AdmissionRequest: tt.req})
+			if !resp.Allowed {
+				t.Fatalf("expected allowed in Warn mode, got: %+v", resp.Result)
+			}
+			if got := len(resp.Warnings) != 0; got != tt.wantWarning {
+				t.Errorf("warnings = %v, want warning: %v", resp.Warnings, tt.wantWarning)
+			}
+
+			deny := clusterresourcequota.NewWorkloadAdmission(client, evaluator, clusterresourcequota.WorkloadAdmissionModeDeny)
+			resp = deny.Handle(ctx, admission.Request{AdmissionRequest: tt.req})
+			if resp.Allowed != tt.wantAllowed {
+				t.Errorf("allowed = %v, want %v: %+v", resp.Allowed, tt.wantAllowed, resp.Result)
+			}
+		})
+	}
+}
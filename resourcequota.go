@@ -2,10 +2,18 @@ package clusterresourcequota
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apiserver/pkg/admission"
 	"k8s.io/apiserver/pkg/admission/plugin/resourcequota"
 	resourcequotaapi "k8s.io/apiserver/pkg/admission/plugin/resourcequota/apis/resourcequota"
@@ -21,16 +29,75 @@ import (
 	resourcequotacontroller "k8s.io/kubernetes/pkg/controller/resourcequota"
 	"k8s.io/kubernetes/pkg/quota/v1/evaluator/core"
 	quotainstall "k8s.io/kubernetes/pkg/quota/v1/install"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
 )
 
-func NewResourceQuota(ctx context.Context, context *ControllerContext, rqConfig *resourcequotaapi.Configuration) (*ConditionalResourceQuotaController, admission.ValidationInterface, error) {
+var _ manager.LeaderElectionRunnable = &ConditionalResourceQuotaController{}
+
+// NewResourceQuota returns the resourcequota controller and the resourcequota admission,
+// the controller is nil if the role does not run controllers, so its monitors do not start informers on the webhook replicas.
+func NewResourceQuota(ctx context.Context, context *ControllerContext, rqConfig *ResourceQuotaConfiguration, role Role) (*ConditionalResourceQuotaController, admission.ValidationInterface, error) {
+	// a nil configuration is accepted by the admission plugin
+	var admissionConfig *resourcequotaapi.Configuration
+	var weightedResources []WeightedResource
+	var customEvaluators []CustomEvaluator
+	var podGroupTimeout time.Duration
+	if rqConfig != nil {
+		admissionConfig = &rqConfig.Configuration
+		weightedResources = rqConfig.PodWeightedResources()
+		customEvaluators = rqConfig.Evaluators
+		podGroupTimeout = rqConfig.PodGroupTimeout.Duration
+	}
+	hijackClientSet := HijackClientSet{Interface: context.Clientset, This: context.ThisClientSet}
+	hijackInformers := HijackSharedInformerFactory{SharedInformerFactory: context.InformerFactory, This: context.HijackedInformerFactory}
+
 	f := quota.ListerForResourceFunc(generic.ListerFuncForResourceFunc(context.InformerFactory.ForResource))
+	podGroupEvaluator := NewPodGroupEvaluator(NewConditionalPodEvaluator(context.InformerFactory, weightedResources),
+		hijackClientSet.CoreV1(), hijackInformers.Core().V1().ResourceQuotas().Lister(), podGroupTimeout)
+	// register the informers before the informer factory starts, so usage can be recalculated from them
+	context.InformerFactory.Core().V1().ConfigMaps().Informer()
+	context.InformerFactory.Core().V1().Secrets().Informer()
 	evaluators := []quota.Evaluator{
-		NewConditionalPodEvaluator(context.InformerFactory),
+		podGroupEvaluator,
 		core.NewServiceEvaluator(f),
 		core.NewPersistentVolumeClaimEvaluator(f),
+		NewConfigMapEvaluator(f),
+		NewSecretEvaluator(f),
+	}
+	draServed, err := IsDynamicResourceAllocationServed(context.Clientset.Discovery())
+	if err != nil {
+		return nil, nil, err
 	}
+	if draServed {
+		// register the informers before the informer factory starts, so usage can be recalculated from them
+		context.InformerFactory.Resource().V1().ResourceClaims().Informer()
+		context.InformerFactory.Resource().V1().ResourceClaimTemplates().Informer()
+		evaluators = append(evaluators,
+			core.NewResourceClaimEvaluator(f),
+			NewResourceClaimTemplateEvaluator(f),
+		)
+	}
+	dynamicf := quota.ListerForResourceFunc(generic.ListerFuncForResourceFunc(
+		func(gvr schema.GroupVersionResource) (informers.GenericInformer, error) {
+			return context.DynamicInformerFactory.ForResource(gvr), nil
+		}))
+	snapshotServed, err := IsVolumeSnapshotServed(context.Clientset.Discovery())
+	if err != nil {
+		return nil, nil, err
+	}
+	if snapshotServed {
+		// register the informer before the informer factory starts
+		context.DynamicInformerFactory.ForResource(VolumeSnapshotGroupVersionResource)
+		pvcLister := context.InformerFactory.Core().V1().PersistentVolumeClaims().Lister()
+		evaluators = append(evaluators, NewVolumeSnapshotEvaluator(dynamicf, pvcLister))
+	}
+	for _, custom := range customEvaluators {
+		// register the informer before the informer factory starts
+		context.DynamicInformerFactory.ForResource(custom.GroupVersionResource())
+		evaluators = append(evaluators, NewCustomResourceEvaluator(custom, dynamicf))
+	}
+	// object count evaluators of the other resources are created lazily by the admission plugin
 	ignoredResources := quotainstall.DefaultIgnoredResources()
 
 	// it make hijackInformer store corev1.ResourceQuota instead of ConditionalResourceQuota
@@ -43,15 +110,46 @@ func NewResourceQuota(ctx context.Context, context *ControllerContext, rqConfig
 		return toQuota(crq), nil
 	})
 
-	hijackInformers := HijackSharedInformerFactory{SharedInformerFactory: context.InformerFactory, This: context.HijackedInformerFactory}
-	hijackClientSet := HijackClientSet{Interface: context.Clientset, This: context.ThisClientSet}
-
 	config := generic.NewConfiguration(evaluators, ignoredResources)
 
-	admission, err := NewResourceQuotaAdmission(ctx, hijackClientSet, hijackInformers, config, rqConfig)
+	quotaAdmission, err := NewResourceQuotaAdmission(ctx, hijackClientSet, hijackInformers, config, admissionConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	// pods are charged again when they are bound, only to the quotas which match bound pods,
+	// the limited resources of the configuration have been checked when the pods were created
+	bindingConfig := generic.NewConfiguration([]quota.Evaluator{
+		&PodBindingEvaluator{Evaluator: NewConditionalPodEvaluator(context.InformerFactory, weightedResources)},
+	}, ignoredResources)
+	bindingAdmission, err := NewResourceQuotaAdmission(ctx, hijackClientSet, hijackInformers, bindingConfig, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// pods are charged to the ResourceQuotas of the queue when they are released from the queue of a ClusterResourceQuota
+	dequeueConfig := generic.NewConfiguration([]quota.Evaluator{
+		&PodDequeueEvaluator{Evaluator: NewConditionalPodEvaluator(context.InformerFactory, weightedResources)},
+	}, ignoredResources)
+	dequeueAdmission, err := NewResourceQuotaAdmission(ctx, hijackClientSet, hijackInformers, dequeueConfig, admissionConfig)
 	if err != nil {
 		return nil, nil, err
 	}
+	// pods are checked against the budgets of ClusterResourceQuotas whether they can be queued or not
+	validation := &PodBudgetAdmission{
+		ValidationInterface: &PodBindingAdmission{
+			ValidationInterface: &PodDequeueAdmission{
+				ValidationInterface: &PodGroupAdmission{ValidationInterface: quotaAdmission, Evaluator: podGroupEvaluator},
+				Dequeue:             dequeueAdmission,
+			},
+			Binding: bindingAdmission,
+			Pods:    context.Clientset.CoreV1(),
+		},
+		Evaluator:                  NewConditionalPodEvaluator(context.InformerFactory, weightedResources),
+		QuotaLister:                hijackInformers.Core().V1().ResourceQuotas().Lister(),
+		ClusterResourceQuotaLister: context.ThisInformerFactory.Quota().V1().ClusterResourceQuotas().Lister(),
+	}
+	if !role.Controller() {
+		return nil, validation, nil
+	}
 	quotacontroller, err := NewConditionalResourceQuotaController(ctx,
 		context.Clientset.Discovery(),
 		hijackClientSet.CoreV1(),
@@ -60,7 +158,9 @@ func NewResourceQuota(ctx context.Context, context *ControllerContext, rqConfig
 	if err != nil {
 		return nil, nil, err
 	}
-	return quotacontroller, admission, nil
+	// the expired reservations of pod groups are released by the leader
+	quotacontroller.podGroups = podGroupEvaluator
+	return quotacontroller, validation, nil
 }
 
 func NewResourceQuotaAdmission(ctx context.Context, clientset kubernetes.Interface, informers informers.SharedInformerFactory, c quota.Configuration, rqConfig *resourcequotaapi.Configuration) (*resourcequota.QuotaAdmission, error) {
@@ -94,23 +194,59 @@ func NewConditionalResourceQuotaController(ctx context.Context,
 		IgnoredResourcesFunc:      quotaConfiguration.IgnoredResources,
 		InformersStarted:          informersStarted,
 		Registry:                  generic.NewRegistry(quotaConfiguration.Evaluators()),
-		UpdateFilter:              quotainstall.DefaultUpdateFilter(),
+		UpdateFilter:              ConditionalUpdateFilter(),
 	}
 	resourceQuotaController, err := resourcequotacontroller.NewController(ctx, options)
 	if err != nil {
 		return nil, err
 	}
 	return &ConditionalResourceQuotaController{
-		Controller:    resourceQuotaController,
-		discoveryFunc: discoveryFunc,
-		started:       informersStarted,
+		Controller:       resourceQuotaController,
+		discoveryFunc:    discoveryFunc,
+		started:          informersStarted,
+		informerFactory:  objectmetadatainformer,
+		ignoredResources: quotaConfiguration.IgnoredResources(),
 	}, nil
 }
 
+// ConditionalUpdateFilter extends [quotainstall.DefaultUpdateFilter],
+// it also replenishes quota when a pod changes between the scopes provided by this project,
+// or is released from the queue of a ClusterResourceQuota.
+func ConditionalUpdateFilter() func(resource schema.GroupVersionResource, oldObj, newObj any) bool {
+	defaultFilter := quotainstall.DefaultUpdateFilter()
+	return func(resource schema.GroupVersionResource, oldObj, newObj any) bool {
+		if defaultFilter(resource, oldObj, newObj) {
+			return true
+		}
+		if resource.GroupResource() != corev1.Resource("pods") {
+			return false
+		}
+		oldPod, ok := oldObj.(*corev1.Pod)
+		if !ok {
+			return false
+		}
+		newPod, ok := newObj.(*corev1.Pod)
+		if !ok {
+			return false
+		}
+		// pod has been bound to a node, or released from the queue
+		return IsPodScheduled(oldPod) != IsPodScheduled(newPod) || IsPodQueued(oldPod) != IsPodQueued(newPod)
+	}
+}
+
 type ConditionalResourceQuotaController struct {
 	started       chan struct{}
 	discoveryFunc resourcequotacontroller.NamespacedResourcesFunc
 	*resourcequotacontroller.Controller
+
+	informerFactory  informerfactory.InformerFactory
+	ignoredResources map[schema.GroupResource]struct{}
+	// podGroups releases the expired reservations of pod groups
+	podGroups *PodGroupEvaluator
+	// running is set once the controller runs, it's never set on replicas not elected
+	running atomic.Bool
+	// discovered is the last successful discovery of the controller
+	discovered atomic.Pointer[[]*metav1.APIResourceList]
 }
 
 func (c *ConditionalResourceQuotaController) HasStarted() bool {
@@ -122,7 +258,20 @@ func (c *ConditionalResourceQuotaController) HasStarted() bool {
 	}
 }
 
+// Start runs the controller, it implements [manager.Runnable].
+func (c *ConditionalResourceQuotaController) Start(ctx context.Context) error {
+	c.Run(ctx)
+	return nil
+}
+
+// NeedLeaderElection implements [manager.LeaderElectionRunnable],
+// the controller writes the usage of quotas so only the leader runs it.
+func (c *ConditionalResourceQuotaController) NeedLeaderElection() bool {
+	return true
+}
+
 func (c *ConditionalResourceQuotaController) Run(ctx context.Context) {
+	c.running.Store(true)
 	eg := errgroup.Group{}
 	eg.Go(func() error {
 		c.Controller.Run(ctx, 1)
@@ -131,9 +280,62 @@ func (c *ConditionalResourceQuotaController) Run(ctx context.Context) {
 	if c.discoveryFunc != nil {
 		eg.Go(func() error {
 			// Periodically the quota controller to detect new resource types
-			c.Controller.Sync(ctx, c.discoveryFunc, time.Minute)
+			c.Controller.Sync(ctx, c.discover, time.Minute)
+			return nil
+		})
+	}
+	if c.podGroups != nil {
+		eg.Go(func() error {
+			c.podGroups.Run(ctx)
 			return nil
 		})
 	}
 	eg.Wait()
 }
+
+// discover records the resources discovered by the controller, the monitors of the controller are synced for them.
+func (c *ConditionalResourceQuotaController) discover() ([]*metav1.APIResourceList, error) {
+	resources, err := c.discoveryFunc()
+	if err == nil {
+		c.discovered.Store(&resources)
+	}
+	return resources, err
+}
+
+// Synced is a readyz check passing after the first discovery sync of the controller,
+// i.e. the informers of all quotable resources discovered have synced.
+// It passes if the controller is not running, e.g. on the replicas not elected.
+func (c *ConditionalResourceQuotaController) Synced(_ *http.Request) error {
+	if !c.running.Load() || c.discoveryFunc == nil {
+		return nil
+	}
+	discovered := c.discovered.Load()
+	if discovered == nil {
+		return fmt.Errorf("resource quota controller has not discovered resources")
+	}
+	resources, err := resourcequotacontroller.GetQuotableResources(func() ([]*metav1.APIResourceList, error) {
+		return *discovered, nil
+	})
+	if err != nil {
+		return err
+	}
+	var unsynced []string
+	for resource := range resources {
+		if _, ok := c.ignoredResources[resource.GroupResource()]; ok {
+			continue
+		}
+		// the same shared informer as the monitor of the resource
+		informer, err := c.informerFactory.ForResource(resource)
+		if err != nil {
+			return err
+		}
+		if !informer.Informer().HasSynced() {
+			unsynced = append(unsynced, resource.String())
+		}
+	}
+	if len(unsynced) > 0 {
+		slices.Sort(unsynced)
+		return fmt.Errorf("resource quota controller has not synced: %s", strings.Join(unsynced, ", "))
+	}
+	return nil
+}
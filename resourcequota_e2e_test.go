@@ -8,8 +8,10 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	thisquotav1 "xiaoshiai.cn/clusterresourcequota/apis/quota/v1"
@@ -255,4 +257,64 @@ var _ = Describe("ResourceQuota controller e2e", func() {
 		Expect(k8sClient.Delete(ctx, rq)).To(Succeed())
 		Expect(k8sClient.Delete(ctx, ns)).To(Succeed())
 	})
+
+	It("limits VolumeSnapshots per VolumeSnapshotClass", func() {
+		ctx := context.Background()
+		name := fmt.Sprintf("rq-snapshot-%d", time.Now().UnixNano())
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: name},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, pvc)).To(Succeed())
+
+		classStorage := VolumeSnapshotResourceByClass("csi", ResourceVolumeSnapshotsStorage)
+		rq := &thisquotav1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: "rq-snapshot", Namespace: name},
+			Spec: corev1.ResourceQuotaSpec{
+				Hard: corev1.ResourceList{
+					VolumeSnapshotObjectCountName: resource.MustParse("2"),
+					classStorage:                  resource.MustParse("1Gi"),
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, rq)).To(Succeed())
+		// the quota is enforced once its status is initialized by the controller
+		Eventually(func() bool {
+			var got thisquotav1.ResourceQuota
+			if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(rq), &got); err != nil {
+				return false
+			}
+			_, ok := got.Status.Hard[classStorage]
+			return ok
+		}, 20*time.Second, 500*time.Millisecond).Should(BeTrue())
+
+		snapshot := func(snapshotName string) *unstructured.Unstructured {
+			u := &unstructured.Unstructured{}
+			u.SetGroupVersionKind(VolumeSnapshotGroupVersionResource.GroupVersion().WithKind("VolumeSnapshot"))
+			u.SetNamespace(name)
+			u.SetName(snapshotName)
+			Expect(unstructured.SetNestedField(u.Object, "csi", "spec", "volumeSnapshotClassName")).To(Succeed())
+			Expect(unstructured.SetNestedField(u.Object, pvc.Name, "spec", "source", "persistentVolumeClaimName")).To(Succeed())
+			return u
+		}
+		first := snapshot("first")
+		Expect(k8sClient.Create(ctx, first)).To(Succeed())
+
+		// the restore size of the second snapshot exceeds the storage of the class
+		err := k8sClient.Create(ctx, snapshot("second"))
+		Expect(apierrors.IsForbidden(err)).To(BeTrue(), "expected forbidden error, got: %v", err)
+
+		// cleanup
+		Expect(k8sClient.Delete(ctx, first)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, rq)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, ns)).To(Succeed())
+	})
 })
@@ -4,6 +4,7 @@ import (
 	"context"
 	"strconv"
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -12,6 +13,7 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apiserver/pkg/admission"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
 	metadatafake "k8s.io/client-go/metadata/fake"
 	api "k8s.io/kubernetes/pkg/apis/core"
@@ -56,7 +58,7 @@ func TestAdmitLimitedResourceWithQuota(t *testing.T) {
 
 	context := NewFakeControllerContext(ctx, []runtime.Object{}, []runtime.Object{resourceQuota})
 
-	controller, admissionHandler, err := clusterresourcequota.NewResourceQuota(ctx, context, nil)
+	controller, admissionHandler, err := clusterresourcequota.NewResourceQuota(ctx, context, nil, clusterresourcequota.RoleAll)
 	if err != nil {
 		t.Errorf("Error occurred while creating admission plugin: %v", err)
 	}
@@ -98,12 +100,142 @@ func TestAdmitLimitedResourceWithQuota(t *testing.T) {
 	}
 }
 
+func TestAdmitWeightedResourceUnscheduled(t *testing.T) {
+	ctx := t.Context()
+	const gpuUnits = corev1.ResourceName("requests.xiaoshiai.cn/gpu-units")
+	resourceQuota := &thisquotav1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "quota", Namespace: "test", ResourceVersion: "124"},
+		Spec:       corev1.ResourceQuotaSpec{Hard: corev1.ResourceList{gpuUnits: resource.MustParse("1")}},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{gpuUnits: resource.MustParse("1")},
+			Used: corev1.ResourceList{gpuUnits: resource.MustParse("0")},
+		},
+	}
+	rqConfig := &clusterresourcequota.ResourceQuotaConfiguration{
+		WeightedResources: []clusterresourcequota.WeightedResource{{
+			Name: "xiaoshiai.cn/gpu-units",
+			Weights: []clusterresourcequota.ResourceWeight{
+				{Resource: "nvidia.com/gpu", NodeSelector: "nvidia.com/gpu.product=A100", Weight: resource.MustParse("1")},
+				{Resource: "nvidia.com/gpu", NodeSelector: "nvidia.com/gpu.product=T4", Weight: resource.MustParse("0.25")},
+			},
+		}},
+	}
+	newGPUPod := func(name string, nodeSelector map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test"},
+			Spec: corev1.PodSpec{
+				NodeSelector: nodeSelector,
+				Containers: []corev1.Container{{
+					Name: "container",
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")},
+						Limits:   corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")},
+					},
+				}},
+			},
+		}
+	}
+	pod := newGPUPod("pod", nil)
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-t4", Labels: map[string]string{"nvidia.com/gpu.product": "T4"}}}
+	context := NewFakeControllerContext(ctx, []runtime.Object{pod}, []runtime.Object{resourceQuota})
+	if err := context.InformerFactory.Core().V1().Nodes().Informer().GetStore().Add(node); err != nil {
+		t.Fatal(err)
+	}
+	_, admissionHandler, err := clusterresourcequota.NewResourceQuota(ctx, context, rqConfig, clusterresourcequota.RoleAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := func() string {
+		t.Helper()
+		rq, err := context.ThisClientSet.QuotaV1().ResourceQuotas("test").Get(ctx, "quota", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		quantity := rq.Status.Used[gpuUnits]
+		return quantity.String()
+	}
+
+	// the node is not known yet, the pod may run on an A100
+	if err := admissionHandler.Validate(ctx, createPodAttributes(pod), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := used(); got != "1" {
+		t.Fatalf("used = %s, want the highest weight 1 charged before the pod is bound", got)
+	}
+	// the informer observes the charged quota, it stores the quota converted by the hijacked informer
+	rq, err := context.ThisClientSet.QuotaV1().ResourceQuotas("test").Get(ctx, "quota", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	observed := &corev1.ResourceQuota{ObjectMeta: rq.ObjectMeta, Spec: rq.Spec, Status: rq.Status}
+	if err := context.HijackedInformerFactory.Quota().V1().ResourceQuotas().Informer().GetStore().Add(observed); err != nil {
+		t.Fatal(err)
+	}
+	// a pod selecting T4 nodes is charged its weight, it exceeds the highest weight charged already
+	if err := admissionHandler.Validate(ctx, createPodAttributes(newGPUPod("t4", map[string]string{"nvidia.com/gpu.product": "T4"})), nil); !apierrors.IsForbidden(err) {
+		t.Fatalf("expected forbidden error, got: %v", err)
+	}
+
+	// the binding charges nothing more, the usage of the bound pod is recounted by the controller
+	binding := admission.NewAttributesRecord(
+		&corev1.Binding{ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace}, Target: corev1.ObjectReference{Kind: "Node", Name: node.Name}},
+		nil, corev1.SchemeGroupVersion.WithKind("Binding"), pod.Namespace, pod.Name,
+		corev1.SchemeGroupVersion.WithResource("pods"), "binding", admission.Create, &metav1.CreateOptions{}, false, nil)
+	if err := admissionHandler.Validate(ctx, binding, nil); err != nil {
+		t.Fatalf("unexpected error on binding: %v", err)
+	}
+	if got := used(); got != "1" {
+		t.Errorf("used = %s after bound, want unchanged 1", got)
+	}
+	evaluator := clusterresourcequota.NewConditionalPodEvaluator(context.InformerFactory, rqConfig.PodWeightedResources())
+	bound := pod.DeepCopy()
+	bound.Spec.NodeName = node.Name
+	usage, err := evaluator.Usage(bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := usage[gpuUnits]; got.String() != "250m" {
+		t.Errorf("recounted usage = %s, want the weight of T4 250m", got.String())
+	}
+}
+
+func TestResourceQuota_LeaderElection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	controllerContext := NewFakeControllerContext(ctx, []runtime.Object{}, []runtime.Object{})
+	controller, _, err := clusterresourcequota.NewResourceQuota(ctx, controllerContext, nil, clusterresourcequota.RoleAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the controller writes the usage, the informers are used by the webhooks of every replica
+	if !controller.NeedLeaderElection() {
+		t.Errorf("expected the resource quota controller run by the leader only")
+	}
+	if controllerContext.NeedLeaderElection() {
+		t.Errorf("expected the informers run by every replica")
+	}
+
+	done := make(chan error)
+	go func() { done <- controllerContext.Start(ctx) }()
+	select {
+	case <-controllerContext.InformersStarted:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("informers not started")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
 func NewFakeControllerContext(ctx context.Context, kubeobjects []runtime.Object, thisobjects []runtime.Object) *clusterresourcequota.ControllerContext {
 	schema := clusterresourcequota.GetScheme()
 	kubeClient := fake.NewSimpleClientset(kubeobjects...)
 	metadataClient := metadatafake.NewSimpleMetadataClient(schema, kubeobjects...)
 	thisclientset := thisfake.NewSimpleClientset(thisobjects...)
-	c, err := clusterresourcequota.NewControllerContextFromClientSet(ctx, kubeClient, thisclientset, metadataClient, 0)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(schema, kubeobjects...)
+	c, err := clusterresourcequota.NewControllerContextFromClientSet(ctx, kubeClient, thisclientset, metadataClient, dynamicClient, 0)
 	if err != nil {
 		panic(err)
 	}
@@ -73,7 +73,11 @@ var _ = BeforeSuite(func() {
 	}
 
 	testEnv = &envtest.Environment{
-		CRDDirectoryPaths:     []string{filepath.Join("deploy", "clusterresourcequota", "crds")},
+		CRDDirectoryPaths: []string{
+			filepath.Join("deploy", "clusterresourcequota", "crds"),
+			// CRDs of third party resources evaluated by the webhook
+			filepath.Join("testdata", "crds"),
+		},
 		ErrorIfCRDPathMissing: true,
 		DownloadBinaryAssets:  true,
 		BinaryAssetsDirectory: binaryDir,